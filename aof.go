@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type fsyncPolicy string
+
+const (
+	fsyncAlways   fsyncPolicy = "always"
+	fsyncEverySec fsyncPolicy = "everysec"
+	fsyncNo       fsyncPolicy = "no"
+)
+
+var fsyncPolicies = []fsyncPolicy{
+	fsyncAlways,
+	fsyncEverySec,
+	fsyncNo,
+}
+
+// appendLog is the append-only command log (AOF). It holds every write
+// command accepted since the last snapshot, so a crash only loses what the
+// fsync policy allows instead of everything since the last persist.
+type appendLog struct {
+	path          string
+	policy        fsyncPolicy
+	file          *os.File
+	sink          *sink
+	syncing       sync.Mutex
+	size          int
+	baseSize      int
+	rewriting     bool
+	rewriteTmp    string
+	rewriteBuffer [][][]byte
+	rewritten     chan struct{} // Closed once the new log is written
+}
+
+// The log is rewritten in background when it doubles in size since the last
+// rewrite (or rotation), as long as it is not too small to bother
+const aofRewritePercentage = 100
+const aofRewriteMinSize = 1024 * 1024 * 64 // 64mb
+
+func parseFsyncPolicy(policy string) (fsyncPolicy, error) {
+	for _, p := range fsyncPolicies {
+		if string(p) == policy {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid fsync policy \"%v\" (always, everysec or no)", policy)
+}
+
+func newAppendLog(path string, policy fsyncPolicy) *appendLog {
+	return &appendLog{path: absPath(path), policy: policy}
+}
+
+func (l *appendLog) open() {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fatalError("Error opening append-only log", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		fatalError("Error reading append-only log size", err)
+	}
+	l.file = file
+	l.sink = newSink(file, 4096)
+	l.size = int(stat.Size())
+}
+
+func (l *appendLog) close() {
+	l.syncing.Lock()
+	defer l.syncing.Unlock()
+	l.closeFile()
+}
+
+// closeFile flushes and closes the file. The syncing lock must be held, so a
+// background fsync never gets the file while it is closed or replaced.
+func (l *appendLog) closeFile() {
+	err := l.file.Sync()
+	if err != nil {
+		fatalError("Error syncing append-only log", err)
+	}
+	err = l.file.Close()
+	if err != nil {
+		logError("Error closing append-only log", err)
+	}
+}
+
+// append writes the command to the log. Under the always policy the data is
+// flushed to the disk before returning, otherwise it is only handed to the OS.
+func (l *appendLog) append(c *command) *ioData {
+	pieces := c.toPieces()
+	data, err := l.sink.flushArrayOfProtocolStrings(pieces...)
+	if err != nil {
+		fatalError("Error writing to append-only log", err)
+	}
+	if l.policy == fsyncAlways {
+		l.fsync()
+	}
+	if l.rewriting {
+		// The rewrite only knows the state from when it started, so it must
+		// get whatever came after that before replacing the current log
+		l.rewriteBuffer = append(l.rewriteBuffer, pieces)
+	}
+	l.size += data.getByteCount()
+	return data
+}
+
+// tick is called once a second by the heartbeat. The fsync runs in the
+// background so a slow disk does not stall the event loop.
+func (l *appendLog) tick() {
+	if l.policy == fsyncEverySec {
+		go l.tryFsync()
+	}
+}
+
+func (l *appendLog) tryFsync() {
+	if !l.syncing.TryLock() {
+		return // The previous fsync is still running
+	}
+	defer l.syncing.Unlock()
+	err := l.file.Sync()
+	if err != nil {
+		logError("Error syncing append-only log", err)
+	}
+}
+
+func (l *appendLog) fsync() {
+	l.syncing.Lock()
+	defer l.syncing.Unlock()
+	err := l.file.Sync()
+	if err != nil {
+		fatalError("Error syncing append-only log", err)
+	}
+}
+
+func (l *appendLog) getPreviousPath() string {
+	return l.path + ".prev"
+}
+
+// rotate moves the current log aside while a snapshot is being written. The
+// previous log is only removed once the snapshot is safely on disk, so if the
+// process dies mid-snapshot both logs are replayed on top of the old snapshot.
+func (l *appendLog) rotate() {
+	l.syncing.Lock()
+	defer l.syncing.Unlock()
+	l.closeFile()
+	err := os.Rename(l.path, l.getPreviousPath())
+	if err != nil {
+		fatalError("Error rotating append-only log", err)
+	}
+	l.open()
+	l.baseSize = 0
+}
+
+func (l *appendLog) isRewriting() bool {
+	return l.rewriting
+}
+
+func (l *appendLog) mustRewrite() bool {
+	growth := l.baseSize * (100 + aofRewritePercentage) / 100
+	return !l.rewriting && l.size >= aofRewriteMinSize && l.size >= growth
+}
+
+func (l *appendLog) startRewrite(tmp string) {
+	l.rewriting = true
+	l.rewriteTmp = tmp
+	l.rewriteBuffer = make([][][]byte, 0)
+	l.rewritten = make(chan struct{})
+}
+
+// markRewritten is called by the rewrite in background once it is done
+// writing the new log to the temp file
+func (l *appendLog) markRewritten() {
+	close(l.rewritten)
+}
+
+// abortRewrite waits for the new log to be written and throws it away,
+// keeping the current log as it is
+func (l *appendLog) abortRewrite() {
+	<-l.rewritten
+	err := os.Remove(l.rewriteTmp)
+	if err != nil {
+		logError("Error removing rewritten append-only log", err)
+	}
+	l.resetRewrite()
+}
+
+func (l *appendLog) resetRewrite() {
+	l.rewriting = false
+	l.rewriteTmp = ""
+	l.rewriteBuffer = nil
+	l.rewritten = nil
+}
+
+// finishRewrite appends the commands buffered during the rewrite to the new
+// log and atomically puts it in place of the current one
+func (l *appendLog) finishRewrite(tmp string) *ioData {
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fatalError("Error opening rewritten append-only log", err)
+	}
+
+	sink := newSink(file, 4096)
+	total := newIoData()
+
+	for _, pieces := range l.rewriteBuffer {
+		sink.writeArrayOfProtocolStrings(pieces...)
+		if sink.full() {
+			data, err := sink.flush()
+			total.merge(data)
+			if err != nil {
+				fatalError("Error writing to rewritten append-only log", err)
+			}
+		}
+	}
+
+	data, err := sink.flush()
+	total.merge(data)
+	if err != nil {
+		fatalError("Error writing to rewritten append-only log", err)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		fatalError("Error syncing rewritten append-only log", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		fatalError("Error closing rewritten append-only log", err)
+	}
+
+	l.syncing.Lock()
+	defer l.syncing.Unlock()
+	l.closeFile()
+
+	err = os.Rename(tmp, l.path)
+	if err != nil {
+		fatalError("Error replacing append-only log with the rewritten one", err)
+	}
+
+	l.open()
+	l.baseSize = l.size
+	l.resetRewrite()
+	return total
+}
+
+// replaceWith puts the file, which must be equivalent to both logs, in place
+// of them. The log must be closed.
+func (l *appendLog) replaceWith(tmp string) {
+	err := os.Rename(tmp, l.path)
+	if err != nil {
+		fatalError("Error replacing append-only log", err)
+	}
+	l.dropPrevious()
+}
+
+func (l *appendLog) genTempFile() (*os.File, error) {
+	dir := filepath.Dir(l.path)
+	return os.CreateTemp(dir, "aetherg-*.aof.tmp")
+}
+
+func (l *appendLog) dropPrevious() {
+	path := l.getPreviousPath()
+	if !fileExists(path) {
+		return
+	}
+	err := os.Remove(path)
+	if err != nil {
+		fatalError("Error removing previous append-only log", err)
+	}
+}
+
+// replay feeds every command found in the logs to the given function,
+// returning the number of commands read. A command cut in half by a crash at
+// the end of a log is discarded.
+func (l *appendLog) replay(apply func(*command)) int {
+	count := 0
+	for _, path := range []string{l.getPreviousPath(), l.path} {
+		if !fileExists(path) {
+			continue
+		}
+		count += l.replayFile(path, apply)
+	}
+	return count
+}
+
+func (l *appendLog) replayFile(path string, apply func(*command)) int {
+	info("Replaying append-only log", log.Fields{"path": path})
+
+	file, err := os.Open(path)
+	if err != nil {
+		fatalError("Error opening append-only log", err)
+	}
+	defer file.Close()
+
+	src := newBufferedSource(file, 4096)
+	parser := newParser(src)
+	buffer := &transactionBuffer{}
+	count := 0
+
+	for {
+		command, _, err := parser.next()
+		switch {
+		case err == nil:
+			if !command.isWriteCommand() && !command.isTransactionCommand() {
+				fatal("Invalid command in append-only log", log.Fields{"code": command.getCode()})
+			}
+			for _, c := range buffer.add(command) {
+				apply(c)
+				count++
+			}
+		case err.isEOF():
+			if buffer.pending() {
+				// Cut in half by a crash, so none of it was acknowledged
+				log.WithField("path", path).Warn("Unfinished transaction at the end of the append-only log discarded")
+			}
+			info("Append-only log replayed (EOF reached)", log.Fields{"path": path, "commands": count})
+			return count
+		default:
+			fatalError("Error reading append-only log", err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendLogReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.aof")
+
+	aof := newAppendLog(path, fsyncAlways)
+	aof.open()
+	aof.append(newCommand(commandSet, "key0", []byte("value zero"), 0))
+	aof.append(newCommand(commandSet, "key1", []byte("value one"), 360))
+	aof.append(newCommand(commandRm, "key0", []byte{}, 0))
+	aof.close()
+
+	replayed := make([]*command, 0)
+	count := aof.replay(func(c *command) {
+		replayed = append(replayed, c)
+	})
+
+	assert.Equal(3, count)
+	assert.Equal(commandSet, replayed[0].getCode())
+	assert.Equal("key0", replayed[0].getKey())
+	assert.Equal([]byte("value zero"), replayed[0].getValue())
+	assert.Equal(360, replayed[1].getExpiration())
+	assert.Equal(commandRm, replayed[2].getCode())
+}
+
+func TestAppendLogRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.aof")
+
+	aof := newAppendLog(path, fsyncNo)
+	aof.open()
+	aof.append(newCommand(commandSet, "key0", []byte("value zero"), 0))
+	aof.rotate()
+	aof.append(newCommand(commandSet, "key1", []byte("value one"), 0))
+	aof.close()
+
+	assert.True(fileExists(aof.getPreviousPath()))
+	assert.Equal(2, aof.replay(func(*command) {}))
+
+	aof.dropPrevious()
+
+	assert.False(fileExists(aof.getPreviousPath()))
+	assert.Equal(1, aof.replay(func(*command) {}))
+}
+
+func TestAppendLogRotationWhileSyncing(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.aof")
+
+	aof := newAppendLog(path, fsyncEverySec)
+	aof.open()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				aof.tryFsync()
+			}
+		}
+	}()
+	for n := 0; n < 100; n++ {
+		aof.append(newCommand(commandSet, "key0", []byte("value zero"), 0))
+		aof.rotate()
+		aof.dropPrevious()
+	}
+	close(stop)
+	<-done
+	aof.close()
+
+	assert.Equal(0, aof.replay(func(*command) {}))
+}
+
+func TestAppendLogRewriteKeepsBufferedCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.aof")
+
+	aof := newAppendLog(path, fsyncNo)
+	aof.open()
+	aof.append(newCommand(commandSet, "key0", []byte("value zero"), 0))
+	aof.append(newCommand(commandSet, "key0", []byte("value one"), 0))
+
+	tmp, err := aof.genTempFile()
+	assert.Nil(err)
+	aof.startRewrite(tmp.Name())
+	assert.True(aof.isRewriting())
+	sink := newSink(tmp, 4096)
+	_, err = sink.flushArrayOfProtocolStrings([]byte("SET"), []byte("key0"), []byte("value one"))
+	assert.Nil(err)
+	assert.Nil(tmp.Close())
+
+	aof.append(newCommand(commandRm, "key0", []byte{}, 0))
+	aof.finishRewrite(tmp.Name())
+	assert.False(aof.isRewriting())
+	assert.Equal(aof.size, aof.baseSize)
+	aof.close()
+
+	codes := make([]commandCode, 0)
+	aof.replay(func(c *command) {
+		codes = append(codes, c.getCode())
+	})
+
+	assert.Equal([]commandCode{commandSet, commandRm}, codes)
+	assert.False(fileExists(tmp.Name()))
+}
+
+func TestAppendLogRewriteAborted(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.aof")
+
+	aof := newAppendLog(path, fsyncNo)
+	aof.open()
+	aof.append(newCommand(commandSet, "key0", []byte("value zero"), 0))
+
+	tmp, err := aof.genTempFile()
+	assert.Nil(err)
+	assert.Nil(tmp.Close())
+	aof.startRewrite(tmp.Name())
+	aof.append(newCommand(commandSet, "key1", []byte("value one"), 0))
+
+	go aof.markRewritten()
+	aof.abortRewrite()
+	assert.False(aof.isRewriting())
+	assert.False(fileExists(tmp.Name()), "the new log is removed")
+	aof.close()
+
+	assert.Equal(2, aof.replay(func(*command) {}), "the current log is kept")
+}
+
+func TestAppendLogReplayDiscardsUnfinishedTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.aof")
+
+	aof := newAppendLog(path, fsyncNo)
+	aof.open()
+	aof.append(newCommand(commandMulti, "", []byte{}, 0))
+	aof.append(newCommand(commandSet, "key0", []byte("value zero"), 0))
+	aof.append(newCommand(commandExec, "", []byte{}, 0))
+	aof.append(newCommand(commandMulti, "", []byte{}, 0))
+	aof.append(newCommand(commandSet, "key1", []byte("value one"), 0))
+	aof.close()
+
+	replayed := make([]*command, 0)
+	count := aof.replay(func(c *command) {
+		replayed = append(replayed, c)
+	})
+
+	assert.Equal(1, count)
+	assert.Equal("key0", replayed[0].getKey())
+}
+
+func TestAppendLogConsolidationKeepsTransientKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	newServer := func() *AetherServer {
+		return &AetherServer{
+			hm:       newHashmap(),
+			events:   make(chan event, 16),
+			snapFile: filepath.Join(dir, "test.snap"),
+			aof:      newAppendLog(filepath.Join(dir, "test.aof"), fsyncNo),
+		}
+	}
+
+	server := newServer()
+	server.aof.open()
+	server.aof.append(newCommand(commandSet, "ttl", []byte("value"), 360))
+	server.aof.append(newCommand(commandSet, "forever", []byte("value"), 0))
+	server.aof.close()
+
+	server.loadAppendLog()
+	server.aof.close()
+	assert.Equal(0, server.aof.replay(func(*command) {}), "the log is consolidated into the snapshot")
+
+	restarted := newServer()
+	restarted.loadSnapshot()
+	i, found := restarted.hm.get("ttl")
+	assert.True(found, "keys with an expiration survive the consolidation")
+	assert.InDelta(nowMillis()+360000, i.getDeadline(), 1000)
+	_, found = restarted.hm.get("forever")
+	assert.True(found)
+}
+
+func TestAppendLogConsolidationCutShort(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	newServer := func() *AetherServer {
+		return &AetherServer{
+			hm:       newHashmap(),
+			waiting:  newWaitingList(),
+			events:   make(chan event, 16),
+			snapFile: filepath.Join(dir, "test.snap"),
+			aof:      newAppendLog(filepath.Join(dir, "test.aof"), fsyncNo),
+		}
+	}
+
+	server := newServer()
+	server.aof.open()
+	server.aof.append(newArgsCommand(commandRpush, "l", [][]byte{[]byte("a")}))
+	server.aof.rotate()
+	server.aof.append(newArgsCommand(commandRpush, "l", [][]byte{[]byte("b")}))
+	server.aof.close()
+
+	// Dies once the snapshot is written, before the log is cleared
+	server.aof.replay(server.apply)
+	items := server.getItems()
+	server.replaceAppendLog(items)
+	server.persist(items)
+	assert.False(fileExists(server.aof.getPreviousPath()))
+
+	restarted := newServer()
+	restarted.loadSnapshot()
+	restarted.loadAppendLog()
+	restarted.aof.close()
+	l, _ := restarted.hm.get("l")
+	assert.Equal([][]byte{[]byte("a"), []byte("b")}, l.lrange(0, -1), "the writes are not applied twice")
+}
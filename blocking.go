@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// blockingState is what a client parked by a blocking command is waiting for
+type blockingState struct {
+	command  *command
+	keys     []string
+	deadline time.Time // Zero means wait forever
+	// serve replies the client if the key that got ready has what it waits for
+	serve func(s *AetherServer, key string) (element, bool)
+}
+
+// waitingList holds the clients blocked on each key, in arrival order
+type waitingList struct {
+	keys map[string][]*aetherClient
+	// Keys that got new elements and may serve the clients waiting on them
+	ready map[string]bool
+}
+
+func newWaitingList() *waitingList {
+	return &waitingList{
+		keys:  make(map[string][]*aetherClient),
+		ready: make(map[string]bool),
+	}
+}
+
+func (w *waitingList) add(c *aetherClient) {
+	for _, key := range c.blocking.keys {
+		w.keys[key] = append(w.keys[key], c)
+	}
+}
+
+func (w *waitingList) rm(c *aetherClient) {
+	for _, key := range c.blocking.keys {
+		clients := w.keys[key]
+		for i, client := range clients {
+			if client == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(w.keys, key)
+		} else {
+			w.keys[key] = clients
+		}
+	}
+}
+
+func (w *waitingList) first(key string) (*aetherClient, bool) {
+	clients, found := w.keys[key]
+	if !found {
+		return nil, false
+	}
+	return clients[0], true
+}
+
+// get returns a copy of the clients blocked on the key, in arrival order
+func (w *waitingList) get(key string) []*aetherClient {
+	return append([]*aetherClient{}, w.keys[key]...)
+}
+
+func (w *waitingList) signal(key string) {
+	if _, waiting := w.keys[key]; waiting {
+		w.ready[key] = true
+	}
+}
+
+func (w *waitingList) nextReady() (string, bool) {
+	for key := range w.ready {
+		delete(w.ready, key)
+		return key, true
+	}
+	return "", false
+}
+
+// expired returns the clients whose timeout is over
+func (w *waitingList) expired(now time.Time) []*aetherClient {
+	seen := make(map[*aetherClient]bool)
+	expired := make([]*aetherClient, 0)
+	for _, clients := range w.keys {
+		for _, c := range clients {
+			deadline := c.blocking.deadline
+			if !seen[c] && !deadline.IsZero() && !now.Before(deadline) {
+				expired = append(expired, c)
+			}
+			seen[c] = true
+		}
+	}
+	return expired
+}
+
+func (w *waitingList) count() int {
+	seen := make(map[*aetherClient]bool)
+	for _, clients := range w.keys {
+		for _, c := range clients {
+			seen[c] = true
+		}
+	}
+	return len(seen)
+}
+
+// parseTimeout converts a timeout in (possibly fractional) seconds to a deadline
+func parseTimeout(arg []byte) (time.Time, error) {
+	secs, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timeout is not a float or out of range")
+	}
+	if secs < 0 {
+		return time.Time{}, fmt.Errorf("timeout is negative")
+	}
+	if secs == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(time.Duration(secs * float64(time.Second))), nil
+}
+
+// runBlockingPop pops from the first non-empty list of the keys, or parks the
+// client until one of them gets an element or the timeout is over
+func runBlockingPop(command *command, c *aetherClient, server *AetherServer, front bool) response {
+	args := command.getArgs()
+	keys := append([]string{command.key}, bytesToStrings(args[:len(args)-1])...)
+
+	deadline, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+
+	for _, key := range keys {
+		i, found, isList := server.hm.getList(key)
+		if found && !isList {
+			return wrongTypeResponse
+		}
+		if found {
+			return server.popFor(key, i, front)
+		}
+	}
+
+	if server.isExecuting() {
+		// Blocking would stall the whole transaction, so it times out at once
+		return newNullArrayResponse("Timeout reached without elements")
+	}
+
+	server.block(c, &blockingState{
+		command:  command,
+		keys:     keys,
+		deadline: deadline,
+		serve: func(s *AetherServer, key string) (element, bool) {
+			i, found, isList := s.hm.getList(key)
+			if !found || !isList {
+				return nil, false
+			}
+			return s.popFor(key, i, front), true
+		},
+	})
+
+	return nil // The reply will be sent when unblocked
+}
+
+// popFor pops an element for a blocking pop, which is replicated as a plain
+// pop so the replicas and the append-only log never block
+func (s *AetherServer) popFor(key string, i *item, front bool) element {
+	var value []byte
+	var pop *command
+	if front {
+		value, _ = s.hm.lpop(i)
+		pop = newArgsCommand(commandLpop, key, [][]byte{})
+	} else {
+		value, _ = s.hm.rpop(i)
+		pop = newArgsCommand(commandRpop, key, [][]byte{})
+	}
+	s.propagate(pop)
+	return newBytesArrayResponse([][]byte{[]byte(key), value})
+}
+
+func (s *AetherServer) block(c *aetherClient, state *blockingState) {
+	c.block(state)
+	s.waiting.add(c)
+}
+
+func (s *AetherServer) unblock(c *aetherClient) {
+	s.waiting.rm(c)
+	c.unblock()
+}
+
+// signalKeyAsReady tells the clients blocked on the key that it got elements
+func (s *AetherServer) signalKeyAsReady(key string) {
+	s.waiting.signal(key)
+}
+
+// serveBlockedClients hands the elements added to the ready keys to the
+// clients waiting on them, in the order they got blocked
+func (s *AetherServer) serveBlockedClients() {
+	for key, found := s.waiting.nextReady(); found; key, found = s.waiting.nextReady() {
+		for _, c := range s.waiting.get(key) {
+			if !c.isBlocked() {
+				continue // Served meanwhile by a key it was also waiting on
+			}
+			reply, served := c.blocking.serve(s, key)
+			if !served {
+				continue
+			}
+			s.unblock(c)
+			c.enqueueReply(reply)
+			s.resume(c)
+		}
+	}
+}
+
+func (s *AetherServer) timeoutBlockedClients() {
+	for _, c := range s.waiting.expired(time.Now()) {
+		s.unblock(c)
+		c.enqueueReply(newNullArrayResponse("Timeout reached without elements"))
+		s.resume(c)
+	}
+}
+
+// resume runs the commands the client sent while it was blocked
+func (s *AetherServer) resume(c *aetherClient) {
+	for _, command := range c.takePending() {
+		s.execute(c, command)
+	}
+}
+
+func bytesToStrings(values [][]byte) []string {
+	strings := make([]string, 0, len(values))
+	for _, value := range values {
+		strings = append(strings, string(value))
+	}
+	return strings
+}
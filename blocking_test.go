@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitingListOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	w := newWaitingList()
+
+	first := &aetherClient{id: "1"}
+	first.block(&blockingState{keys: []string{"a", "b"}})
+	w.add(first)
+
+	second := &aetherClient{id: "2"}
+	second.block(&blockingState{keys: []string{"b"}, deadline: time.Now().Add(-time.Second)})
+	w.add(second)
+
+	assert.Equal(2, w.count())
+
+	c, found := w.first("b")
+	assert.True(found)
+	assert.Same(first, c)
+
+	w.signal("b")
+	w.signal("unknown") // Nobody is waiting for it
+	key, found := w.nextReady()
+	assert.True(found)
+	assert.Equal("b", key)
+	_, found = w.nextReady()
+	assert.False(found)
+
+	assert.Equal([]*aetherClient{second}, w.expired(time.Now()))
+
+	w.rm(first)
+	c, _ = w.first("b")
+	assert.Same(second, c)
+	_, found = w.first("a")
+	assert.False(found)
+}
+
+func TestParseTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	deadline, err := parseTimeout([]byte("0"))
+	assert.Nil(err)
+	assert.True(deadline.IsZero())
+
+	deadline, err = parseTimeout([]byte("1.5"))
+	assert.Nil(err)
+	assert.WithinDuration(time.Now().Add(1500*time.Millisecond), deadline, 100*time.Millisecond)
+
+	_, err = parseTimeout([]byte("-1"))
+	assert.NotNil(err)
+
+	_, err = parseTimeout([]byte("soon"))
+	assert.NotNil(err)
+}
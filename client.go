@@ -6,14 +6,24 @@ import (
 )
 
 type aetherClient struct {
-	id        string
-	conn      net.Conn
-	sink      *sink
-	parser    *parser
-	log       *log.Entry
-	server    *AetherServer
-	responses chan response
-	replica   bool
+	id       string
+	conn     net.Conn
+	sink     *sink
+	parser   *parser
+	log      *log.Entry
+	server   *AetherServer
+	outbox   *outbox
+	replica  bool
+	proto    protocol
+	blocking *blockingState
+	pending  []*command
+	// Commands queued after MULTI, nil if not in a transaction
+	transaction *transaction
+	// Versions of the keys watched (WATCH) by the client
+	watched map[string]uint64
+	// Channels and channel patterns the client is subscribed to
+	channels map[string]struct{}
+	patterns map[string]struct{}
 }
 
 func newClient(conn net.Conn, s *AetherServer) *aetherClient {
@@ -27,11 +37,13 @@ func newClient(conn net.Conn, s *AetherServer) *aetherClient {
 	src := newBufferedSource(conn, 128)
 	c.parser = newParser(src)
 	c.sink = newSink(conn, 1024)
-	c.responses = make(chan response)
+	c.outbox = newOutbox()
+	c.proto = s.protocol
 	return c
 }
 
 func (c *aetherClient) close() {
+	c.outbox.close()
 	err := c.conn.Close()
 	if err != nil {
 		c.log.WithFields(log.Fields{"error": err}).Error("Error closing socket")
@@ -77,8 +89,31 @@ func (c *aetherClient) getNumberOfWrites() int {
 	return c.sink.getNumberOfWrites()
 }
 
+// enqueueReply hands the reply to the writer without waiting for it. A
+// subscriber or replica not keeping up with its replies is disconnected.
 func (c *aetherClient) enqueueReply(r response) {
-	c.responses <- r
+	pending, open := c.outbox.push(r)
+	if !open {
+		return // Disconnecting
+	}
+	if limit := c.getOutputLimit(); limit > 0 && pending > limit {
+		c.log.WithField("replies", pending).Warn("Output limit reached, disconnecting client")
+		c.outbox.close()
+		go c.server.newEvent(newCloseClientEvent(c))
+	}
+}
+
+// getOutputLimit returns how many replies can wait to be written to the
+// client, 0 meaning no limit
+func (c *aetherClient) getOutputLimit() int {
+	switch {
+	case c.isAReplica():
+		return replicaOutputLimit
+	case c.isSubscribed():
+		return pubsubOutputLimit
+	default:
+		return 0
+	}
 }
 
 func (c *aetherClient) getId() string {
@@ -105,6 +140,37 @@ func (c *aetherClient) isAReplica() bool {
 	return c.replica
 }
 
+func (c *aetherClient) block(state *blockingState) {
+	c.blocking = state
+}
+
+func (c *aetherClient) unblock() {
+	c.blocking = nil
+}
+
+func (c *aetherClient) isBlocked() bool {
+	return c.blocking != nil
+}
+
+// queue holds a command sent while the client is blocked
+func (c *aetherClient) queue(command *command) {
+	c.pending = append(c.pending, command)
+}
+
+func (c *aetherClient) takePending() []*command {
+	pending := c.pending
+	c.pending = nil
+	return pending
+}
+
+func (c *aetherClient) setProtocol(proto protocol) {
+	c.proto = proto
+}
+
+func (c *aetherClient) getProtocol() protocol {
+	return c.proto
+}
+
 func (c *aetherClient) logNewClient() {
 	c.log.WithField("address", c.getOriginAddr()).Info("New client")
 }
@@ -142,22 +208,33 @@ func (c *aetherClient) read() {
 }
 
 func (c *aetherClient) write() {
+	proto := c.proto // c.proto belongs to the event loop from now on
 	for {
-		response := <-c.responses
-		data, err := response.write(c.sink)
-		if err != nil {
-			e := newWritingErrorEvent(c, err)
-			go c.server.newEvent(e)
-			return
+		responses, open := c.outbox.take()
+		if !open {
+			return // Disconnected
 		}
+		for _, response := range responses {
+			if hello, ok := response.(*helloResponse); ok {
+				proto = hello.proto
+			}
+			data, err := response.write(c.sink, proto)
+			if err != nil {
+				c.outbox.close()
+				e := newWritingErrorEvent(c, err)
+				go c.server.newEvent(e)
+				return
+			}
 
-		io := newNetworkWriteEvent(data)
-		go c.server.newEvent(io)
+			io := newNetworkWriteEvent(data)
+			go c.server.newEvent(io)
 
-		if response.isFinal() {
-			e := newCloseClientEvent(c)
-			go c.server.newEvent(e)
-			return
+			if response.isFinal() {
+				c.outbox.close()
+				e := newCloseClientEvent(c)
+				go c.server.newEvent(e)
+				return
+			}
 		}
 	}
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"math"
+	"strconv"
 )
 
 type commandCode string
@@ -18,6 +20,103 @@ const (
 	commandPing  commandCode = "PING"
 	commandSync  commandCode = "SYNC"
 	commandExit  commandCode = "EXIT"
+
+	commandRewriteAof commandCode = "REWRITEAOF"
+	commandHello      commandCode = "HELLO"
+
+	commandHset    commandCode = "HSET"
+	commandHget    commandCode = "HGET"
+	commandHdel    commandCode = "HDEL"
+	commandHgetall commandCode = "HGETALL"
+	commandHincrby commandCode = "HINCRBY"
+
+	commandLpush  commandCode = "LPUSH"
+	commandRpush  commandCode = "RPUSH"
+	commandLpop   commandCode = "LPOP"
+	commandRpop   commandCode = "RPOP"
+	commandLrange commandCode = "LRANGE"
+	commandLlen   commandCode = "LLEN"
+	commandLtrim  commandCode = "LTRIM"
+	commandLindex commandCode = "LINDEX"
+	commandBlpop  commandCode = "BLPOP"
+	commandBrpop  commandCode = "BRPOP"
+
+	commandSadd        commandCode = "SADD"
+	commandSrem        commandCode = "SREM"
+	commandSmembers    commandCode = "SMEMBERS"
+	commandSismember   commandCode = "SISMEMBER"
+	commandScard       commandCode = "SCARD"
+	commandSinter      commandCode = "SINTER"
+	commandSunion      commandCode = "SUNION"
+	commandSdiff       commandCode = "SDIFF"
+	commandSinterstore commandCode = "SINTERSTORE"
+	commandSunionstore commandCode = "SUNIONSTORE"
+	commandSdiffstore  commandCode = "SDIFFSTORE"
+
+	commandZadd          commandCode = "ZADD"
+	commandZrem          commandCode = "ZREM"
+	commandZscore        commandCode = "ZSCORE"
+	commandZrank         commandCode = "ZRANK"
+	commandZrange        commandCode = "ZRANGE"
+	commandZrangebyscore commandCode = "ZRANGEBYSCORE"
+	commandZincrby       commandCode = "ZINCRBY"
+	commandZcard         commandCode = "ZCARD"
+
+	commandIncr        commandCode = "INCR"
+	commandDecr        commandCode = "DECR"
+	commandIncrby      commandCode = "INCRBY"
+	commandDecrby      commandCode = "DECRBY"
+	commandIncrbyfloat commandCode = "INCRBYFLOAT"
+
+	commandTtl       commandCode = "TTL"
+	commandPttl      commandCode = "PTTL"
+	commandExpire    commandCode = "EXPIRE"
+	commandPexpire   commandCode = "PEXPIRE"
+	commandExpireat  commandCode = "EXPIREAT"
+	commandPexpireat commandCode = "PEXPIREAT"
+	commandPersist   commandCode = "PERSIST"
+
+	commandScan  commandCode = "SCAN"
+	commandHscan commandCode = "HSCAN"
+	commandSscan commandCode = "SSCAN"
+	commandZscan commandCode = "ZSCAN"
+
+	commandRmmatch commandCode = "RMMATCH"
+
+	commandMget   commandCode = "MGET"
+	commandMset   commandCode = "MSET"
+	commandMsetnx commandCode = "MSETNX"
+	commandExists commandCode = "EXISTS"
+
+	commandMulti   commandCode = "MULTI"
+	commandExec    commandCode = "EXEC"
+	commandDiscard commandCode = "DISCARD"
+	commandWatch   commandCode = "WATCH"
+	commandUnwatch commandCode = "UNWATCH"
+
+	commandSubscribe    commandCode = "SUBSCRIBE"
+	commandUnsubscribe  commandCode = "UNSUBSCRIBE"
+	commandPsubscribe   commandCode = "PSUBSCRIBE"
+	commandPunsubscribe commandCode = "PUNSUBSCRIBE"
+	commandPublish      commandCode = "PUBLISH"
+
+	commandXadd   commandCode = "XADD"
+	commandXrange commandCode = "XRANGE"
+	commandXread  commandCode = "XREAD"
+	commandXlen   commandCode = "XLEN"
+	commandXtrim  commandCode = "XTRIM"
+	commandXsetid commandCode = "XSETID"
+
+	commandXgroup     commandCode = "XGROUP"
+	commandXreadgroup commandCode = "XREADGROUP"
+	commandXack       commandCode = "XACK"
+	commandXpending   commandCode = "XPENDING"
+	commandXclaim     commandCode = "XCLAIM"
+
+	commandQpush    commandCode = "QPUSH"
+	commandQreserve commandCode = "QRESERVE"
+	commandQack     commandCode = "QACK"
+	commandQnack    commandCode = "QNACK"
 )
 
 var commandCodes = []commandCode{
@@ -30,30 +129,227 @@ var commandCodes = []commandCode{
 	commandPing,
 	commandSync,
 	commandExit,
+	commandRewriteAof,
+	commandHello,
+	commandHset,
+	commandHget,
+	commandHdel,
+	commandHgetall,
+	commandHincrby,
+	commandLpush,
+	commandRpush,
+	commandLpop,
+	commandRpop,
+	commandLrange,
+	commandLlen,
+	commandLtrim,
+	commandLindex,
+	commandBlpop,
+	commandBrpop,
+	commandSadd,
+	commandSrem,
+	commandSmembers,
+	commandSismember,
+	commandScard,
+	commandSinter,
+	commandSunion,
+	commandSdiff,
+	commandSinterstore,
+	commandSunionstore,
+	commandSdiffstore,
+	commandZadd,
+	commandZrem,
+	commandZscore,
+	commandZrank,
+	commandZrange,
+	commandZrangebyscore,
+	commandZincrby,
+	commandZcard,
+	commandIncr,
+	commandDecr,
+	commandIncrby,
+	commandDecrby,
+	commandIncrbyfloat,
+	commandTtl,
+	commandPttl,
+	commandExpire,
+	commandPexpire,
+	commandExpireat,
+	commandPexpireat,
+	commandPersist,
+	commandScan,
+	commandHscan,
+	commandSscan,
+	commandZscan,
+	commandRmmatch,
+	commandMget,
+	commandMset,
+	commandMsetnx,
+	commandExists,
+	commandMulti,
+	commandExec,
+	commandDiscard,
+	commandWatch,
+	commandUnwatch,
+	commandSubscribe,
+	commandUnsubscribe,
+	commandPsubscribe,
+	commandPunsubscribe,
+	commandPublish,
+	commandXadd,
+	commandXrange,
+	commandXread,
+	commandXlen,
+	commandXtrim,
+	commandXsetid,
+	commandXgroup,
+	commandXreadgroup,
+	commandXack,
+	commandXpending,
+	commandXclaim,
+	commandQpush,
+	commandQreserve,
+	commandQack,
+	commandQnack,
+}
+
+// Redis names for the commands, so Redis clients can talk to aetherg
+var commandAliases = map[string]commandCode{
+	"DEL":      commandRm,
+	"FLUSHALL": commandRmall,
+	"QUIT":     commandExit,
+	"KEYS":     commandList,
 }
 
 var writeCommands = []commandCode{
 	commandSet,
 	commandRm,
 	commandRmall,
+	commandHset,
+	commandHdel,
+	commandHincrby,
+	commandLpush,
+	commandRpush,
+	commandLpop,
+	commandRpop,
+	commandLtrim,
+	commandSadd,
+	commandSrem,
+	commandSinterstore,
+	commandSunionstore,
+	commandSdiffstore,
+	commandZadd,
+	commandZrem,
+	commandZincrby,
+	commandIncr,
+	commandDecr,
+	commandIncrby,
+	commandDecrby,
+	commandIncrbyfloat,
+	commandExpire,
+	commandPexpire,
+	commandExpireat,
+	commandPexpireat,
+	commandPersist,
+	commandRmmatch,
+	commandMset,
+	commandMsetnx,
+	commandXadd,
+	commandXtrim,
+	commandXsetid,
+	commandXgroup,
+	commandXreadgroup,
+	commandXack,
+	commandXclaim,
+	commandQpush,
+	commandQreserve,
+	commandQack,
+	commandQnack,
 }
 
 var readCommands = []commandCode{
 	commandGet,
 	commandList,
+	commandHget,
+	commandHgetall,
+	commandLrange,
+	commandLlen,
+	commandLindex,
+	commandSmembers,
+	commandSismember,
+	commandScard,
+	commandSinter,
+	commandSunion,
+	commandSdiff,
+	commandZscore,
+	commandZrank,
+	commandZrange,
+	commandZrangebyscore,
+	commandZcard,
+	commandTtl,
+	commandPttl,
+	commandScan,
+	commandHscan,
+	commandSscan,
+	commandZscan,
+	commandMget,
+	commandExists,
+	commandXrange,
+	commandXread,
+	commandXlen,
+	commandXpending,
+}
+
+// Writes that can't take more memory, so they run even when out of memory
+var releaseCommands = []commandCode{
+	commandRm,
+	commandRmall,
+	commandHdel,
+	commandLpop,
+	commandRpop,
+	commandLtrim,
+	commandSrem,
+	commandZrem,
+	commandExpire,
+	commandPexpire,
+	commandExpireat,
+	commandPexpireat,
+	commandPersist,
+	commandRmmatch,
+	commandXtrim,
+	commandXsetid,
+	commandXack,
+	commandQack,
 }
 
 var controlCommands = []commandCode{
 	commandPing,
 	commandStats,
 	commandExit,
+	commandHello,
+	commandMulti,
+	commandExec,
+	commandDiscard,
+	commandWatch,
+	commandUnwatch,
+	commandSubscribe,
+	commandUnsubscribe,
+	commandPsubscribe,
+	commandPunsubscribe,
+	commandPublish,
 }
 
 type command struct {
 	code       commandCode
 	key        string
 	value      []byte
-	expiration int
+	expiration int   // Secs to expire from now, as given by EXP
+	deadline   int64 // Unix time in millis to expire, as given by PX, PXAT, etc
+	args       [][]byte
+	// What is propagated in place of the command, if not the command itself
+	replication *command
+	// Whether the command must not be propagated at all
+	unreplicated bool
 }
 
 func newCommand(code commandCode, key string, value []byte, expiration int) *command {
@@ -65,6 +361,22 @@ func newCommand(code commandCode, key string, value []byte, expiration int) *com
 	}
 }
 
+// newSetCommand creates a SET that expires at the deadline (if not zero)
+func newSetCommand(key string, value []byte, deadline int64) *command {
+	c := newCommand(commandSet, key, value, 0)
+	c.deadline = deadline
+	return c
+}
+
+// newArgsCommand creates a command shaped as "CODE key args..."
+func newArgsCommand(code commandCode, key string, args [][]byte) *command {
+	return &command{
+		code: code,
+		key:  key,
+		args: args,
+	}
+}
+
 func (command *command) getCode() commandCode {
 	return command.code
 }
@@ -81,6 +393,50 @@ func (command *command) getExpiration() int {
 	return command.expiration
 }
 
+// resolveDeadline turns the expiration relative to now into an absolute
+// deadline, so the command expires the key at the same instant wherever it
+// gets replayed
+func (command *command) resolveDeadline() int64 {
+	if command.deadline == 0 && command.expiration != 0 {
+		command.deadline = nowMillis() + int64(command.expiration)*1000
+	}
+	return command.deadline
+}
+
+func (command *command) getArgs() [][]byte {
+	return command.args
+}
+
+func (command *command) getArg(index int) []byte {
+	return command.args[index]
+}
+
+func (command *command) getIntArg(index int) (int, error) {
+	return strconv.Atoi(string(command.args[index]))
+}
+
+// replicateAs makes the command be propagated as another one (e.g. a command
+// that doesn't depend on the state of the hashmap to give the same result)
+func (command *command) replicateAs(c *command) {
+	command.replication = c
+}
+
+// dontReplicate keeps the command from being propagated, for the commands
+// that propagate their effects by themselves
+func (command *command) dontReplicate() {
+	command.unreplicated = true
+}
+
+func (command *command) getReplication() *command {
+	if command.unreplicated {
+		return nil
+	}
+	if command.replication != nil {
+		return command.replication
+	}
+	return command
+}
+
 func (command *command) isWriteCommand() bool {
 	for _, item := range writeCommands {
 		if item == command.getCode() {
@@ -90,22 +446,43 @@ func (command *command) isWriteCommand() bool {
 	return false
 }
 
+func (command *command) mayTakeMemory() bool {
+	for _, code := range releaseCommands {
+		if code == command.getCode() {
+			return false
+		}
+	}
+	return true
+}
+
 func (command *command) toPieces() [][]byte {
 	pieces := make([][]byte, 0)
 	pieces = append(pieces, []byte(command.code))
 	switch command.code {
-	case commandRm:
-		pieces = append(pieces, []byte(command.key))
 	case commandSet:
 		pieces = append(pieces, []byte(command.key))
 		pieces = append(pieces, command.value)
-		if command.hasExpirationTime() {
+		if command.deadline != 0 {
+			pieces = append(pieces, bprintf("PXAT"))
+			pieces = append(pieces, bprintf("%v", command.deadline))
+		} else if command.hasExpirationTime() {
 			pieces = append(pieces, bprintf("EXP"))
 			pieces = append(pieces, bprintf("%v", command.expiration))
 		}
 
-	case commandRmall:
+	case commandRmall, commandMulti, commandExec:
 		break
+	case commandRm, commandMset, commandPublish,
+		commandHset, commandHdel, commandHincrby,
+		commandLpush, commandRpush, commandLpop, commandRpop, commandLtrim,
+		commandSadd, commandSrem, commandSinterstore, commandSunionstore, commandSdiffstore,
+		commandZadd, commandZrem, commandZincrby,
+		commandIncr, commandDecr, commandIncrby, commandDecrby, commandIncrbyfloat,
+		commandExpire, commandPexpire, commandExpireat, commandPexpireat, commandPersist,
+		commandXadd, commandXtrim, commandXsetid, commandXgroup, commandXack, commandXclaim,
+		commandQpush, commandQreserve, commandQack, commandQnack:
+		pieces = append(pieces, []byte(command.key))
+		pieces = append(pieces, command.args...)
 	default:
 		log.WithField("code", command.code).Fatal("Conversion to pieces not supported")
 	}
@@ -145,23 +522,24 @@ func (command *command) canRunOnAReplica() bool {
 var commandRunners = map[commandCode]commandRunner{
 	commandGet: func(command *command, _ *aetherClient, server *AetherServer) response {
 		i, found := server.hm.get(command.key)
+		if found && !i.is(kindString) {
+			return wrongTypeResponse
+		}
 		if found {
 			value := i.getValue()
 			return newStringResponse(value)
 		} else {
 			msg := fmt.Sprintf("Key \"%v\" not found", command.key)
-			return newErrorResponse(msg, false)
+			return newNullResponse(msg)
 		}
 	},
 
 	commandSet: func(command *command, _ *aetherClient, server *AetherServer) response {
-		server.hm.set(command.key, command.value, command.expiration)
-		return okResponse
+		return runSet(command, server)
 	},
 
 	commandRm: func(command *command, _ *aetherClient, server *AetherServer) response {
-		server.hm.rm(command.key)
-		return okResponse
+		return runRm(command, server)
 	},
 
 	commandRmall: func(_ *command, _ *aetherClient, server *AetherServer) response {
@@ -171,15 +549,30 @@ var commandRunners = map[commandCode]commandRunner{
 
 	commandStats: func(_ *command, _ *aetherClient, server *AetherServer) response {
 		stats := server.getStats()
-		return newJsonResponse(stats)
+		return newCompatResponse(newJsonResponse(stats), newNativeResponse(stats))
 	},
 
-	commandList: func(_ *command, _ *aetherClient, server *AetherServer) response {
+	commandList: func(command *command, _ *aetherClient, server *AetherServer) response {
+		if command.key != "" {
+			return newStringArrayResponse(server.hm.getKeysMatching(command.key))
+		}
 		keys := server.getKeys()
-		return newJsonResponse(keys)
+		return newStringArrayResponse(keys)
 	},
 
-	commandPing: func(_ *command, _ *aetherClient, _ *AetherServer) response {
+	commandRmmatch: func(command *command, _ *aetherClient, server *AetherServer) response {
+		// The purge propagates the keys it removes one by one
+		command.dontReplicate()
+		server.purges = append(server.purges, newKeyPurge(command.key))
+		server.purgeKeys()
+		return okResponse
+	},
+
+	commandPing: func(_ *command, c *aetherClient, _ *AetherServer) response {
+		if c != nil && c.isSubscribed() && c.getProtocol() != protocolResp3 {
+			// Subscribers tell the pong apart from the messages, as Redis does
+			return newBytesArrayResponse([][]byte{[]byte("pong"), {}})
+		}
 		return pongResponse
 	},
 
@@ -199,4 +592,583 @@ var commandRunners = map[commandCode]commandRunner{
 	commandExit: func(_ *command, _ *aetherClient, _ *AetherServer) response {
 		return byeResponse
 	},
+
+	commandHello: func(command *command, c *aetherClient, s *AetherServer) response {
+		proto := c.getProtocol()
+		if command.key != "" {
+			version, err := strconv.Atoi(command.key)
+			if err != nil || (version != 2 && version != 3) {
+				return newCodedErrorResponse("NOPROTO", "unsupported protocol version", false)
+			}
+			proto = protocol(version)
+		}
+		c.setProtocol(proto)
+		return newHelloResponse(proto, s.getHello(c))
+	},
+
+	commandHset: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, isHash := server.hm.getOrCreateHash(command.key)
+		if !isHash {
+			return wrongTypeResponse
+		}
+		added := 0
+		args := command.getArgs()
+		for n := 0; n < len(args); n += 2 {
+			if server.hm.hset(i, string(args[n]), args[n+1]) {
+				added++
+			}
+		}
+		return newIntegerResponse(added)
+	},
+
+	commandHget: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isHash := server.hm.getHash(command.key)
+		if found && !isHash {
+			return wrongTypeResponse
+		}
+		if !found {
+			msg := fmt.Sprintf("Key \"%v\" not found", command.key)
+			return newNullResponse(msg)
+		}
+		field := string(command.getArg(0))
+		value, found := i.hget(field)
+		if !found {
+			msg := fmt.Sprintf("Field \"%v\" not found in key \"%v\"", field, command.key)
+			return newNullResponse(msg)
+		}
+		return newStringResponse(value)
+	},
+
+	commandHdel: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isHash := server.hm.getHash(command.key)
+		if found && !isHash {
+			return wrongTypeResponse
+		}
+		removed := 0
+		for _, field := range command.getArgs() {
+			if found && server.hm.hdel(i, string(field)) {
+				removed++
+			}
+		}
+		return newIntegerResponse(removed)
+	},
+
+	commandHgetall: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isHash := server.hm.getHash(command.key)
+		if found && !isHash {
+			return wrongTypeResponse
+		}
+		return newHashResponse(i)
+	},
+
+	commandHincrby: func(command *command, _ *aetherClient, server *AetherServer) response {
+		increment, err := strconv.ParseInt(string(command.getArg(1)), 10, 64)
+		if err != nil {
+			return notAnIntegerResponse
+		}
+		i, isHash := server.hm.getOrCreateHash(command.key)
+		if !isHash {
+			return wrongTypeResponse
+		}
+		field := string(command.getArg(0))
+		var current int64
+		if value, found := i.hget(field); found {
+			current, err = strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return newErrorResponse("hash value is not an integer", false)
+			}
+		}
+		if overflows(current, increment) {
+			return newErrorResponse("increment or decrement would overflow", false)
+		}
+		current += increment
+		server.hm.hset(i, field, []byte(strconv.FormatInt(current, 10)))
+		return newIntegerResponse(int(current))
+	},
+
+	commandLpush: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runPush(command, server, true)
+	},
+
+	commandRpush: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runPush(command, server, false)
+	},
+
+	commandLpop: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runPop(command, server, true)
+	},
+
+	commandRpop: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runPop(command, server, false)
+	},
+
+	commandLrange: func(command *command, _ *aetherClient, server *AetherServer) response {
+		start, err1 := command.getIntArg(0)
+		stop, err2 := command.getIntArg(1)
+		if err1 != nil || err2 != nil {
+			return notAnIntegerResponse
+		}
+		i, found, isList := server.hm.getList(command.key)
+		switch {
+		case found && !isList:
+			return wrongTypeResponse
+		case !found:
+			return newArrayResponse([]element{})
+		}
+		return newBytesArrayResponse(i.lrange(start, stop))
+	},
+
+	commandLlen: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isList := server.hm.getList(command.key)
+		switch {
+		case found && !isList:
+			return wrongTypeResponse
+		case !found:
+			return newIntegerResponse(0)
+		}
+		return newIntegerResponse(i.llen())
+	},
+
+	commandLtrim: func(command *command, _ *aetherClient, server *AetherServer) response {
+		start, err1 := command.getIntArg(0)
+		stop, err2 := command.getIntArg(1)
+		if err1 != nil || err2 != nil {
+			return notAnIntegerResponse
+		}
+		i, found, isList := server.hm.getList(command.key)
+		if found && !isList {
+			return wrongTypeResponse
+		}
+		if found {
+			server.hm.ltrim(i, start, stop)
+		}
+		return okResponse
+	},
+
+	commandLindex: func(command *command, _ *aetherClient, server *AetherServer) response {
+		index, err := command.getIntArg(0)
+		if err != nil {
+			return notAnIntegerResponse
+		}
+		i, found, isList := server.hm.getList(command.key)
+		if found && !isList {
+			return wrongTypeResponse
+		}
+		if found {
+			if value, ok := i.lindex(index); ok {
+				return newStringResponse(value)
+			}
+		}
+		msg := fmt.Sprintf("Index %v out of range in key \"%v\"", index, command.key)
+		return newNullResponse(msg)
+	},
+
+	commandBlpop: func(command *command, c *aetherClient, server *AetherServer) response {
+		return runBlockingPop(command, c, server, true)
+	},
+
+	commandBrpop: func(command *command, c *aetherClient, server *AetherServer) response {
+		return runBlockingPop(command, c, server, false)
+	},
+
+	commandSadd: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, isSet := server.hm.getOrCreateSet(command.key)
+		if !isSet {
+			return wrongTypeResponse
+		}
+		added := 0
+		for _, member := range command.getArgs() {
+			if server.hm.sadd(i, string(member)) {
+				added++
+			}
+		}
+		return newIntegerResponse(added)
+	},
+
+	commandSrem: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isSet := server.hm.getSet(command.key)
+		if found && !isSet {
+			return wrongTypeResponse
+		}
+		removed := 0
+		for _, member := range command.getArgs() {
+			if found && server.hm.srem(i, string(member)) {
+				removed++
+			}
+		}
+		return newIntegerResponse(removed)
+	},
+
+	commandSmembers: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runSetOperation(command, server, setUnion)
+	},
+
+	commandSismember: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isSet := server.hm.getSet(command.key)
+		if found && !isSet {
+			return wrongTypeResponse
+		}
+		member := found && i.sismember(string(command.getArg(0)))
+		return newBooleanResponse(member)
+	},
+
+	commandScard: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isSet := server.hm.getSet(command.key)
+		switch {
+		case found && !isSet:
+			return wrongTypeResponse
+		case !found:
+			return newIntegerResponse(0)
+		}
+		return newIntegerResponse(i.scard())
+	},
+
+	commandSinter: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runSetOperation(command, server, setInter)
+	},
+
+	commandSunion: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runSetOperation(command, server, setUnion)
+	},
+
+	commandSdiff: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runSetOperation(command, server, setDiff)
+	},
+
+	commandSinterstore: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runSetOperationStore(command, server, setInter)
+	},
+
+	commandSunionstore: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runSetOperationStore(command, server, setUnion)
+	},
+
+	commandSdiffstore: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runSetOperationStore(command, server, setDiff)
+	},
+
+	commandZadd: func(command *command, _ *aetherClient, server *AetherServer) response {
+		args := command.getArgs()
+		scores := make([]float64, 0, len(args)/2)
+		for n := 0; n < len(args); n += 2 {
+			score, err := parseScore(args[n])
+			if err != nil {
+				return newErrorResponse(err.Error(), false)
+			}
+			scores = append(scores, score)
+		}
+		i, isSortedSet := server.hm.getOrCreateSortedSet(command.key)
+		if !isSortedSet {
+			return wrongTypeResponse
+		}
+		added := 0
+		for n, score := range scores {
+			if server.hm.zadd(i, string(args[n*2+1]), score) {
+				added++
+			}
+		}
+		return newIntegerResponse(added)
+	},
+
+	commandZrem: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isSortedSet := server.hm.getSortedSet(command.key)
+		if found && !isSortedSet {
+			return wrongTypeResponse
+		}
+		removed := 0
+		for _, member := range command.getArgs() {
+			if found && server.hm.zrem(i, string(member)) {
+				removed++
+			}
+		}
+		return newIntegerResponse(removed)
+	},
+
+	commandZscore: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isSortedSet := server.hm.getSortedSet(command.key)
+		if found && !isSortedSet {
+			return wrongTypeResponse
+		}
+		member := string(command.getArg(0))
+		if !found {
+			return newNullResponse(fmt.Sprintf("Key \"%v\" not found", command.key))
+		}
+		score, found := i.zscore(member)
+		if !found {
+			return newNullResponse(fmt.Sprintf("Member \"%v\" not found", member))
+		}
+		return newDoubleResponse(score)
+	},
+
+	commandZrank: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isSortedSet := server.hm.getSortedSet(command.key)
+		if found && !isSortedSet {
+			return wrongTypeResponse
+		}
+		member := string(command.getArg(0))
+		if !found {
+			return newNullResponse(fmt.Sprintf("Key \"%v\" not found", command.key))
+		}
+		rank, found := i.zrank(member)
+		if !found {
+			return newNullResponse(fmt.Sprintf("Member \"%v\" not found", member))
+		}
+		return newIntegerResponse(rank)
+	},
+
+	commandZrange: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runZrange(command, server)
+	},
+
+	commandZrangebyscore: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runZrangeByScore(command, server)
+	},
+
+	commandZincrby: func(command *command, _ *aetherClient, server *AetherServer) response {
+		increment, err := parseScore(command.getArg(0))
+		if err != nil {
+			return newErrorResponse(err.Error(), false)
+		}
+		i, isSortedSet := server.hm.getOrCreateSortedSet(command.key)
+		if !isSortedSet {
+			return wrongTypeResponse
+		}
+		member := string(command.getArg(1))
+		score, _ := i.zscore(member)
+		score += increment
+		if math.IsNaN(score) {
+			server.hm.rmIfEmpty(i)
+			return newErrorResponse("resulting score is not a number (NaN)", false)
+		}
+		server.hm.zadd(i, member, score)
+		return newDoubleResponse(score)
+	},
+
+	commandZcard: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found, isSortedSet := server.hm.getSortedSet(command.key)
+		switch {
+		case found && !isSortedSet:
+			return wrongTypeResponse
+		case !found:
+			return newIntegerResponse(0)
+		}
+		return newIntegerResponse(i.zcard())
+	},
+
+	commandIncr: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runIncrBy(command, server, 1)
+	},
+
+	commandDecr: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runIncrBy(command, server, -1)
+	},
+
+	commandIncrby: func(command *command, _ *aetherClient, server *AetherServer) response {
+		increment, err := strconv.ParseInt(string(command.getArg(0)), 10, 64)
+		if err != nil {
+			return notAnIntegerResponse
+		}
+		return runIncrBy(command, server, increment)
+	},
+
+	commandDecrby: func(command *command, _ *aetherClient, server *AetherServer) response {
+		decrement, err := strconv.ParseInt(string(command.getArg(0)), 10, 64)
+		if err != nil || decrement == math.MinInt64 {
+			return notAnIntegerResponse
+		}
+		return runIncrBy(command, server, -decrement)
+	},
+
+	commandIncrbyfloat: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runIncrByFloat(command, server)
+	},
+
+	commandTtl: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runTtl(command, server, 1000)
+	},
+
+	commandPttl: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runTtl(command, server, 1)
+	},
+
+	commandExpire: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runExpire(command, server, func(secs int64) (int64, bool) {
+			millis, ok := secsToMillis(secs)
+			if !ok {
+				return 0, false
+			}
+			return addMillis(nowMillis(), millis)
+		})
+	},
+
+	commandPexpire: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runExpire(command, server, func(millis int64) (int64, bool) {
+			return addMillis(nowMillis(), millis)
+		})
+	},
+
+	commandExpireat: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runExpire(command, server, secsToMillis)
+	},
+
+	commandPexpireat: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runExpire(command, server, func(timestamp int64) (int64, bool) {
+			return timestamp, true
+		})
+	},
+
+	commandPersist: func(command *command, _ *aetherClient, server *AetherServer) response {
+		i, found := server.hm.get(command.key)
+		if found && server.hm.persist(i) {
+			return newIntegerResponse(1)
+		}
+		return newIntegerResponse(0)
+	},
+
+	commandScan: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runScan(command, server)
+	},
+
+	commandHscan: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runElementsScan(command, server, kindHash)
+	},
+
+	commandSscan: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runElementsScan(command, server, kindSet)
+	},
+
+	commandZscan: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runElementsScan(command, server, kindSortedSet)
+	},
+
+	commandMget: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runMget(command, server)
+	},
+
+	commandMset: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runMset(command, server)
+	},
+
+	commandMsetnx: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runMsetnx(command, server)
+	},
+
+	commandExists: func(command *command, _ *aetherClient, server *AetherServer) response {
+		return runExists(command, server)
+	},
+
+	commandMulti: func(_ *command, c *aetherClient, _ *AetherServer) response {
+		return runMulti(c)
+	},
+
+	commandDiscard: func(_ *command, c *aetherClient, _ *AetherServer) response {
+		return runDiscard(c)
+	},
+
+	commandWatch: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runWatch(command, c, s)
+	},
+
+	commandUnwatch: func(_ *command, c *aetherClient, _ *AetherServer) response {
+		c.unwatch()
+		return okResponse
+	},
+
+	commandSubscribe: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runSubscribe(command, c, s, false)
+	},
+
+	commandUnsubscribe: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runUnsubscribe(command, c, s, false)
+	},
+
+	commandPsubscribe: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runSubscribe(command, c, s, true)
+	},
+
+	commandPunsubscribe: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runUnsubscribe(command, c, s, true)
+	},
+
+	commandPublish: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runPublish(command, s)
+	},
+
+	commandXadd: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runXadd(command, s)
+	},
+
+	commandXrange: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runXrange(command, s)
+	},
+
+	commandXread: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runXread(command, c, s)
+	},
+
+	commandXlen: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runXlen(command, s)
+	},
+
+	commandXtrim: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runXtrim(command, s)
+	},
+
+	commandXsetid: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runXsetid(command, s)
+	},
+
+	commandXgroup: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runXgroup(command, s)
+	},
+
+	commandXreadgroup: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runXreadgroup(command, c, s)
+	},
+
+	commandXack: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runXack(command, s)
+	},
+
+	commandXpending: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runXpending(command, s)
+	},
+
+	commandXclaim: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runXclaim(command, c, s)
+	},
+
+	commandQpush: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runQpush(command, c, s)
+	},
+
+	commandQreserve: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runQreserve(command, c, s)
+	},
+
+	commandQack: func(command *command, _ *aetherClient, s *AetherServer) response {
+		return runQack(command, s)
+	},
+
+	commandQnack: func(command *command, c *aetherClient, s *AetherServer) response {
+		return runQnack(command, c, s)
+	},
+
+	commandRewriteAof: func(_ *command, _ *aetherClient, s *AetherServer) response {
+		switch {
+		case !s.hasAppendLog():
+			return newErrorResponse("append-only log is disabled", false)
+		case s.isRewritingAppendLog():
+			return newErrorResponse("append-only log rewrite already in progress", false)
+		case s.isSnapshotting():
+			return newErrorResponse("snapshot in progress, try again later", false)
+		}
+		s.startAppendLogRewrite()
+		return okResponse
+	},
+}
+
+func overflows(value int64, increment int64) bool {
+	return (increment > 0 && value > math.MaxInt64-increment) ||
+		(increment < 0 && value < math.MinInt64-increment)
 }
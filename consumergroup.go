@@ -0,0 +1,818 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// consumerGroup hands the entries of a stream out to a pool of consumers,
+// each entry to a single one, keeping the ones delivered but not acknowledged
+// yet so they can be claimed by another consumer if the first one got stuck
+type consumerGroup struct {
+	lastDelivered streamId
+	consumers     map[string]struct{}
+	pending       map[streamId]*pendingEntry
+}
+
+// pendingEntry is an entry delivered to a consumer and not acknowledged yet
+type pendingEntry struct {
+	consumer   string
+	delivered  int64 // Unix time in millis of the last delivery
+	deliveries int
+}
+
+func newConsumerGroup(lastDelivered streamId) *consumerGroup {
+	return &consumerGroup{
+		lastDelivered: lastDelivered,
+		consumers:     make(map[string]struct{}),
+		pending:       make(map[streamId]*pendingEntry),
+	}
+}
+
+func (g *consumerGroup) clone() *consumerGroup {
+	c := newConsumerGroup(g.lastDelivered)
+	for consumer := range g.consumers {
+		c.consumers[consumer] = struct{}{}
+	}
+	for id, p := range g.pending {
+		copied := *p
+		c.pending[id] = &copied
+	}
+	return c
+}
+
+// pendingIds returns the ids pending for the consumer (or for the whole group
+// if empty) in order
+func (g *consumerGroup) pendingIds(consumer string) []streamId {
+	ids := make([]streamId, 0)
+	for id, p := range g.pending {
+		if consumer == "" || p.consumer == consumer {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return ids[a].less(ids[b])
+	})
+	return ids
+}
+
+func (g *consumerGroup) consumerNames() []string {
+	names := make([]string, 0, len(g.consumers))
+	for consumer := range g.consumers {
+		names = append(names, consumer)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (g *consumerGroup) memory(name string) int64 {
+	size := entryMemory([]byte(name)) + int64(len(g.pending))*entryMemory()
+	for consumer := range g.consumers {
+		size += entryMemory([]byte(consumer))
+	}
+	return size
+}
+
+func (i *item) getGroup(name string) (*consumerGroup, bool) {
+	g, found := i.stream.groups[name]
+	return g, found
+}
+
+// xlookup returns the entry with the given id, if not trimmed yet
+func (i *item) xlookup(id streamId) (streamEntry, bool) {
+	n := i.stream.search(id)
+	if n < i.xlen() && i.stream.entries[n].id == id {
+		return i.stream.entries[n], true
+	}
+	return streamEntry{}, false
+}
+
+func (i *item) cloneGroups() map[string]*consumerGroup {
+	groups := make(map[string]*consumerGroup, len(i.stream.groups))
+	for name, g := range i.stream.groups {
+		groups[name] = g.clone()
+	}
+	return groups
+}
+
+func (i *item) groupsMemory() int64 {
+	size := int64(0)
+	for name, g := range i.stream.groups {
+		size += g.memory(name)
+	}
+	return size
+}
+
+func (i *item) groupNames() []string {
+	names := make([]string, 0, len(i.stream.groups))
+	for name := range i.stream.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// genXgroupCommandPieces returns the commands recreating the consumer groups,
+// their consumers and the entries pending for each of them
+func (i *item) genXgroupCommandPieces() [][][]byte {
+	commands := make([][][]byte, 0)
+	for _, name := range i.groupNames() {
+		g := i.stream.groups[name]
+		create := newArgsCommand(commandXgroup, "CREATE", [][]byte{
+			[]byte(i.getKey()),
+			[]byte(name),
+			[]byte(g.lastDelivered.String()),
+			[]byte("MKSTREAM"),
+		})
+		commands = append(commands, create.toPieces())
+		for _, consumer := range g.consumerNames() {
+			commands = append(commands, newCreateConsumerCommand(i.getKey(), name, consumer).toPieces())
+		}
+		for _, id := range g.pendingIds("") {
+			commands = append(commands, newForcedClaimCommand(i.getKey(), name, id, g.pending[id], nil).toPieces())
+		}
+	}
+	return commands
+}
+
+func (hm *hashmap) createGroup(i *item, name string, lastDelivered streamId) bool {
+	if _, found := i.getGroup(name); found {
+		return false
+	}
+	g := newConsumerGroup(lastDelivered)
+	i.stream.groups[name] = g
+	hm.modified(i)
+	hm.resize(i, g.memory(name))
+	return true
+}
+
+func (hm *hashmap) destroyGroup(i *item, name string) bool {
+	g, found := i.getGroup(name)
+	if !found {
+		return false
+	}
+	delete(i.stream.groups, name)
+	hm.modified(i)
+	hm.resize(i, -g.memory(name))
+	return true
+}
+
+func (hm *hashmap) setGroupId(i *item, g *consumerGroup, lastDelivered streamId) {
+	g.lastDelivered = lastDelivered
+	hm.modified(i)
+}
+
+func (hm *hashmap) createConsumer(i *item, g *consumerGroup, consumer string) bool {
+	if _, found := g.consumers[consumer]; found {
+		return false
+	}
+	g.consumers[consumer] = struct{}{}
+	hm.modified(i)
+	hm.resize(i, entryMemory([]byte(consumer)))
+	return true
+}
+
+// delConsumer removes the consumer along with its pending entries, returning
+// how many entries were pending
+func (hm *hashmap) delConsumer(i *item, g *consumerGroup, consumer string) int {
+	if _, found := g.consumers[consumer]; !found {
+		return 0
+	}
+	ids := g.pendingIds(consumer)
+	for _, id := range ids {
+		delete(g.pending, id)
+	}
+	delete(g.consumers, consumer)
+	hm.modified(i)
+	hm.resize(i, -entryMemory([]byte(consumer))-int64(len(ids))*entryMemory())
+	return len(ids)
+}
+
+// deliver hands the entries to the consumer, leaving them pending until
+// acknowledged (unless noack is given)
+func (hm *hashmap) deliver(i *item, g *consumerGroup, consumer string, entries []streamEntry, noack bool) {
+	now := nowMillis()
+	for _, entry := range entries {
+		g.lastDelivered = entry.id
+		if !noack {
+			hm.claim(i, g, entry.id, &pendingEntry{consumer: consumer, delivered: now, deliveries: 1})
+		}
+	}
+	hm.modified(i)
+}
+
+// claim makes the entry pending as given, replacing how it was pending before
+func (hm *hashmap) claim(i *item, g *consumerGroup, id streamId, p *pendingEntry) {
+	if _, found := g.pending[id]; !found {
+		hm.resize(i, entryMemory())
+	}
+	g.pending[id] = p
+	hm.modified(i)
+}
+
+func (hm *hashmap) ack(i *item, g *consumerGroup, id streamId) bool {
+	if _, found := g.pending[id]; !found {
+		return false
+	}
+	delete(g.pending, id)
+	hm.modified(i)
+	hm.resize(i, -entryMemory())
+	return true
+}
+
+func newCreateConsumerCommand(key string, group string, consumer string) *command {
+	return newArgsCommand(commandXgroup, "CREATECONSUMER", [][]byte{[]byte(key), []byte(group), []byte(consumer)})
+}
+
+// newForcedClaimCommand makes the entry pending exactly as it is now. The
+// writes whose outcome depends on the clock (deliveries and claims here, jobs
+// pushed and reserved in the queues) are replicated as what they did, with
+// options only accepted from the master or the disk (a nil client).
+func newForcedClaimCommand(key string, group string, id streamId, p *pendingEntry, lastId *streamId) *command {
+	args := [][]byte{
+		[]byte(group),
+		[]byte(p.consumer),
+		[]byte("0"),
+		[]byte(id.String()),
+		[]byte("TIME"),
+		[]byte(strconv.FormatInt(p.delivered, 10)),
+		[]byte("RETRYCOUNT"),
+		[]byte(strconv.Itoa(p.deliveries)),
+		[]byte("FORCE"),
+		[]byte("JUSTID"),
+	}
+	if lastId != nil {
+		args = append(args, []byte("LASTID"), []byte(lastId.String()))
+	}
+	return newArgsCommand(commandXclaim, key, args)
+}
+
+func newNoGroupResponse(key string, group string) element {
+	msg := fmt.Sprintf("No such key '%v' or consumer group '%v'", key, group)
+	return newCodedErrorResponse("NOGROUP", msg, false)
+}
+
+// lookupGroup returns the stream at the key and the consumer group of it,
+// or the error reply if any of them is missing
+func (s *AetherServer) lookupGroup(key string, group string) (*item, *consumerGroup, response) {
+	i, found, isStream := s.hm.getStream(key)
+	if found && !isStream {
+		return nil, nil, wrongTypeResponse
+	}
+	if !found {
+		return nil, nil, newNoGroupResponse(key, group)
+	}
+	g, found := i.getGroup(group)
+	if !found {
+		return nil, nil, newNoGroupResponse(key, group)
+	}
+	return i, g, nil
+}
+
+// parseGroupId reads the id a group starts from, where "$" is the last entry
+func parseGroupId(arg string, i *item) (streamId, error) {
+	if arg == "$" {
+		if i == nil {
+			return streamId{}, nil
+		}
+		return i.getLastStreamId(), nil
+	}
+	return parseStreamId(arg, 0)
+}
+
+// runXgroup manages the consumer groups of a stream. The subcommand is taken
+// as the key of the command, followed by the actual key.
+func runXgroup(command *command, server *AetherServer) response {
+	fail := func(failure response) response {
+		command.dontReplicate()
+		return failure
+	}
+
+	subcommand := strings.ToUpper(command.key)
+	args := command.getArgs()
+	key, group := string(args[0]), string(args[1])
+
+	switch {
+	case subcommand == "CREATE" && (len(args) == 3 || len(args) == 4):
+		mkstream := len(args) == 4 && strings.ToUpper(string(args[3])) == "MKSTREAM"
+		if len(args) == 4 && !mkstream {
+			return fail(newErrorResponse("syntax error", false))
+		}
+		i, found, isStream := server.hm.getStream(key)
+		switch {
+		case found && !isStream:
+			return fail(wrongTypeResponse)
+		case !found && !mkstream:
+			return fail(newErrorResponse("The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.", false))
+		}
+		id, err := parseGroupId(string(args[2]), i)
+		if err != nil {
+			return fail(newErrorResponse(err.Error(), false))
+		}
+		if !found {
+			i = newStreamItem(key)
+			server.hm.put(i)
+		}
+		if !server.hm.createGroup(i, group, id) {
+			return fail(newCodedErrorResponse("BUSYGROUP", "Consumer Group name already exists", false))
+		}
+		replication := [][]byte{args[0], args[1], []byte(id.String())}
+		if mkstream {
+			replication = append(replication, []byte("MKSTREAM"))
+		}
+		command.replicateAs(newArgsCommand(commandXgroup, "CREATE", replication))
+		return okResponse
+
+	case subcommand == "SETID" && len(args) == 3:
+		i, g, failure := server.lookupGroup(key, group)
+		if failure != nil {
+			return fail(failure)
+		}
+		id, err := parseGroupId(string(args[2]), i)
+		if err != nil {
+			return fail(newErrorResponse(err.Error(), false))
+		}
+		server.hm.setGroupId(i, g, id)
+		command.replicateAs(newArgsCommand(commandXgroup, "SETID", [][]byte{args[0], args[1], []byte(id.String())}))
+		return okResponse
+
+	case subcommand == "DESTROY" && len(args) == 2:
+		i, found, isStream := server.hm.getStream(key)
+		switch {
+		case found && !isStream:
+			return fail(wrongTypeResponse)
+		case !found:
+			return fail(newErrorResponse("The XGROUP subcommand requires the key to exist.", false))
+		}
+		if server.hm.destroyGroup(i, group) {
+			return newIntegerResponse(1)
+		}
+		return newIntegerResponse(0)
+
+	case subcommand == "CREATECONSUMER" && len(args) == 3:
+		i, g, failure := server.lookupGroup(key, group)
+		if failure != nil {
+			return fail(failure)
+		}
+		if server.hm.createConsumer(i, g, string(args[2])) {
+			return newIntegerResponse(1)
+		}
+		return newIntegerResponse(0)
+
+	case subcommand == "DELCONSUMER" && len(args) == 3:
+		i, g, failure := server.lookupGroup(key, group)
+		if failure != nil {
+			return fail(failure)
+		}
+		return newIntegerResponse(server.hm.delConsumer(i, g, string(args[2])))
+	}
+
+	return fail(newErrorResponse(fmt.Sprintf("unknown subcommand or wrong number of arguments for '%v'", command.key), false))
+}
+
+// groupRead is a XREADGROUP of some streams, where the id ">" asks for the
+// entries never delivered to the group and any other id for the entries
+// already delivered to the consumer (and still pending) after it
+type groupRead struct {
+	group    string
+	consumer string
+	keys     []string
+	ids      []string
+	count    int
+	noack    bool
+}
+
+// read returns the entries of the streams that have any, or false if none
+// has, propagating the deliveries
+func (r *groupRead) read(server *AetherServer) (element, bool) {
+	streams := make([]element, 0)
+	writes := make([]*command, 0)
+
+	for n, key := range r.keys {
+		i, found, isStream := server.hm.getStream(key)
+		if !found || !isStream {
+			continue
+		}
+		g, found := i.getGroup(r.group)
+		if !found {
+			continue
+		}
+		if server.hm.createConsumer(i, g, r.consumer) {
+			writes = append(writes, newCreateConsumerCommand(key, r.group, r.consumer))
+		}
+
+		var entries []streamEntry
+		if r.ids[n] == ">" {
+			entries = i.xreadAfter(g.lastDelivered, r.count)
+			if len(entries) == 0 {
+				continue
+			}
+			server.hm.deliver(i, g, r.consumer, entries, r.noack)
+			writes = append(writes, r.genDeliveryCommands(key, g, entries)...)
+		} else {
+			after, _ := parseStreamId(r.ids[n], 0)
+			entries = r.history(i, g, after)
+		}
+
+		streams = append(streams, newArrayResponse([]element{
+			newStringResponse([]byte(key)),
+			newStreamEntriesResponse(entries),
+		}))
+	}
+
+	server.propagateAll(writes)
+	return newArrayResponse(streams), len(streams) > 0
+}
+
+// history returns the entries pending for the consumer after the given id
+func (r *groupRead) history(i *item, g *consumerGroup, after streamId) []streamEntry {
+	entries := make([]streamEntry, 0)
+	for _, id := range g.pendingIds(r.consumer) {
+		if len(entries) == r.count {
+			break
+		}
+		if !after.less(id) {
+			continue
+		}
+		entry, found := i.xlookup(id)
+		if !found {
+			entry = streamEntry{id: id} // Trimmed meanwhile
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (r *groupRead) genDeliveryCommands(key string, g *consumerGroup, entries []streamEntry) []*command {
+	if r.noack {
+		last := []byte(g.lastDelivered.String())
+		return []*command{newArgsCommand(commandXgroup, "SETID", [][]byte{[]byte(key), []byte(r.group), last})}
+	}
+	writes := make([]*command, 0, len(entries))
+	for _, entry := range entries {
+		writes = append(writes, newForcedClaimCommand(key, r.group, entry.id, g.pending[entry.id], &entry.id))
+	}
+	return writes
+}
+
+// runXreadgroup reads the streams on behalf of a consumer of the group
+func runXreadgroup(command *command, c *aetherClient, server *AetherServer) response {
+	command.dontReplicate()
+
+	args := command.getKeys()
+	if strings.ToUpper(args[0]) != "GROUP" {
+		return newErrorResponse("syntax error", false)
+	}
+	opts, failure := parseReadOptions(args[3:], true)
+	if failure != nil {
+		return failure
+	}
+
+	r := &groupRead{
+		group:    args[1],
+		consumer: args[2],
+		keys:     opts.keys,
+		ids:      opts.ids,
+		count:    opts.count,
+		noack:    opts.noack,
+	}
+	fresh := true
+	for n, key := range r.keys {
+		if _, _, failure := server.lookupGroup(key, r.group); failure != nil {
+			return failure
+		}
+		if r.ids[n] == ">" {
+			continue
+		}
+		if _, err := parseStreamId(r.ids[n], 0); err != nil {
+			return newErrorResponse(err.Error(), false)
+		}
+		fresh = false
+	}
+
+	reply, ok := r.read(server)
+	if ok {
+		return reply
+	}
+	if !fresh || !opts.block || c == nil || server.isExecuting() {
+		return newNullArrayResponse("No entries found")
+	}
+
+	server.block(c, &blockingState{
+		command:  command,
+		keys:     r.keys,
+		deadline: opts.deadline,
+		serve: func(s *AetherServer, _ string) (element, bool) {
+			return r.read(s)
+		},
+	})
+
+	return nil // The reply will be sent when unblocked
+}
+
+func runXack(command *command, server *AetherServer) response {
+	args := command.getArgs()
+	ids := make([]streamId, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, err := parseStreamId(string(arg), 0)
+		if err != nil {
+			command.dontReplicate()
+			return newErrorResponse(err.Error(), false)
+		}
+		ids = append(ids, id)
+	}
+
+	i, found, isStream := server.hm.getStream(command.key)
+	if found && !isStream {
+		command.dontReplicate()
+		return wrongTypeResponse
+	}
+	if !found {
+		return newIntegerResponse(0)
+	}
+	g, found := i.getGroup(string(args[0]))
+	if !found {
+		return newIntegerResponse(0)
+	}
+
+	acked := 0
+	for _, id := range ids {
+		if server.hm.ack(i, g, id) {
+			acked++
+		}
+	}
+	return newIntegerResponse(acked)
+}
+
+// runXpending returns the summary of the entries pending in the group, or
+// the pending entries in the range if given, as
+// "key group [[IDLE min-idle] start end count [consumer]]"
+func runXpending(command *command, server *AetherServer) response {
+	args := command.getArgs()
+	_, g, failure := server.lookupGroup(command.key, string(args[0]))
+	if failure != nil {
+		return failure
+	}
+	if len(args) == 1 {
+		return newPendingSummaryResponse(g)
+	}
+
+	pos := 1
+	minIdle := int64(0)
+	if strings.ToUpper(string(args[1])) == "IDLE" && len(args) > 2 {
+		idle, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return notAnIntegerResponse
+		}
+		minIdle = idle
+		pos = 3
+	}
+	if len(args)-pos != 3 && len(args)-pos != 4 {
+		return newErrorResponse("syntax error", false)
+	}
+	start, startOk, err := parseRangeId(string(args[pos]), false)
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+	end, endOk, err := parseRangeId(string(args[pos+1]), true)
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+	count, err := strconv.Atoi(string(args[pos+2]))
+	if err != nil {
+		return notAnIntegerResponse
+	}
+	consumer := ""
+	if len(args)-pos == 4 {
+		consumer = string(args[pos+3])
+	}
+
+	now := nowMillis()
+	elements := make([]element, 0)
+	for _, id := range g.pendingIds(consumer) {
+		if len(elements) >= count || !startOk || !endOk || end.less(id) {
+			break
+		}
+		p := g.pending[id]
+		idle := now - p.delivered
+		if id.less(start) || idle < minIdle {
+			continue
+		}
+		elements = append(elements, newArrayResponse([]element{
+			newStringResponse([]byte(id.String())),
+			newStringResponse([]byte(p.consumer)),
+			newIntegerResponse(int(idle)),
+			newIntegerResponse(p.deliveries),
+		}))
+	}
+	return newArrayResponse(elements)
+}
+
+// newPendingSummaryResponse replies the count of pending entries, the
+// smallest and greatest of their ids and how many each consumer has
+func newPendingSummaryResponse(g *consumerGroup) element {
+	ids := g.pendingIds("")
+	if len(ids) == 0 {
+		return newArrayResponse([]element{
+			newIntegerResponse(0),
+			newNullResponse("No pending entries"),
+			newNullResponse("No pending entries"),
+			newNullArrayResponse("No pending entries"),
+		})
+	}
+
+	perConsumer := make(map[string]int)
+	for _, p := range g.pending {
+		perConsumer[p.consumer]++
+	}
+	consumers := make([]string, 0, len(perConsumer))
+	for consumer := range perConsumer {
+		consumers = append(consumers, consumer)
+	}
+	sort.Strings(consumers)
+
+	counts := make([]element, 0, len(consumers))
+	for _, consumer := range consumers {
+		counts = append(counts, newBytesArrayResponse([][]byte{
+			[]byte(consumer),
+			[]byte(strconv.Itoa(perConsumer[consumer])),
+		}))
+	}
+	return newArrayResponse([]element{
+		newIntegerResponse(len(ids)),
+		newStringResponse([]byte(ids[0].String())),
+		newStringResponse([]byte(ids[len(ids)-1].String())),
+		newArrayResponse(counts),
+	})
+}
+
+// claimOptions are the options of XCLAIM following the ids
+type claimOptions struct {
+	delivered  int64 // Unix time in millis the claimed entries are taken as delivered
+	retryCount int   // Negative means incrementing the count of deliveries
+	force      bool
+	justId     bool
+	lastId     *streamId
+}
+
+func parseClaimOptions(args [][]byte) (claimOptions, error) {
+	opts := claimOptions{delivered: nowMillis(), retryCount: -1}
+	for n := 0; n < len(args); n++ {
+		option := strings.ToUpper(string(args[n]))
+		switch option {
+		case "FORCE":
+			opts.force = true
+			continue
+		case "JUSTID":
+			opts.justId = true
+			continue
+		}
+		if n+1 >= len(args) {
+			return opts, fmt.Errorf("syntax error")
+		}
+		value := string(args[n+1])
+		n++
+
+		var err error
+		switch option {
+		case "IDLE":
+			var idle int64
+			idle, err = strconv.ParseInt(value, 10, 64)
+			opts.delivered = nowMillis() - idle
+		case "TIME":
+			opts.delivered, err = strconv.ParseInt(value, 10, 64)
+		case "RETRYCOUNT":
+			opts.retryCount, err = strconv.Atoi(value)
+		case "LASTID":
+			var id streamId
+			id, err = parseStreamId(value, 0)
+			opts.lastId = &id
+		default:
+			return opts, fmt.Errorf("syntax error")
+		}
+		if err != nil {
+			return opts, fmt.Errorf("Invalid %v of XCLAIM", option)
+		}
+	}
+	return opts, nil
+}
+
+// groupClaim is a XCLAIM of the given pending entries for the consumer
+type groupClaim struct {
+	claimOptions
+	key      string
+	group    string
+	consumer string
+	minIdle  int64
+	ids      []streamId
+}
+
+// runXclaim hands the pending entries idle long enough over to the consumer
+func runXclaim(command *command, client *aetherClient, server *AetherServer) response {
+	command.dontReplicate()
+
+	args := command.getArgs()
+	i, g, failure := server.lookupGroup(command.key, string(args[0]))
+	if failure != nil {
+		return failure
+	}
+	c := &groupClaim{key: command.key, group: string(args[0]), consumer: string(args[1])}
+	minIdle, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return newErrorResponse("Invalid min-idle-time argument for XCLAIM", false)
+	}
+	c.minIdle = minIdle
+
+	n := 3
+	for ; n < len(args); n++ {
+		id, err := parseStreamId(string(args[n]), 0)
+		if err != nil {
+			break
+		}
+		c.ids = append(c.ids, id)
+	}
+	if len(c.ids) == 0 {
+		return newErrorResponse("Invalid stream ID specified as stream command argument", false)
+	}
+	c.claimOptions, err = parseClaimOptions(args[n:])
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+
+	claimed, writes := c.claim(server, i, g)
+	if client != nil {
+		// Otherwise already replicated
+		server.propagateAll(writes)
+	}
+	if c.justId {
+		ids := make([][]byte, 0, len(claimed))
+		for _, entry := range claimed {
+			ids = append(ids, []byte(entry.id.String()))
+		}
+		return newBytesArrayResponse(ids)
+	}
+	existing := make([]streamEntry, 0, len(claimed))
+	for _, entry := range claimed {
+		if entry.fields != nil {
+			existing = append(existing, entry)
+		}
+	}
+	return newStreamEntriesResponse(existing)
+}
+
+// claim makes the claims, returning the claimed entries and the writes that
+// replicate them. Entries trimmed from the stream are dropped from the pending
+// ones instead (unless FORCE is given, as when restoring them).
+func (c *groupClaim) claim(server *AetherServer, i *item, g *consumerGroup) ([]streamEntry, []*command) {
+	writes := make([]*command, 0)
+	if server.hm.createConsumer(i, g, c.consumer) {
+		writes = append(writes, newCreateConsumerCommand(c.key, c.group, c.consumer))
+	}
+	if c.lastId != nil && g.lastDelivered.less(*c.lastId) {
+		server.hm.setGroupId(i, g, *c.lastId)
+	}
+
+	now := nowMillis()
+	claimed := make([]streamEntry, 0)
+	for _, id := range c.ids {
+		p, pending := g.pending[id]
+		entry, exists := i.xlookup(id)
+		switch {
+		case !pending && !c.force:
+			continue
+		case pending && !exists && !c.force:
+			server.hm.ack(i, g, id)
+			writes = append(writes, newArgsCommand(commandXack, c.key, [][]byte{[]byte(c.group), []byte(id.String())}))
+			continue
+		case pending && now-p.delivered < c.minIdle:
+			continue
+		}
+
+		deliveries := 0
+		if pending {
+			deliveries = p.deliveries
+		}
+		switch {
+		case c.retryCount >= 0:
+			deliveries = c.retryCount
+		case !c.justId:
+			deliveries++
+		}
+		claim := &pendingEntry{consumer: c.consumer, delivered: c.delivered, deliveries: deliveries}
+		server.hm.claim(i, g, id, claim)
+		writes = append(writes, newForcedClaimCommand(c.key, c.group, id, claim, nil))
+
+		if !exists {
+			entry = streamEntry{id: id}
+		}
+		claimed = append(claimed, entry)
+	}
+
+	if c.lastId != nil {
+		lastId := []byte(g.lastDelivered.String())
+		writes = append(writes, newArgsCommand(commandXgroup, "SETID", [][]byte{[]byte(c.key), []byte(c.group), lastId}))
+	}
+	return claimed, writes
+}
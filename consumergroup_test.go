@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newStreamServer() *AetherServer {
+	return &AetherServer{hm: newHashmap(), replicas: newClientSet(), waiting: newWaitingList()}
+}
+
+func runStreamCommand(server *AetherServer, c *aetherClient, code commandCode, key string, args ...string) response {
+	return commandRunners[code](newArgsCommand(code, key, streamArgs(args...)), c, server)
+}
+
+func TestXgroupCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	missing := runStreamCommand(server, nil, commandXgroup, "CREATE", "s", "g", "$")
+	assert.IsType(&rawBytesResponse{}, missing, "the stream must exist without MKSTREAM")
+
+	create := newArgsCommand(commandXgroup, "CREATE", streamArgs("s", "g", "$", "MKSTREAM"))
+	assert.Same(okResponse, runXgroup(create, server))
+	assert.Equal(streamArgs("s", "g", "0-0", "MKSTREAM"), create.getReplication().getArgs(), "$ is replicated as the actual id")
+
+	busy := runStreamCommand(server, nil, commandXgroup, "CREATE", "s", "g", "0")
+	assert.Equal(newCodedErrorResponse("BUSYGROUP", "Consumer Group name already exists", false), busy)
+
+	assert.Equal(newIntegerResponse(1), runStreamCommand(server, nil, commandXgroup, "CREATECONSUMER", "s", "g", "alice"))
+	assert.Equal(newIntegerResponse(0), runStreamCommand(server, nil, commandXgroup, "CREATECONSUMER", "s", "g", "alice"))
+	assert.Equal(newIntegerResponse(1), runStreamCommand(server, nil, commandXgroup, "DESTROY", "s", "g"))
+	assert.Equal(newNoGroupResponse("s", "g"), runStreamCommand(server, nil, commandXgroup, "SETID", "s", "g", "0"))
+}
+
+func TestXreadgroupAndXack(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		runXadd(newArgsCommand(commandXadd, "s", streamArgs(id, "f", id)), server)
+	}
+	runStreamCommand(server, nil, commandXgroup, "CREATE", "s", "g", "0")
+
+	reply := runStreamCommand(server, nil, commandXreadgroup, "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">")
+	assert.Equal([]any{[]any{"s", []any{
+		[]any{"1-0", []any{"f", "1-0"}},
+		[]any{"2-0", []any{"f", "2-0"}},
+	}}}, reply.(element).toNative())
+
+	reply = runStreamCommand(server, nil, commandXreadgroup, "GROUP", "g", "bob", "STREAMS", "s", ">")
+	assert.Equal([]any{[]any{"s", []any{[]any{"3-0", []any{"f", "3-0"}}}}}, reply.(element).toNative(), "each entry goes to a single consumer")
+
+	reply = runStreamCommand(server, nil, commandXreadgroup, "GROUP", "g", "alice", "STREAMS", "s", "0")
+	assert.Len(reply.(element).toNative().([]any)[0].([]any)[1], 2, "the history of alice")
+
+	assert.Equal(newIntegerResponse(1), runStreamCommand(server, nil, commandXack, "s", "g", "1-0", "9-0"))
+	assert.Equal(newIntegerResponse(0), runStreamCommand(server, nil, commandXack, "s", "other", "2-0"))
+
+	summary := runStreamCommand(server, nil, commandXpending, "s", "g")
+	assert.Equal([]any{int64(2), "2-0", "3-0", []any{
+		[]any{"alice", "1"},
+		[]any{"bob", "1"},
+	}}, summary.(element).toNative())
+
+	pending := runStreamCommand(server, nil, commandXpending, "s", "g", "-", "+", "10", "bob").(element).toNative().([]any)
+	assert.Len(pending, 1)
+	assert.Equal("3-0", pending[0].([]any)[0])
+	assert.Equal(int64(1), pending[0].([]any)[3])
+
+	none := runStreamCommand(server, nil, commandXreadgroup, "GROUP", "g", "alice", "STREAMS", "s", ">")
+	assert.IsType(&nullResponse{}, none)
+}
+
+func TestXreadgroupPropagatesTheDeliveries(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	runXadd(newArgsCommand(commandXadd, "s", streamArgs("1-0", "f", "v")), server)
+	runStreamCommand(server, nil, commandXgroup, "CREATE", "s", "g", "0")
+
+	server.beginExec()
+	readgroup := newArgsCommand(commandXreadgroup, "GROUP", streamArgs("g", "alice", "STREAMS", "s", ">"))
+	runXreadgroup(readgroup, nil, server)
+	writes := server.execWrites
+	server.endExec()
+
+	assert.Nil(readgroup.getReplication())
+	assert.Len(writes, 2)
+	assert.Equal(commandXgroup, writes[0].getCode(), "the consumer is created first")
+	delivered := server.hm.data["s"].stream.groups["g"].pending[streamId{ms: 1}].delivered
+	assert.Equal(newForcedClaimCommand("s", "g", streamId{ms: 1}, &pendingEntry{consumer: "alice", delivered: delivered, deliveries: 1}, &streamId{ms: 1}), writes[1])
+}
+
+func TestXclaim(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	for _, id := range []string{"1-0", "2-0"} {
+		runXadd(newArgsCommand(commandXadd, "s", streamArgs(id, "f", "v")), server)
+	}
+	runStreamCommand(server, nil, commandXgroup, "CREATE", "s", "g", "0")
+	runStreamCommand(server, nil, commandXreadgroup, "GROUP", "g", "alice", "STREAMS", "s", ">")
+	g := server.hm.data["s"].stream.groups["g"]
+
+	notIdle := runStreamCommand(server, nil, commandXclaim, "s", "g", "bob", "60000", "1-0")
+	assert.Equal([]any{}, notIdle.(element).toNative(), "claimed only if idle for long enough")
+
+	g.pending[streamId{ms: 1}].delivered -= 120000
+	claimed := runStreamCommand(server, nil, commandXclaim, "s", "g", "bob", "60000", "1-0", "2-0")
+	assert.Equal([]any{[]any{"1-0", []any{"f", "v"}}}, claimed.(element).toNative())
+	assert.Equal("bob", g.pending[streamId{ms: 1}].consumer)
+	assert.Equal(2, g.pending[streamId{ms: 1}].deliveries)
+
+	justId := runStreamCommand(server, nil, commandXclaim, "s", "g", "carol", "0", "2-0", "JUSTID", "RETRYCOUNT", "7")
+	assert.Equal([]any{"2-0"}, justId.(element).toNative())
+	assert.Equal(7, g.pending[streamId{ms: 2}].deliveries)
+
+	runXtrim(newArgsCommand(commandXtrim, "s", streamArgs("MAXLEN", "0")), server)
+	trimmed := runStreamCommand(server, nil, commandXclaim, "s", "g", "bob", "0", "2-0")
+	assert.Equal([]any{}, trimmed.(element).toNative())
+	assert.NotContains(g.pending, streamId{ms: 2}, "trimmed entries stop being pending")
+}
+
+func TestConsumerGroupsRestored(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		runXadd(newArgsCommand(commandXadd, "s", streamArgs(id, "f", "v")), server)
+	}
+	runStreamCommand(server, nil, commandXgroup, "CREATE", "s", "g", "0")
+	runStreamCommand(server, nil, commandXgroup, "CREATE", "s", "idle", "$")
+	runStreamCommand(server, nil, commandXgroup, "CREATECONSUMER", "s", "idle", "nobody")
+	runStreamCommand(server, nil, commandXreadgroup, "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">")
+	runXtrim(newArgsCommand(commandXtrim, "s", streamArgs("MAXLEN", "1")), server)
+
+	restored := newStreamServer()
+	for _, pieces := range server.hm.data["s"].genRestoreCommands() {
+		code := commandCode(pieces[0])
+		commandRunners[code](newArgsCommand(code, string(pieces[1]), pieces[2:]), nil, restored)
+	}
+
+	original := server.hm.data["s"]
+	restoredStream := restored.hm.data["s"]
+	assert.Equal(original.stream.entries, restoredStream.stream.entries)
+	assert.Equal(original.stream.groups, restoredStream.stream.groups, "pending entries survive even if trimmed")
+	assert.Equal(original.getMemory(), restoredStream.getMemory())
+}
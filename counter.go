@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// update replaces the value of a string item keeping its expiration
+func (hm *hashmap) update(i *item, value []byte) {
+	hm.resize(i, int64(len(value)-len(i.value)))
+	i.value = value
+	hm.modified(i)
+}
+
+// storeCounter sets the counter to the new value, creating it if needed, and makes
+// the command be replicated as a SET of the result so replaying it twice (or
+// over a diverged value) can't double count
+func (hm *hashmap) storeCounter(command *command, value []byte, event string) {
+	i, found := hm.get(command.key)
+	if !found {
+		hm.put(&item{key: command.key, kind: kindString, value: value, creation: time.Now()})
+		command.replicateAs(newSetCommand(command.key, value, 0))
+	} else {
+		hm.update(i, value)
+		command.replicateAs(newSetCommand(command.key, value, i.getDeadline()))
+	}
+	hm.notifyEvent(notifyString, event, command.key)
+}
+
+// getCounter returns the current value of the counter (missing keys are 0)
+func (hm *hashmap) getCounter(key string) ([]byte, bool) {
+	i, found, isString := hm.lookup(key, kindString)
+	if !found {
+		return []byte("0"), true
+	}
+	if !isString {
+		return nil, false
+	}
+	return i.getValue(), true
+}
+
+func runIncrBy(command *command, server *AetherServer, increment int64) response {
+	value, isString := server.hm.getCounter(command.key)
+	if !isString {
+		return wrongTypeResponse
+	}
+
+	current, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return notAnIntegerResponse
+	}
+	if overflows(current, increment) {
+		return newErrorResponse("increment or decrement would overflow", false)
+	}
+
+	current += increment
+	server.hm.storeCounter(command, []byte(strconv.FormatInt(current, 10)), "incrby")
+	return newIntegerResponse(int(current))
+}
+
+func runIncrByFloat(command *command, server *AetherServer) response {
+	increment, err := strconv.ParseFloat(string(command.getArg(0)), 64)
+	if err != nil || math.IsNaN(increment) || math.IsInf(increment, 0) {
+		return newErrorResponse("value is not a valid float", false)
+	}
+
+	value, isString := server.hm.getCounter(command.key)
+	if !isString {
+		return wrongTypeResponse
+	}
+
+	current, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+		return newErrorResponse("value is not a valid float", false)
+	}
+
+	current += increment
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return newErrorResponse("increment would produce NaN or Infinity", false)
+	}
+
+	result := []byte(formatDouble(current))
+	server.hm.storeCounter(command, result, "incrbyfloat")
+	return newStringResponse(result)
+}
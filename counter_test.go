@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountersReplicateTheResult(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap()}
+
+	incr := newArgsCommand(commandIncrby, "hits", [][]byte{[]byte("5")})
+	runIncrBy(incr, server, 5)
+	assert.Equal(newSetCommand("hits", []byte("5"), 0), incr.getReplication())
+
+	deadline := nowMillis() + 60000
+	server.hm.data["hits"].deadline = deadline
+	decr := newArgsCommand(commandDecr, "hits", [][]byte{})
+	runIncrBy(decr, server, -1)
+	assert.Equal(newSetCommand("hits", []byte("4"), deadline), decr.getReplication())
+	assert.Equal(deadline, server.hm.data["hits"].getDeadline(), "counters keep their expiration")
+
+	float := newArgsCommand(commandIncrbyfloat, "hits", [][]byte{[]byte("0.5")})
+	runIncrByFloat(float, server)
+	assert.Equal([]byte("4.5"), float.getReplication().getValue())
+
+	failed := newArgsCommand(commandIncr, "hits", [][]byte{})
+	assert.Same(notAnIntegerResponse, runIncrBy(failed, server, 1))
+	assert.Same(failed, failed.getReplication())
+
+	server.hm.set("max", []byte("9223372036854775807"), 0)
+	overflow := newArgsCommand(commandIncr, "max", [][]byte{})
+	runIncrBy(overflow, server, 1)
+	assert.Equal([]byte("9223372036854775807"), server.hm.data["max"].getValue())
+
+	server.hm.set("inf", []byte("1e308"), 0)
+	runIncrByFloat(newArgsCommand(commandIncrbyfloat, "inf", [][]byte{[]byte("1e308")}), server)
+	assert.Equal([]byte("1e308"), server.hm.data["inf"].getValue())
+
+	l, _ := server.hm.getOrCreateList("queue")
+	server.hm.rpush(l, []byte("1"))
+	assert.Same(wrongTypeResponse, runIncrBy(newArgsCommand(commandIncr, "queue", [][]byte{}), server, 1))
+}
@@ -16,22 +16,7 @@ type newCommandEvent struct {
 }
 
 func (e *newCommandEvent) exec(server *AetherServer) bool {
-	client := e.client
-	command := e.command
-	code := command.getCode()
-
-	if server.isAReplica() && !command.canRunOnAReplica() {
-		response := newErrorResponse("this instance is a read replica (read-only)", true)
-		client.enqueueReply(response)
-		return false
-	}
-
-	runner := commandRunners[code]
-	response := runner(command, client, server)
-	client.enqueueReply(response)
-	if command.isWriteCommand() {
-		server.broadcast(command)
-	}
+	server.execute(e.client, e.command)
 	return false
 }
 
@@ -87,12 +72,18 @@ type heartBeat struct {
 
 func (e *heartBeat) exec(server *AetherServer) bool {
 	server.evictExpiredKeys()
+	server.purgeKeys()
+	server.serveQueues()
+	// Workers blocked on the dead-letter lists the timed out jobs went to
+	server.serveBlockedClients()
+	server.timeoutBlockedClients()
 	server.updateStatistics()
+	server.tickAppendLog()
 	if e.everyOneHundred() && server.mustSave() {
-		items := server.getItems()
-		server.washClean()
-		server.setSnapshotting(true)
+		items := server.cutSnapshot()
 		go server.persist(items)
+	} else if server.mustRewriteAppendLog() {
+		server.startAppendLogRewrite()
 	}
 	return false
 }
@@ -105,6 +96,19 @@ func newHeartBeat(no int) event {
 	return &heartBeat{no: no}
 }
 
+type appendLogRewrittenEvent struct {
+	tmp string
+}
+
+func (e *appendLogRewrittenEvent) exec(server *AetherServer) bool {
+	server.finishAppendLogRewrite(e.tmp)
+	return false
+}
+
+func newAppendLogRewrittenEvent(tmp string) event {
+	return &appendLogRewrittenEvent{tmp: tmp}
+}
+
 type writingErrorEvent struct {
 	client *aetherClient
 	err    error
@@ -132,6 +136,8 @@ func (e *readingErrorEvent) exec(server *AetherServer) bool {
 	if e.err.isTechnical() {
 		server.disconnect(e.client)
 	} else {
+		// A command of the transaction is lost, so it can't be executed
+		e.client.abortTransaction()
 		response := e.err.toErrorResponse()
 		e.client.enqueueReply(response)
 	}
@@ -155,23 +161,27 @@ func newErrorAcceptingConnectionEvent(err error) event {
 	return &errorAcceptingConnectionEvent{err: err}
 }
 
+// sourceCommand holds the commands sent by the master, more than one when
+// they are a transaction that must be applied at once
 type sourceCommand struct {
-	command *command
+	commands []*command
 }
 
 func (e *sourceCommand) exec(server *AetherServer) bool {
-	command := e.command
-
-	log.WithFields(log.Fields{"command": command.getCode()}).Trace("New command recv")
+	for _, command := range e.commands {
+		log.WithFields(log.Fields{"command": command.getCode()}).Trace("New command recv")
 
-	code := command.getCode()
-	runner := commandRunners[code]
-	_ = runner(command, nil, server)
+		code := command.getCode()
+		runner := commandRunners[code]
+		_ = runner(command, nil, server)
+	}
+	// Readers blocked on this instance (e.g. XREAD BLOCK on a replica)
+	server.serveBlockedClients()
 	return false
 }
 
-func newSourceCommand(command *command) event {
-	return &sourceCommand{command: command}
+func newSourceCommand(commands []*command) event {
+	return &sourceCommand{commands: commands}
 }
 
 type errorReadingFromMasterEvent struct {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
+
+// addMillis returns the time plus the millis, false if it overflows
+func addMillis(at int64, millis int64) (int64, bool) {
+	if (millis > 0 && at > math.MaxInt64-millis) || (millis < 0 && at < math.MinInt64-millis) {
+		return 0, false
+	}
+	return at + millis, true
+}
+
+// secsToMillis returns the secs as millis, false if they overflow
+func secsToMillis(secs int64) (int64, bool) {
+	if secs > math.MaxInt64/1000 || secs < math.MinInt64/1000 {
+		return 0, false
+	}
+	return secs * 1000, true
+}
+
+// expire sets the deadline (Unix time in millis) for the item to expire
+func (hm *hashmap) expire(i *item, deadline int64) {
+	i.deadline = deadline
+	hm.transientKeys.add(i.getKey())
+	hm.modified(i)
+}
+
+// persist removes the expiration of the item returning false if it had none
+func (hm *hashmap) persist(i *item) bool {
+	if !i.isTransient() {
+		return false
+	}
+	i.deadline = 0
+	hm.transientKeys.rm(i.getKey())
+	hm.modified(i)
+	return true
+}
+
+func (i *item) genExpireCommandPieces() [][]byte {
+	return [][]byte{
+		[]byte(commandPexpireat),
+		[]byte(i.getKey()),
+		[]byte(strconv.FormatInt(i.getDeadline(), 10)),
+	}
+}
+
+// runExpire sets the key to expire at the deadline computed from the command
+// argument. It's replicated as a PEXPIREAT, or a RM if the deadline is already
+// gone, so the replicas expire the key at the very same instant.
+func runExpire(command *command, server *AetherServer, toDeadline func(int64) (int64, bool)) response {
+	arg, err := strconv.ParseInt(string(command.getArg(0)), 10, 64)
+	if err != nil {
+		command.dontReplicate()
+		return notAnIntegerResponse
+	}
+
+	deadline, ok := toDeadline(arg)
+	if !ok {
+		command.dontReplicate()
+		code := strings.ToLower(string(command.getCode()))
+		return newErrorResponse(fmt.Sprintf("invalid expire time in '%s' command", code), false)
+	}
+
+	i, found := server.hm.get(command.key)
+	if !found {
+		command.dontReplicate()
+		return newIntegerResponse(0)
+	}
+
+	if deadline <= nowMillis() {
+		server.hm.rm(command.key)
+		command.replicateAs(newCommand(commandRm, command.key, []byte{}, 0))
+		return newIntegerResponse(1)
+	}
+
+	server.hm.expire(i, deadline)
+	command.replicateAs(newArgsCommand(commandPexpireat, command.key, [][]byte{
+		[]byte(strconv.FormatInt(deadline, 10)),
+	}))
+	return newIntegerResponse(1)
+}
+
+// runTtl replies the time left for the key in the unit (as millis), -1 if the
+// key doesn't expire and -2 if there is no such key
+func runTtl(command *command, server *AetherServer, unit int64) response {
+	i, found := server.hm.get(command.key)
+	switch {
+	case !found:
+		return newIntegerResponse(-2)
+	case !i.isTransient():
+		return newIntegerResponse(-1)
+	}
+	ttl := (i.getTimeToLive() + unit/2) / unit
+	return newIntegerResponse(int(ttl))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpireAndPersist(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap()}
+	hm := server.hm
+
+	h, _ := hm.getOrCreateHash("user")
+	hm.hset(h, "name", []byte("jairo"))
+
+	assert.Equal(newIntegerResponse(-1), runTtl(newArgsCommand(commandTtl, "user", nil), server, 1000))
+	assert.Equal(newIntegerResponse(-2), runTtl(newArgsCommand(commandTtl, "none", nil), server, 1000))
+
+	expire := newArgsCommand(commandPexpire, "user", [][]byte{[]byte("30000")})
+	assert.Equal(newIntegerResponse(1), commandRunners[commandPexpire](expire, nil, server))
+	assert.True(hm.transientKeys.has("user"))
+	assert.Equal(newIntegerResponse(30), runTtl(newArgsCommand(commandTtl, "user", nil), server, 1000))
+
+	deadline := strconv.FormatInt(h.getDeadline(), 10)
+	assert.Equal(commandPexpireat, expire.getReplication().getCode())
+	assert.Equal([]byte(deadline), expire.getReplication().getArg(0))
+
+	assert.Equal([][][]byte{
+		{[]byte("HSET"), []byte("user"), []byte("name"), []byte("jairo")},
+		{[]byte("PEXPIREAT"), []byte("user"), []byte(deadline)},
+	}, h.genRestoreCommands())
+
+	assert.True(hm.persist(h))
+	assert.False(hm.persist(h))
+	assert.False(hm.transientKeys.has("user"))
+
+	missing := newArgsCommand(commandExpire, "none", [][]byte{[]byte("30")})
+	assert.Equal(newIntegerResponse(0), commandRunners[commandExpire](missing, nil, server))
+	assert.Nil(missing.getReplication(), "nothing was written")
+
+	for _, code := range []commandCode{commandExpire, commandPexpire, commandExpireat} {
+		huge := newArgsCommand(code, "user", [][]byte{[]byte("9223372036854775807")})
+		msg := fmt.Sprintf("invalid expire time in '%s' command", strings.ToLower(string(code)))
+		assert.Equal(newErrorResponse(msg, false), commandRunners[code](huge, nil, server))
+		assert.Nil(huge.getReplication())
+	}
+	_, found := hm.get("user")
+	assert.True(found, "not removed by an overflowing deadline")
+
+	invalid := newArgsCommand(commandExpire, "user", [][]byte{[]byte("soon")})
+	assert.Same(notAnIntegerResponse, commandRunners[commandExpire](invalid, nil, server))
+	assert.Nil(invalid.getReplication())
+
+	past := newArgsCommand(commandExpireat, "user", [][]byte{[]byte(strconv.FormatInt(time.Now().Unix()-10, 10))})
+	assert.Equal(newIntegerResponse(1), commandRunners[commandExpireat](past, nil, server))
+	_, found = hm.get("user")
+	assert.False(found, "expiring in the past removes the key")
+	assert.Equal(commandRm, past.getReplication().getCode())
+}
+
+func TestSetCommandCarriesTheDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	set := newCommand(commandSet, "key", []byte("value"), 10)
+	deadline := set.resolveDeadline()
+	assert.InDelta(nowMillis()+10000, deadline, 100)
+	assert.Equal(deadline, set.resolveDeadline(), "the deadline is resolved only once")
+
+	assert.Equal([][]byte{
+		[]byte("SET"), []byte("key"), []byte("value"),
+		[]byte("PXAT"), []byte(strconv.FormatInt(deadline, 10)),
+	}, set.toPieces())
+
+	hm := newHashmap()
+	hm.set("key", []byte("value"), deadline)
+	i, _ := hm.get("key")
+	assert.Equal(set.toPieces(), i.genSetCommandPieces())
+}
+
+func TestExpiredKeysAreDroppedOnLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	past := strconv.FormatInt(nowMillis()-1000, 10)
+	future := strconv.FormatInt(nowMillis()+60000, 10)
+	snapshot := "# aetherg v0.1.0-beta snapshot format 2 2024-01-01 10:00:00\n" +
+		"SET gone value PXAT " + past + "\n" +
+		"HSET gone-hash field value\n" +
+		"PEXPIREAT gone-hash " + past + "\n" +
+		"SET kept value PXAT " + future + "\n"
+
+	server := &AetherServer{hm: newHashmap(), snapFile: filepath.Join(t.TempDir(), "test.snap")}
+	assert.Nil(os.WriteFile(server.snapFile, []byte(snapshot), 0644))
+	server.loadSnapshot()
+
+	assert.NotContains(server.hm.data, "gone")
+	assert.NotContains(server.hm.data, "gone-hash")
+	assert.Contains(server.hm.data, "kept")
+	assert.Equal(1, server.hm.transientKeys.len())
+}
+
+func TestReadSnapshotFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	headers := map[string]int{
+		"# aetherg v0.1.0-beta snapshot 2024-01-01 10:00:00\n":          1,
+		"# aetherg v0.1.0-beta snapshot format 2 2024-01-01 10:00:00\n": 2,
+		"": 1,
+	}
+
+	for header, format := range headers {
+		path := filepath.Join(t.TempDir(), "test.snap")
+		assert.Nil(os.WriteFile(path, []byte(header+"SET key value\n"), 0644))
+
+		snap, err := os.Open(path)
+		assert.Nil(err)
+		assert.Equal(format, readSnapshotFormat(snap))
+
+		content, _ := io.ReadAll(snap)
+		assert.Equal(header+"SET key value\n", string(content), "the file must be rewound")
+		snap.Close()
+	}
+}
@@ -40,3 +40,18 @@ func absPath(file string) string {
 	}
 	return path
 }
+
+func truncateFile(path string) {
+	if !fileExists(path) {
+		return
+	}
+
+	err := os.Truncate(path, 0)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"path":  path,
+		}).Error("Error trying to truncate a file")
+		os.Exit(EXIT_FAILURE)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+// globMatch tells if the string matches the Redis-like glob pattern, where
+// * matches anything, ? any single char, [abc], [^abc] and [a-z] classes of
+// chars, and a backslash escapes the next char
+func globMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for n := 0; n <= len(s); n++ {
+				if globMatch(pattern[1:], s[n:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end, matched := matchClass(pattern, s[0])
+			if !matched {
+				return false
+			}
+			pattern = pattern[end:]
+			s = s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass matches the char against the [class] at the start of the
+// pattern, returning how much of the pattern the class takes
+func matchClass(pattern string, c byte) (int, bool) {
+	n := 1
+	negate := n < len(pattern) && pattern[n] == '^'
+	if negate {
+		n++
+	}
+
+	matched := false
+	for n < len(pattern) && pattern[n] != ']' {
+		switch {
+		case pattern[n] == '\\' && n+1 < len(pattern):
+			n++
+			matched = matched || pattern[n] == c
+		case n+2 < len(pattern) && pattern[n+1] == '-' && pattern[n+2] != ']':
+			low, high := pattern[n], pattern[n+2]
+			if low > high {
+				low, high = high, low
+			}
+			matched = matched || (c >= low && c <= high)
+			n += 2
+		default:
+			matched = matched || pattern[n] == c
+		}
+		n++
+	}
+
+	if n < len(pattern) {
+		n++ // The closing ]
+	}
+
+	return n, matched != negate
+}
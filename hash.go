@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+func newHashItem(key string) *item {
+	return &item{
+		key:      key,
+		kind:     kindHash,
+		hash:     make(map[string][]byte),
+		elements: newKeyIndex(),
+		creation: time.Now(),
+	}
+}
+
+// hset sets the field value returning true if the field is a new one
+func (i *item) hset(field string, value []byte) bool {
+	_, found := i.hash[field]
+	i.hash[field] = value
+	i.elements.add(field)
+	return !found
+}
+
+func (i *item) hget(field string) ([]byte, bool) {
+	value, found := i.hash[field]
+	return value, found
+}
+
+func (i *item) hdel(field string) bool {
+	_, found := i.hash[field]
+	delete(i.hash, field)
+	i.elements.rm(field)
+	return found
+}
+
+func (i *item) hlen() int {
+	return len(i.hash)
+}
+
+// hfields returns the hash fields in alphabetical order
+func (i *item) hfields() []string {
+	fields := make([]string, 0, len(i.hash))
+	for field := range i.hash {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (i *item) cloneHash() map[string][]byte {
+	hash := make(map[string][]byte, len(i.hash))
+	for field, value := range i.hash {
+		hash[field] = value
+	}
+	return hash
+}
+
+func (i *item) genHsetCommandPieces() [][]byte {
+	pieces := [][]byte{
+		[]byte(commandHset),
+		[]byte(i.getKey()),
+	}
+
+	for _, field := range i.hfields() {
+		pieces = append(pieces, []byte(field), i.hash[field])
+	}
+
+	return pieces
+}
+
+func (hm *hashmap) getHash(key string) (*item, bool, bool) {
+	return hm.lookup(key, kindHash)
+}
+
+func (hm *hashmap) getOrCreateHash(key string) (*item, bool) {
+	return hm.lookupOrCreate(key, kindHash, newHashItem)
+}
+
+func (hm *hashmap) hset(i *item, field string, value []byte) bool {
+	hm.modified(i)
+	old, found := i.hget(field)
+	if found {
+		hm.resize(i, int64(len(value)-len(old)))
+	} else {
+		hm.resize(i, entryMemory([]byte(field), value))
+	}
+	return i.hset(field, value)
+}
+
+func (hm *hashmap) hdel(i *item, field string) bool {
+	value, _ := i.hget(field)
+	removed := i.hdel(field)
+	if removed {
+		hm.modified(i)
+		hm.resize(i, -entryMemory([]byte(field), value))
+	}
+	hm.rmIfEmpty(i)
+	return removed
+}
+
+func newHashResponse(i *item) element {
+	r := newMapResponse()
+	if i == nil {
+		return r
+	}
+	for _, field := range i.hfields() {
+		r.put(field, newStringResponse(i.hash[field]))
+	}
+	return r
+}
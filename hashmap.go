@@ -1,59 +1,206 @@
 package main
 
 import (
+	"container/list"
 	"strconv"
 	"time"
 )
 
 type hashmap struct {
 	data          map[string]*item
-	transientKeys map[string]bool
+	keys          *keyIndex
+	transientKeys *keyIndex
+	queueKeys     *keyIndex // Keys holding queues, served on each heart beat
 	dirty         bool
+	used          int64  // Memory taken by the items (an estimate)
+	expired       int    // Count of keys removed for being expired
+	evicted       int    // Count of keys removed to free memory
+	clock         uint64 // Last version given to a modified item
+	events        keyspaceEvents
+	// Called with the keyspace events selected by the events above
+	notify func(event string, key string)
 }
 
+const (
+	// Transient keys checked on each round of the active expiration
+	expirationSampleSize = 20
+	// Rounds go on while more than this ratio of the sample was expired
+	expirationRatio = 0.25
+	// Max time spent by each active expiration cycle
+	expirationBudget = 25 * time.Millisecond
+)
+
+type itemKind string
+
+const (
+	kindString    itemKind = "string"
+	kindHash      itemKind = "hash"
+	kindList      itemKind = "list"
+	kindSet       itemKind = "set"
+	kindSortedSet itemKind = "zset"
+	kindStream    itemKind = "stream"
+	kindQueue     itemKind = "queue"
+)
+
 type item struct {
-	key        string
-	value      []byte
-	expiration int
-	creation   time.Time
+	key       string
+	kind      itemKind
+	value     []byte
+	hash      map[string][]byte
+	list      *list.List
+	members   map[string]struct{}
+	zset      *sortedSet
+	stream    *stream
+	queue     *jobQueue
+	elements  *keyIndex // Fields or members of a hash, set or sorted set, to be scanned
+	deadline  int64     // Unix time in millis when the item expires (0 is never)
+	creation  time.Time
+	memory    int64  // Memory taken by the item (an estimate)
+	accessed  int64  // Unix time in millis of the last access
+	frequency uint8  // Logarithmic access counter, for the LFU eviction
+	version   uint64 // Clock of the hashmap when the item was last modified
 }
 
 func newHashmap() *hashmap {
 	hm := new(hashmap)
 	hm.data = make(map[string]*item)
-	hm.transientKeys = make(map[string]bool)
+	hm.keys = newKeyIndex()
+	hm.transientKeys = newKeyIndex()
+	hm.queueKeys = newKeyIndex()
 	return hm
 }
 
+// get returns the item at the key, expired ones are removed on the spot so
+// they are never seen between the active expiration cycles
 func (hm *hashmap) get(key string) (*item, bool) {
 	i, ok := hm.data[key]
+	if ok && i.isTransient() && i.hasExpired() {
+		hm.rmExpired(key)
+		return nil, false
+	}
+	if ok {
+		i.touch()
+	}
 	return i, ok
 }
 
-func (hm *hashmap) rm(key string) {
-	delete(hm.data, key)
-	delete(hm.transientKeys, key)
+// put stores the item at its key, replacing whatever was there
+func (hm *hashmap) put(i *item) {
+	if old, found := hm.data[i.key]; found {
+		hm.used -= old.memory
+	}
+	i.memory = i.measure()
+	i.accessed = nowMillis()
+	i.frequency = lfuInitialFrequency
+	hm.data[i.key] = i
+	hm.keys.add(i.key)
+	if i.is(kindQueue) {
+		hm.queueKeys.add(i.key)
+	} else {
+		hm.queueKeys.rm(i.key)
+	}
+	hm.used += i.memory
+	hm.modified(i)
+}
+
+// modified marks the item as changed, giving it a new version so the clients
+// watching the key (WATCH) know their transactions must be aborted
+func (hm *hashmap) modified(i *item) {
+	hm.clock++
+	i.version = hm.clock
 	hm.dirty = true
 }
 
-func (hm *hashmap) set(key string, val []byte, expiration int) {
-	hm.data[key] = &item{
-		key:        key,
-		value:      val,
-		expiration: expiration,
-		creation:   time.Now(),
+// getVersion returns the version of the item at the key, where missing keys
+// are 0 and a key removed and set again never gets the same version back
+func (hm *hashmap) getVersion(key string) uint64 {
+	i, found := hm.data[key]
+	if !found || (i.isTransient() && i.hasExpired()) {
+		return 0
+	}
+	return i.version
+}
+
+// lookup returns the item stored at the key, whether it was found and
+// whether it holds the given kind of value
+func (hm *hashmap) lookup(key string, kind itemKind) (*item, bool, bool) {
+	i, found := hm.get(key)
+	if !found {
+		return nil, false, false
+	}
+	return i, true, i.is(kind)
+}
+
+// lookupOrCreate is like lookup, but a missing key gets a new empty item
+func (hm *hashmap) lookupOrCreate(key string, kind itemKind, create func(string) *item) (*item, bool) {
+	i, found, ok := hm.lookup(key, kind)
+	if !found {
+		i = create(key)
+		hm.put(i)
+		return i, true
+	}
+	return i, ok
+}
+
+// rmIfEmpty removes collections left without elements, like Redis does
+func (hm *hashmap) rmIfEmpty(i *item) {
+	if i.size() == 0 {
+		hm.rm(i.getKey())
+	}
+}
+
+func (hm *hashmap) rm(key string) bool {
+	removed := hm.remove(key)
+	if removed {
+		hm.notifyEvent(notifyGeneric, "del", key)
 	}
+	return removed
+}
 
+// remove drops the key without telling why, so the callers notify it
+func (hm *hashmap) remove(key string) bool {
+	i, found := hm.data[key]
+	if found {
+		hm.used -= i.memory
+	}
+	delete(hm.data, key)
+	hm.keys.rm(key)
+	hm.transientKeys.rm(key)
+	hm.queueKeys.rm(key)
 	hm.dirty = true
+	return found
+}
+
+func (hm *hashmap) set(key string, val []byte, deadline int64) {
+	if deadline != 0 && deadline <= nowMillis() {
+		// Already expired (e.g. loaded from disk after its deadline)
+		hm.rm(key)
+		return
+	}
+
+	hm.put(&item{
+		key:      key,
+		kind:     kindString,
+		value:    val,
+		deadline: deadline,
+		creation: time.Now(),
+	})
 
-	if expiration != 0 {
-		hm.transientKeys[key] = true
+	if deadline != 0 {
+		hm.transientKeys.add(key)
+	} else {
+		hm.transientKeys.rm(key)
 	}
+
+	hm.notifyEvent(notifyString, "set", key)
 }
 
 func (hm *hashmap) getKeys() []string {
 	keys := make([]string, 0)
-	for key := range hm.data {
+	for key, i := range hm.data {
+		if i.isTransient() && i.hasExpired() {
+			continue // Just not evicted yet
+		}
 		keys = append(keys, key)
 	}
 	return keys
@@ -64,26 +211,68 @@ func (hm *hashmap) count() int {
 }
 
 func (hm *hashmap) rmall() {
+	if hm.notifies(notifyGeneric) {
+		for key := range hm.data {
+			hm.notify("del", key)
+		}
+	}
+
 	hm.data = make(map[string]*item)
-	hm.transientKeys = make(map[string]bool)
+	hm.keys = newKeyIndex()
+	hm.transientKeys = newKeyIndex()
+	hm.queueKeys = newKeyIndex()
+	hm.used = 0
 	hm.dirty = true
 }
 
+// getItens returns a copy of the items that can be safely read by another
+// goroutine while the hashmap keeps changing (e.g. during snapshots)
 func (hm *hashmap) getItens() []*item {
 	itens := []*item{}
 	for _, item := range hm.data {
-		itens = append(itens, item)
+		itens = append(itens, item.clone())
 	}
 	return itens
 }
 
-func (hm *hashmap) evict() {
-	for key := range hm.transientKeys {
-		item, _ := hm.get(key)
-		if item.isTransient() && item.hasExpired() {
-			hm.rm(key)
+// evict removes expired keys sampling the transient ones at random, Redis
+// style. The sampling goes on while a good share of the sample turns out to
+// be expired, but never for longer than the time budget, so the event loop
+// isn't stalled no matter how many keys are set to expire.
+func (hm *hashmap) evict() int {
+	start := time.Now()
+	evicted := 0
+
+	for hm.transientKeys.len() > 0 {
+		sample := min(expirationSampleSize, hm.transientKeys.len())
+		expired := 0
+		for n := 0; n < sample; n++ {
+			key := hm.transientKeys.random()
+			if hm.data[key].hasExpired() {
+				hm.rmExpired(key)
+				expired++
+			}
+		}
+
+		evicted += expired
+
+		if float64(expired) <= float64(sample)*expirationRatio || time.Since(start) > expirationBudget {
+			break
 		}
 	}
+
+	return evicted
+}
+
+// rmExpired removes a key for being expired
+func (hm *hashmap) rmExpired(key string) {
+	hm.remove(key)
+	hm.expired++
+	hm.notifyEvent(notifyExpired, "expired", key)
+}
+
+func (hm *hashmap) getExpiredCount() int {
+	return hm.expired
 }
 
 func (hm *hashmap) isDirty() bool {
@@ -94,6 +283,58 @@ func (hm *hashmap) washClean() {
 	hm.dirty = false
 }
 
+func (i *item) is(kind itemKind) bool {
+	return i.kind == kind
+}
+
+func (i *item) getKind() itemKind {
+	return i.kind
+}
+
+// clone copies the item. String values are never changed in place, so only
+// the collection types need to be copied over.
+func (i *item) clone() *item {
+	c := *i
+	switch i.kind {
+	case kindHash:
+		c.hash = i.cloneHash()
+		c.elements = i.elements.clone()
+	case kindList:
+		c.list = i.cloneList()
+	case kindSet:
+		c.members = i.cloneMembers()
+		c.elements = i.elements.clone()
+	case kindSortedSet:
+		c.zset = i.cloneSortedSet()
+		c.elements = i.elements.clone()
+	case kindStream:
+		c.stream = i.cloneStream()
+	case kindQueue:
+		c.queue = i.cloneQueue()
+	}
+	return &c
+}
+
+// size is the number of elements of a collection (strings are always 1)
+func (i *item) size() int {
+	switch i.kind {
+	case kindHash:
+		return i.hlen()
+	case kindList:
+		return i.llen()
+	case kindSet:
+		return i.scard()
+	case kindSortedSet:
+		return i.zcard()
+	case kindStream:
+		return i.xlen()
+	case kindQueue:
+		return i.qlen()
+	default:
+		return 1
+	}
+}
+
 func (i *item) getValue() []byte {
 	return i.value
 }
@@ -106,8 +347,8 @@ func (i *item) getKey() string {
 	return i.key
 }
 
-func (i *item) getExpiration() int {
-	return i.expiration
+func (i *item) getDeadline() int64 {
+	return i.deadline
 }
 
 func (i *item) getCreation() time.Time {
@@ -115,23 +356,45 @@ func (i *item) getCreation() time.Time {
 }
 
 func (i *item) isTransient() bool {
-	return i.expiration != 0
+	return i.deadline != 0
 }
 
-func (i *item) getTimeToLive() int {
-	return i.expiration - i.getAge()
-}
-
-func (i *item) getAge() int {
-	now := time.Now()
-	age := now.Unix() - i.creation.Unix()
-	return int(age)
+// getTimeToLive returns the millis left before the item expires
+func (i *item) getTimeToLive() int64 {
+	return i.deadline - nowMillis()
 }
 
 func (i *item) hasExpired() bool {
 	return i.getTimeToLive() <= 0
 }
 
+// genRestoreCommands returns the commands that recreate the item as it is
+// now, used for snapshots, replica SYNC and append-only log rewrites
+func (i *item) genRestoreCommands() [][][]byte {
+	var commands [][][]byte
+	switch i.kind {
+	case kindHash:
+		commands = [][][]byte{i.genHsetCommandPieces()}
+	case kindList:
+		commands = [][][]byte{i.genRpushCommandPieces()}
+	case kindSet:
+		commands = [][][]byte{i.genSaddCommandPieces()}
+	case kindSortedSet:
+		commands = [][][]byte{i.genZaddCommandPieces()}
+	case kindStream:
+		commands = append(i.genXaddCommandPieces(), i.genXgroupCommandPieces()...)
+	case kindQueue:
+		commands = i.genQpushCommandPieces()
+	default:
+		// SET carries the expiration itself
+		return [][][]byte{i.genSetCommandPieces()}
+	}
+	if i.isTransient() {
+		commands = append(commands, i.genExpireCommandPieces())
+	}
+	return commands
+}
+
 func (i *item) genSetCommandPieces() [][]byte {
 	pieces := [][]byte{
 		[]byte("SET"),
@@ -140,13 +403,11 @@ func (i *item) genSetCommandPieces() [][]byte {
 	}
 
 	if i.isTransient() {
-		// TODO: Sending expiration to the replica as the current TTL is a dangerous and simplistic assumption
-		// It assumes that the lastMeasurement between now and the lastMeasurement that this item settle in the replica's hashmap, it passes
-		// ZERO seconds. A better replication algorithm would take this into consideration.
-		ttl := i.getTimeToLive()
-		expiration := strconv.Itoa(ttl)
-		pieces = append(pieces, []byte("EXP"))
-		pieces = append(pieces, []byte(expiration))
+		// The absolute deadline makes the item expire at the same instant
+		// no matter when the command gets to the replica (or disk)
+		deadline := strconv.FormatInt(i.getDeadline(), 10)
+		pieces = append(pieces, []byte("PXAT"))
+		pieces = append(pieces, []byte(deadline))
 	}
 
 	return pieces
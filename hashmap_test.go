@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -12,7 +13,7 @@ func TestHashMapRW(t *testing.T) {
 
 	key := "F398BC5672A51D8D"
 	val := []byte("71A79DF49BDC291E1578986A71929")
-	exp := 360
+	exp := nowMillis() + 360000
 
 	hm := newHashmap()
 	hm.set(key, val, exp)
@@ -23,7 +24,7 @@ func TestHashMapRW(t *testing.T) {
 	assert.Equal(item.getKey(), key)
 	assert.Equal(item.getValue(), val)
 	assert.Equal(item.toString(), string(val))
-	assert.Equal(item.getExpiration(), exp)
+	assert.Equal(item.getDeadline(), exp)
 
 	hm.rm(key)
 	_, found = hm.get(key)
@@ -35,7 +36,7 @@ func TestExpirationOfKeys(t *testing.T) {
 
 	key := "F398BC5672A51D8D"
 	val := []byte("71A79DF49BDC291E1578986A71929")
-	exp := 2
+	exp := nowMillis() + 2000
 
 	hm := newHashmap()
 	hm.set(key, val, exp)
@@ -46,3 +47,91 @@ func TestExpirationOfKeys(t *testing.T) {
 	_, found := hm.get(key)
 	assert.Equal(found, false)
 }
+
+func TestHashFields(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+
+	h, isHash := hm.getOrCreateHash("user:1")
+	assert.True(isHash)
+	assert.True(hm.hset(h, "name", []byte("Jairo")))
+	assert.True(hm.hset(h, "age", []byte("35")))
+	assert.False(hm.hset(h, "age", []byte("36")))
+
+	h, found, isHash := hm.getHash("user:1")
+	assert.True(found)
+	assert.True(isHash)
+	assert.Equal([]string{"age", "name"}, h.hfields())
+
+	value, found := h.hget("age")
+	assert.True(found)
+	assert.Equal([]byte("36"), value)
+
+	hm.set("string", []byte("value"), 0)
+	_, found, isHash = hm.getHash("string")
+	assert.True(found)
+	assert.False(isHash)
+
+	assert.True(hm.hdel(h, "name"))
+	assert.False(hm.hdel(h, "name"))
+	assert.True(hm.hdel(h, "age"))
+
+	_, found = hm.get("user:1")
+	assert.False(found, "empty hashes must be removed")
+}
+
+func TestClonedHashIsNotChangedByWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	h, _ := hm.getOrCreateHash("user:1")
+	hm.hset(h, "name", []byte("Jairo"))
+
+	items := hm.getItens()
+	hm.hset(h, "age", []byte("36"))
+
+	assert.Equal(1, items[0].hlen())
+	assert.Equal([][][]byte{{
+		[]byte("HSET"), []byte("user:1"), []byte("name"), []byte("Jairo"),
+	}}, items[0].genRestoreCommands())
+}
+
+func TestActiveExpirationSamplesTransientKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	for n := 0; n < 1000; n++ {
+		hm.set(fmt.Sprintf("gone-%v", n), []byte("value"), nowMillis()+10)
+		hm.set(fmt.Sprintf("kept-%v", n), []byte("value"), 0)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// Every sample is all expired, so the sampling goes on until none is left
+	assert.Equal(1000, hm.evict())
+	assert.Equal(1000, hm.getExpiredCount())
+	assert.Equal(1000, hm.count())
+	assert.Equal(0, hm.transientKeys.len())
+
+	hm.set("later", []byte("value"), nowMillis()+60000)
+	assert.Equal(0, hm.evict())
+	assert.Equal(1001, hm.count())
+}
+
+func TestLazyExpirationOnAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	hm.set("key", []byte("value"), nowMillis()+10)
+	hm.set("other", []byte("value"), nowMillis()+10)
+	hm.set("other", []byte("value"), 0)
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Equal([]string{"other"}, hm.getKeys())
+	_, found := hm.get("key")
+	assert.False(found)
+	assert.Equal(1, hm.getExpiredCount())
+	assert.Equal(0, hm.transientKeys.len(), "persisted keys must leave the transient ones")
+}
@@ -0,0 +1,84 @@
+package main
+
+import "math/rand"
+
+// keyIndex is a set of keys that can also pick one of them at random in O(1),
+// used to sample the transient keys, and be scanned a chunk at a time
+type keyIndex struct {
+	keys      []string
+	positions map[string]int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		keys:      make([]string, 0),
+		positions: make(map[string]int),
+	}
+}
+
+func (idx *keyIndex) add(key string) {
+	if _, found := idx.positions[key]; found {
+		return
+	}
+	idx.positions[key] = len(idx.keys)
+	idx.keys = append(idx.keys, key)
+}
+
+// rm removes the key moving the last one to its place
+func (idx *keyIndex) rm(key string) {
+	pos, found := idx.positions[key]
+	if !found {
+		return
+	}
+	last := len(idx.keys) - 1
+	idx.keys[pos] = idx.keys[last]
+	idx.positions[idx.keys[pos]] = pos
+	idx.keys = idx.keys[:last]
+	delete(idx.positions, key)
+}
+
+func (idx *keyIndex) has(key string) bool {
+	_, found := idx.positions[key]
+	return found
+}
+
+// getKeys returns a copy of the keys, safe to iterate while changing the index
+func (idx *keyIndex) getKeys() []string {
+	return append([]string{}, idx.keys...)
+}
+
+// scan visits up to count keys from the end of the index towards its start.
+// Keys are removed by moving the last key to their place, so a key not yet
+// visited never moves to where the scan has already been: every key present
+// for the whole scan is visited at least once (maybe more). The cursor is the
+// position of the next key to visit plus one, 0 when the scan is over.
+func (idx *keyIndex) scan(cursor int, count int, visit func(key string)) int {
+	pos := idx.len() - 1
+	if cursor > 0 {
+		pos = min(cursor-1, pos)
+	}
+	for visited := 0; pos >= 0 && visited < count; visited++ {
+		visit(idx.keys[pos])
+		pos--
+	}
+	return pos + 1
+}
+
+func (idx *keyIndex) clone() *keyIndex {
+	c := &keyIndex{
+		keys:      append([]string{}, idx.keys...),
+		positions: make(map[string]int, len(idx.positions)),
+	}
+	for key, pos := range idx.positions {
+		c.positions[key] = pos
+	}
+	return c
+}
+
+func (idx *keyIndex) random() string {
+	return idx.keys[rand.Intn(len(idx.keys))]
+}
+
+func (idx *keyIndex) len() int {
+	return len(idx.keys)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	idx := newKeyIndex()
+	idx.add("a")
+	idx.add("b")
+	idx.add("c")
+	idx.add("a")
+	assert.Equal(3, idx.len())
+
+	idx.rm("a")
+	idx.rm("missing")
+	assert.Equal(2, idx.len())
+	assert.False(idx.has("a"))
+	assert.True(idx.has("c"))
+
+	for n := 0; n < 10; n++ {
+		assert.Contains([]string{"b", "c"}, idx.random())
+	}
+
+	idx.rm("c")
+	idx.rm("b")
+	assert.Equal(0, idx.len())
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"time"
+)
+
+func newListItem(key string) *item {
+	return &item{
+		key:      key,
+		kind:     kindList,
+		list:     list.New(),
+		creation: time.Now(),
+	}
+}
+
+func (i *item) lpush(value []byte) {
+	i.list.PushFront(value)
+}
+
+func (i *item) rpush(value []byte) {
+	i.list.PushBack(value)
+}
+
+func (i *item) lpop() ([]byte, bool) {
+	return i.pop(i.list.Front())
+}
+
+func (i *item) rpop() ([]byte, bool) {
+	return i.pop(i.list.Back())
+}
+
+func (i *item) pop(e *list.Element) ([]byte, bool) {
+	if e == nil {
+		return nil, false
+	}
+	i.list.Remove(e)
+	return e.Value.([]byte), true
+}
+
+func (i *item) llen() int {
+	return i.list.Len()
+}
+
+// normalizeRange converts Redis-like start/stop indexes (negative ones
+// counting from the end) to a valid inclusive range, or false if it is empty
+func normalizeRange(start int, stop int, length int) (int, int, bool) {
+	if start < 0 {
+		start = length + start
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	start = max(start, 0)
+	stop = min(stop, length-1)
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+func (i *item) lrange(start int, stop int) [][]byte {
+	values := make([][]byte, 0)
+	start, stop, ok := normalizeRange(start, stop, i.llen())
+	if !ok {
+		return values
+	}
+	index := 0
+	for e := i.list.Front(); e != nil && index <= stop; e = e.Next() {
+		if index >= start {
+			values = append(values, e.Value.([]byte))
+		}
+		index++
+	}
+	return values
+}
+
+func (i *item) lindex(index int) ([]byte, bool) {
+	if index < 0 {
+		index = i.llen() + index
+	}
+	if index < 0 || index >= i.llen() {
+		return nil, false
+	}
+	if index < i.llen()/2 {
+		e := i.list.Front()
+		for ; index > 0; index-- {
+			e = e.Next()
+		}
+		return e.Value.([]byte), true
+	}
+	e := i.list.Back()
+	for index = i.llen() - 1 - index; index > 0; index-- {
+		e = e.Prev()
+	}
+	return e.Value.([]byte), true
+}
+
+// ltrim keeps only the elements inside the range
+func (i *item) ltrim(start int, stop int) {
+	length := i.llen()
+	start, stop, ok := normalizeRange(start, stop, length)
+	if !ok {
+		i.list.Init()
+		return
+	}
+	for n := 0; n < start; n++ {
+		i.list.Remove(i.list.Front())
+	}
+	for n := stop + 1; n < length; n++ {
+		i.list.Remove(i.list.Back())
+	}
+}
+
+func (i *item) cloneList() *list.List {
+	c := list.New()
+	c.PushBackList(i.list)
+	return c
+}
+
+func (i *item) genRpushCommandPieces() [][]byte {
+	pieces := [][]byte{
+		[]byte(commandRpush),
+		[]byte(i.getKey()),
+	}
+
+	for e := i.list.Front(); e != nil; e = e.Next() {
+		pieces = append(pieces, e.Value.([]byte))
+	}
+
+	return pieces
+}
+
+func (hm *hashmap) getList(key string) (*item, bool, bool) {
+	return hm.lookup(key, kindList)
+}
+
+func (hm *hashmap) getOrCreateList(key string) (*item, bool) {
+	return hm.lookupOrCreate(key, kindList, newListItem)
+}
+
+func (hm *hashmap) lpush(i *item, value []byte) {
+	hm.modified(i)
+	hm.resize(i, entryMemory(value))
+	i.lpush(value)
+}
+
+func (hm *hashmap) rpush(i *item, value []byte) {
+	hm.modified(i)
+	hm.resize(i, entryMemory(value))
+	i.rpush(value)
+}
+
+func (hm *hashmap) lpop(i *item) ([]byte, bool) {
+	value, found := i.lpop()
+	return hm.popped(i, value, found)
+}
+
+func (hm *hashmap) rpop(i *item) ([]byte, bool) {
+	value, found := i.rpop()
+	return hm.popped(i, value, found)
+}
+
+func (hm *hashmap) popped(i *item, value []byte, found bool) ([]byte, bool) {
+	if found {
+		hm.resize(i, -entryMemory(value))
+	}
+	hm.modified(i)
+	hm.rmIfEmpty(i)
+	return value, found
+}
+
+func (hm *hashmap) ltrim(i *item, start int, stop int) {
+	i.ltrim(start, stop)
+	hm.resize(i, i.measure()-i.getMemory())
+	hm.modified(i)
+	hm.rmIfEmpty(i)
+}
+
+func newBytesArrayResponse(values [][]byte) element {
+	elements := make([]element, 0, len(values))
+	for _, value := range values {
+		elements = append(elements, newStringResponse(value))
+	}
+	return newArrayResponse(elements)
+}
+
+func runPush(command *command, server *AetherServer, front bool) response {
+	i, isList := server.hm.getOrCreateList(command.key)
+	if !isList {
+		return wrongTypeResponse
+	}
+	for _, value := range command.getArgs() {
+		if front {
+			server.hm.lpush(i, value)
+		} else {
+			server.hm.rpush(i, value)
+		}
+	}
+	server.signalKeyAsReady(command.key)
+	return newIntegerResponse(i.llen())
+}
+
+// runPop pops one element, or up to count elements as an array if the
+// optional count argument is given
+func runPop(command *command, server *AetherServer, front bool) response {
+	count := 1
+	if len(command.getArgs()) > 0 {
+		var err error
+		count, err = command.getIntArg(0)
+		if err != nil || count < 0 {
+			return newErrorResponse("value is out of range, must be positive", false)
+		}
+	}
+
+	i, found, isList := server.hm.getList(command.key)
+	switch {
+	case found && !isList:
+		return wrongTypeResponse
+	case !found && len(command.getArgs()) > 0:
+		return newNullArrayResponse(fmt.Sprintf("Key \"%v\" not found", command.key))
+	case !found:
+		msg := fmt.Sprintf("Key \"%v\" not found", command.key)
+		return newNullResponse(msg)
+	}
+
+	values := make([][]byte, 0, min(count, i.llen()))
+	for len(values) < count {
+		var value []byte
+		var ok bool
+		if front {
+			value, ok = server.hm.lpop(i)
+		} else {
+			value, ok = server.hm.rpop(i)
+		}
+		if !ok {
+			break
+		}
+		values = append(values, value)
+	}
+
+	if len(command.getArgs()) > 0 {
+		return newBytesArrayResponse(values)
+	}
+	return newStringResponse(values[0])
+}
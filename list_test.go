@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	l, _ := hm.getOrCreateList("queue")
+	for _, value := range []string{"a", "b", "c", "d", "e"} {
+		hm.rpush(l, []byte(value))
+	}
+
+	toStrings := func(values [][]byte) []string {
+		strings := make([]string, 0)
+		for _, value := range values {
+			strings = append(strings, string(value))
+		}
+		return strings
+	}
+
+	assert.Equal([]string{"a", "b", "c", "d", "e"}, toStrings(l.lrange(0, -1)))
+	assert.Equal([]string{"d", "e"}, toStrings(l.lrange(-2, 100)))
+	assert.Equal([]string{"b", "c"}, toStrings(l.lrange(1, 2)))
+	assert.Equal([]string{}, toStrings(l.lrange(3, 1)))
+	assert.Equal([]string{}, toStrings(l.lrange(10, 20)))
+
+	value, found := l.lindex(-1)
+	assert.True(found)
+	assert.Equal([]byte("e"), value)
+
+	value, found = l.lindex(3)
+	assert.True(found)
+	assert.Equal([]byte("d"), value)
+
+	_, found = l.lindex(5)
+	assert.False(found)
+
+	hm.ltrim(l, 1, -2)
+	assert.Equal([]string{"b", "c", "d"}, toStrings(l.lrange(0, -1)))
+
+	hm.ltrim(l, 5, 10)
+	_, found = hm.get("queue")
+	assert.False(found, "empty lists must be removed")
+}
+
+func TestListPushAndPop(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	l, isList := hm.getOrCreateList("queue")
+	assert.True(isList)
+
+	hm.lpush(l, []byte("b"))
+	hm.lpush(l, []byte("a"))
+	hm.rpush(l, []byte("c"))
+
+	value, _ := hm.lpop(l)
+	assert.Equal([]byte("a"), value)
+	value, _ = hm.rpop(l)
+	assert.Equal([]byte("c"), value)
+	assert.Equal(1, l.llen())
+
+	assert.Equal([][][]byte{{
+		[]byte("RPUSH"), []byte("queue"), []byte("b"),
+	}}, hm.getItens()[0].genRestoreCommands())
+
+	hm.set("string", []byte("value"), 0)
+	_, isList = hm.getOrCreateList("string")
+	assert.False(isList)
+}
+
+func TestPopWithCount(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	runStreamCommand(server, nil, commandRpush, "l", "a", "b")
+	pop := func(key string, args ...string) response {
+		return runPop(newArgsCommand(commandLpop, key, streamArgs(args...)), server, true)
+	}
+
+	assert.Equal([]any{"a", "b"}, pop("l", "9223372036854775807").(element).toNative(), "a huge count takes what there is")
+	assert.Equal(newNullArrayResponse(`Key "l" not found`), pop("l", "1"), "an array was asked for")
+	assert.Equal(newNullResponse(`Key "l" not found`), pop("l"))
+}
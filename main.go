@@ -21,6 +21,13 @@ func parseArgs() AetherSettings {
 	var loggingLevel string
 	var json bool
 	var snapshot string
+	var appendLog string
+	var appendFsync string
+	var resp2 bool
+	var maxMemory string
+	var maxMemoryPolicy string
+	var keyspaceEvents string
+	var queueMaxAttempts int
 
 	flag.StringVar(&host, "h", "localhost", "Server's tcp host")
 	flag.IntVar(&port, "p", 3000, "Server's tcp port")
@@ -29,6 +36,16 @@ func parseArgs() AetherSettings {
 	flag.StringVar(&loggingLevel, "l", "trace", "Logging level (trace, debug, info, etc)")
 	flag.BoolVar(&json, "j", false, "JSON logger formatter")
 	flag.StringVar(&snapshot, "f", defaultSnapshotFile, "Path to snapshot file")
+	flag.StringVar(&appendLog, "a", "", "Path to append-only log file (disabled if empty)")
+	flag.StringVar(&appendFsync, "fsync", string(fsyncEverySec), "Append-only log fsync policy (always, everysec or no)")
+	flag.BoolVar(&resp2, "resp2", false, "Reply in strict RESP2 (compatible with redis-cli and Redis clients)")
+
+	flag.StringVar(&maxMemory, "maxmemory", "0", "Memory limit for the keys, like 512mb or 2gb (0 is no limit)")
+	flag.StringVar(&maxMemoryPolicy, "maxmemory-policy", string(evictNoEviction), "How keys are evicted at the memory limit (allkeys-lru, allkeys-lfu, volatile-lru, volatile-ttl, random or noeviction)")
+
+	flag.StringVar(&keyspaceEvents, "notify-keyspace-events", "", "Keyspace notifications published, like KEA (K keyspace, E keyevent, g del, $ string writes, s set stores, x expired, e evicted, A all)")
+
+	flag.IntVar(&queueMaxAttempts, "queue-max-attempts", defaultQueueMaxAttempts, "Times a queued job can be reserved before going to the dead-letter list")
 
 	flag.Parse()
 
@@ -43,11 +60,47 @@ func parseArgs() AetherSettings {
 
 	log.SetLevel(level) // Maybe this could be hardcoded instead...
 
+	fsync, err := parseFsyncPolicy(appendFsync)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	memory, err := parseMemorySize(maxMemory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	policy, err := parseEvictionPolicy(maxMemoryPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	events, err := parseKeyspaceEvents(keyspaceEvents)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if queueMaxAttempts < 1 {
+		log.Fatal("queue-max-attempts must be at least 1")
+	}
+
+	proto := protocolAetherg
+	if resp2 {
+		proto = protocolResp2
+	}
+
 	return AetherSettings{
-		Port:          port,
-		Host:          host,
-		Replicate:     replicate,
-		SourceAddress: source,
-		Snapshot:      snapshot,
+		Port:             port,
+		Host:             host,
+		Replicate:        replicate,
+		SourceAddress:    source,
+		Snapshot:         snapshot,
+		AppendLog:        appendLog,
+		AppendFsync:      fsync,
+		Protocol:         proto,
+		MaxMemory:        memory,
+		EvictionPolicy:   policy,
+		KeyspaceEvents:   events,
+		QueueMaxAttempts: queueMaxAttempts,
 	}
 }
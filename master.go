@@ -14,6 +14,7 @@ type master struct {
 }
 
 func (m *master) follow(server *AetherServer) {
+	buffer := &transactionBuffer{}
 	for {
 		command, _, err := m.parser.next()
 		if err != nil {
@@ -22,8 +23,10 @@ func (m *master) follow(server *AetherServer) {
 			return
 		}
 
-		e := newSourceCommand(command)
-		server.newEvent(e)
+		if commands := buffer.add(command); len(commands) > 0 {
+			e := newSourceCommand(commands)
+			server.newEvent(e)
+		}
 	}
 }
 
@@ -45,11 +48,11 @@ func (m *master) sync(server *AetherServer) {
 		fatal("Invalid first token from master (expecting array)", log.Fields{"type": token.getType()})
 	}
 
-	numOfKeys := token.getSize()
+	numOfCommands := token.getSize()
 
-	info("Downloading keys from main node", log.Fields{"keys": numOfKeys})
+	info("Downloading keys from main node", log.Fields{"commands": numOfCommands})
 
-	for i := 0; i < numOfKeys; i++ {
+	for i := 0; i < numOfCommands; i++ {
 		command, _, parsingErr := m.parser.next()
 		if parsingErr != nil {
 			log.WithFields(log.Fields{
@@ -59,15 +62,15 @@ func (m *master) sync(server *AetherServer) {
 			os.Exit(EXIT_FAILURE)
 		}
 
-		switch command.getCode() {
-		case commandSet:
-			server.hm.set(command.getKey(), command.getValue(), command.getExpiration())
+		switch {
+		case command.isWriteCommand():
+			server.apply(command)
 		default:
 			fatal("Invalid command during initial SYNC", log.Fields{"code": command.getCode()})
 		}
 	}
 
-	info("Keys downloaded from main server", log.Fields{"keys": numOfKeys})
+	info("Keys downloaded from main server", log.Fields{"keys": server.hm.count()})
 }
 
 func (m *master) close() {
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+type evictionPolicy string
+
+const (
+	evictAllKeysLru  evictionPolicy = "allkeys-lru"
+	evictAllKeysLfu  evictionPolicy = "allkeys-lfu"
+	evictVolatileLru evictionPolicy = "volatile-lru"
+	evictVolatileTtl evictionPolicy = "volatile-ttl"
+	evictRandom      evictionPolicy = "random"
+	evictNoEviction  evictionPolicy = "noeviction"
+)
+
+var evictionPolicies = []evictionPolicy{
+	evictAllKeysLru,
+	evictAllKeysLfu,
+	evictVolatileLru,
+	evictVolatileTtl,
+	evictRandom,
+	evictNoEviction,
+}
+
+const (
+	// Rough cost of an item (struct, map entry and key index slot)
+	itemOverhead = 64
+	// Rough cost of each element of a collection
+	entryOverhead = 32
+)
+
+const (
+	// Keys sampled to pick the one to be evicted, like Redis does
+	evictionSampleSize = 5
+	// Frequency of the new items, so they aren't evicted right away
+	lfuInitialFrequency = 5
+	// The frequency counter is logarithmic, this slows down its growth
+	lfuLogFactor = 10
+	// Millis for the frequency counter to decay by one
+	lfuDecayTime = 60 * 1000
+)
+
+var oomResponse = newCodedErrorResponse("OOM", "command not allowed when used memory > 'maxmemory'", false)
+
+func parseEvictionPolicy(policy string) (evictionPolicy, error) {
+	for _, p := range evictionPolicies {
+		if string(p) == policy {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid eviction policy \"%v\" (allkeys-lru, allkeys-lfu, volatile-lru, volatile-ttl, random or noeviction)", policy)
+}
+
+// parseMemorySize reads sizes like "1024", "512kb", "100mb" or "2gb"
+func parseMemorySize(size string) (int64, error) {
+	units := []struct {
+		suffix string
+		bytes  int64
+	}{
+		{"gb", 1024 * 1024 * 1024},
+		{"mb", 1024 * 1024},
+		{"kb", 1024},
+		{"b", 1},
+	}
+
+	value := strings.ToLower(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size \"%v\"", size)
+	}
+	return n * multiplier, nil
+}
+
+func (p evictionPolicy) isVolatile() bool {
+	return p == evictVolatileLru || p == evictVolatileTtl
+}
+
+// entryMemory is the memory taken by a collection element of the given parts
+func entryMemory(parts ...[]byte) int64 {
+	size := int64(entryOverhead)
+	for _, part := range parts {
+		size += int64(len(part))
+	}
+	return size
+}
+
+// measure computes the memory taken by the whole item, walking every
+// element. The hashmap keeps it up to date incrementally after that.
+func (i *item) measure() int64 {
+	size := int64(itemOverhead + len(i.key))
+	switch i.kind {
+	case kindHash:
+		for field, value := range i.hash {
+			size += entryMemory([]byte(field), value)
+		}
+	case kindList:
+		for e := i.list.Front(); e != nil; e = e.Next() {
+			size += entryMemory(e.Value.([]byte))
+		}
+	case kindSet:
+		for member := range i.members {
+			size += entryMemory([]byte(member))
+		}
+	case kindSortedSet:
+		for member := range i.zset.scores {
+			size += entryMemory([]byte(member))
+		}
+	case kindStream:
+		size += entriesMemory(i.stream.entries) + i.groupsMemory()
+	case kindQueue:
+		size += i.queueMemory()
+	default:
+		size += int64(len(i.value))
+	}
+	return size
+}
+
+func (i *item) getMemory() int64 {
+	return i.memory
+}
+
+// touch records an access to the item, for the LRU and LFU policies
+func (i *item) touch() {
+	now := nowMillis()
+	frequency := i.decayedFrequency(now)
+	if frequency < 255 {
+		base := float64(max(int(frequency)-lfuInitialFrequency, 0))
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			frequency++
+		}
+	}
+	i.frequency = frequency
+	i.accessed = now
+}
+
+// decayedFrequency is the access frequency minus one for each decay period
+// since the last access, so keys once hot but now forgotten can be evicted
+func (i *item) decayedFrequency(now int64) uint8 {
+	periods := (now - i.accessed) / lfuDecayTime
+	if periods >= int64(i.frequency) {
+		return 0
+	}
+	return i.frequency - uint8(periods)
+}
+
+// evictionRank tells how good a candidate for eviction the item is under the
+// policy, the lower the better
+func (i *item) evictionRank(policy evictionPolicy, now int64) int64 {
+	switch policy {
+	case evictAllKeysLfu:
+		return int64(i.decayedFrequency(now))
+	case evictVolatileTtl:
+		return i.deadline
+	default:
+		return i.accessed
+	}
+}
+
+// resize accounts for the memory taken (or freed) by a change to the item
+func (hm *hashmap) resize(i *item, delta int64) {
+	i.memory += delta
+	hm.used += delta
+}
+
+func (hm *hashmap) getUsedMemory() int64 {
+	return hm.used
+}
+
+func (hm *hashmap) getEvictedCount() int {
+	return hm.evicted
+}
+
+// pickVictim samples a few keys picking the best one to be evicted under the
+// policy, or false if there is no key the policy allows to evict
+func (hm *hashmap) pickVictim(policy evictionPolicy) (string, bool) {
+	pool := hm.keys
+	if policy.isVolatile() {
+		pool = hm.transientKeys
+	}
+
+	if pool.len() == 0 || policy == evictNoEviction {
+		return "", false
+	}
+
+	if policy == evictRandom {
+		return pool.random(), true
+	}
+
+	now := nowMillis()
+	victim := ""
+	var best int64
+	for n := 0; n < evictionSampleSize; n++ {
+		key := pool.random()
+		rank := hm.data[key].evictionRank(policy, now)
+		if victim == "" || rank < best {
+			victim, best = key, rank
+		}
+	}
+	return victim, true
+}
+
+// rmEvicted removes a key to free memory
+func (hm *hashmap) rmEvicted(key string) {
+	hm.remove(key)
+	hm.evicted++
+	hm.notifyEvent(notifyEvicted, "evicted", key)
+}
+
+// freeMemory evicts keys until the memory used is under the maxmemory,
+// returning false if the policy doesn't allow it. The evictions are
+// propagated as RMs, so the replicas and the log don't diverge.
+func (s *AetherServer) freeMemory() bool {
+	if s.maxMemory == 0 {
+		return true
+	}
+
+	for s.hm.getUsedMemory() > s.maxMemory {
+		key, found := s.hm.pickVictim(s.evictionPolicy)
+		if !found {
+			return false
+		}
+		s.hm.rmEvicted(key)
+		s.propagate(newCommand(commandRm, key, []byte{}, 0))
+	}
+
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	measured := func() int64 {
+		total := int64(0)
+		for _, i := range hm.data {
+			assert.Equal(i.measure(), i.getMemory(), "item %v", i.getKey())
+			total += i.measure()
+		}
+		return total
+	}
+
+	hm.set("str", []byte("value"), 0)
+	hm.set("str", []byte("longer value"), 0)
+
+	h, _ := hm.getOrCreateHash("hash")
+	hm.hset(h, "a", []byte("1"))
+	hm.hset(h, "a", []byte("100"))
+	hm.hset(h, "b", []byte("2"))
+	hm.hdel(h, "b")
+
+	l, _ := hm.getOrCreateList("list")
+	for _, value := range []string{"a", "bb", "ccc", "dddd"} {
+		hm.rpush(l, []byte(value))
+	}
+	hm.lpop(l)
+	hm.ltrim(l, 0, 1)
+
+	s, _ := hm.getOrCreateSet("set")
+	hm.sadd(s, "x")
+	hm.sadd(s, "x")
+	hm.sadd(s, "yy")
+	hm.srem(s, "x")
+
+	z, _ := hm.getOrCreateSortedSet("zset")
+	hm.zadd(z, "m", 1)
+	hm.zadd(z, "m", 2)
+	hm.zadd(z, "n", 3)
+	hm.zrem(z, "n")
+
+	hm.store("stored", map[string]struct{}{"a": {}, "b": {}}, "sunionstore")
+	hm.update(hm.data["str"], []byte("v"))
+
+	assert.Equal(measured(), hm.getUsedMemory())
+
+	hm.rm("hash")
+	hm.rpop(l)
+	hm.rpop(l) // Removes the empty list
+	assert.Equal(measured(), hm.getUsedMemory())
+
+	hm.rmall()
+	assert.Equal(int64(0), hm.getUsedMemory())
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	_, found := hm.pickVictim(evictAllKeysLru)
+	assert.False(found)
+
+	hm.set("forever", []byte("value"), 0)
+	_, found = hm.pickVictim(evictVolatileLru)
+	assert.False(found, "volatile policies only evict keys with an expiration")
+
+	hm.set("soon", []byte("value"), nowMillis()+1000)
+	victim, _ := hm.pickVictim(evictVolatileTtl)
+	assert.Equal("soon", victim)
+
+	_, found = hm.pickVictim(evictNoEviction)
+	assert.False(found)
+
+	forever, soon := hm.data["forever"], hm.data["soon"]
+	now := nowMillis()
+
+	forever.accessed -= 10000
+	assert.Less(forever.evictionRank(evictAllKeysLru, now), soon.evictionRank(evictAllKeysLru, now))
+
+	forever.frequency = 100
+	assert.Less(soon.evictionRank(evictAllKeysLfu, now), forever.evictionRank(evictAllKeysLfu, now))
+
+	forever.accessed = now - 3*lfuDecayTime
+	assert.Equal(uint8(97), forever.decayedFrequency(now))
+}
+
+func TestFreeMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{
+		hm:             newHashmap(),
+		replicas:       newClientSet(),
+		maxMemory:      10 * 1024,
+		evictionPolicy: evictAllKeysLru,
+	}
+
+	for n := 0; n < 100; n++ {
+		server.hm.set(fmt.Sprintf("key-%v", n), make([]byte, 1000), 0)
+	}
+
+	assert.True(server.freeMemory())
+	assert.LessOrEqual(server.hm.getUsedMemory(), server.maxMemory)
+	assert.Equal(100-server.hm.count(), server.hm.getEvictedCount())
+
+	server.evictionPolicy = evictNoEviction
+	server.hm.set("big", make([]byte, 20*1024), 0)
+	assert.False(server.freeMemory())
+
+	server.maxMemory = 0
+	assert.True(server.freeMemory(), "no limit")
+}
+
+func TestParseMemorySize(t *testing.T) {
+	assert := assert.New(t)
+
+	sizes := map[string]int64{
+		"0":     0,
+		"1024":  1024,
+		"512kb": 512 * 1024,
+		"100MB": 100 * 1024 * 1024,
+		"2gb":   2 * 1024 * 1024 * 1024,
+	}
+	for size, bytes := range sizes {
+		parsed, err := parseMemorySize(size)
+		assert.Nil(err)
+		assert.Equal(bytes, parsed)
+	}
+
+	_, err := parseMemorySize("lots")
+	assert.NotNil(err)
+	_, err = parseMemorySize("-1mb")
+	assert.NotNil(err)
+}
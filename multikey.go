@@ -0,0 +1,85 @@
+package main
+
+// getKeys returns all the keys of a multi-key command (e.g. "RM key [key ...]")
+func (command *command) getKeys() []string {
+	keys := make([]string, 0, len(command.args)+1)
+	keys = append(keys, command.key)
+	for _, arg := range command.args {
+		keys = append(keys, string(arg))
+	}
+	return keys
+}
+
+// getPairs returns the key value pairs of a "CODE key value [key value ...]"
+// command, preserving their order so the last value of a repeated key wins
+func (command *command) getPairs() ([]string, [][]byte) {
+	keys := []string{command.key}
+	values := [][]byte{command.getArg(0)}
+	for i := 1; i+1 < len(command.args); i += 2 {
+		keys = append(keys, string(command.args[i]))
+		values = append(values, command.args[i+1])
+	}
+	return keys, values
+}
+
+func runRm(command *command, server *AetherServer) response {
+	removed := 0
+	for _, key := range command.getKeys() {
+		if server.hm.rm(key) {
+			removed++
+		}
+	}
+	return newCompatResponse(okResponse, newIntegerResponse(removed))
+}
+
+func runMget(command *command, server *AetherServer) response {
+	keys := command.getKeys()
+	elements := make([]element, 0, len(keys))
+	for _, key := range keys {
+		i, found := server.hm.get(key)
+		if found && i.is(kindString) {
+			elements = append(elements, newStringResponse(i.getValue()))
+		} else {
+			// As in Redis, keys of other types are reported as missing
+			elements = append(elements, newNullResponse("Key \""+key+"\" not found"))
+		}
+	}
+	return newArrayResponse(elements)
+}
+
+func runMset(command *command, server *AetherServer) response {
+	keys, values := command.getPairs()
+	for n, key := range keys {
+		server.hm.set(key, values[n], 0)
+	}
+	return okResponse
+}
+
+// runMsetnx sets all the keys only if none of them exists. Whenever it sets
+// them, it is replicated as a MSET, so the replicas don't decide it again.
+func runMsetnx(command *command, server *AetherServer) response {
+	keys, values := command.getPairs()
+	for _, key := range keys {
+		if _, found := server.hm.get(key); found {
+			command.dontReplicate()
+			return newBooleanResponse(false)
+		}
+	}
+
+	for n, key := range keys {
+		server.hm.set(key, values[n], 0)
+	}
+	command.replicateAs(newArgsCommand(commandMset, command.key, command.args))
+	return newBooleanResponse(true)
+}
+
+// runExists counts the keys that exist, a key given twice counting twice
+func runExists(command *command, server *AetherServer) response {
+	count := 0
+	for _, key := range command.getKeys() {
+		if _, found := server.hm.get(key); found {
+			count++
+		}
+	}
+	return newIntegerResponse(count)
+}
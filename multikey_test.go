@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiKeyCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap()}
+
+	mset := newArgsCommand(commandMset, "a", [][]byte{[]byte("1"), []byte("b"), []byte("2"), []byte("a"), []byte("3")})
+	assert.Same(okResponse, runMset(mset, server))
+	assert.Same(mset, mset.getReplication(), "replicated as a single command")
+	assert.Equal([][]byte{[]byte("MSET"), []byte("a"), []byte("1"), []byte("b"), []byte("2"), []byte("a"), []byte("3")}, mset.toPieces())
+
+	server.hm.lookupOrCreate("list", kindList, newListItem)
+	mget := newArgsCommand(commandMget, "a", [][]byte{[]byte("b"), []byte("missing"), []byte("list")})
+	assert.Equal([]any{"3", "2", nil, nil}, runMget(mget, server).(element).toNative())
+
+	exists := newArgsCommand(commandExists, "a", [][]byte{[]byte("a"), []byte("missing"), []byte("b")})
+	assert.Equal(newIntegerResponse(3), runExists(exists, server))
+
+	rm := newArgsCommand(commandRm, "a", [][]byte{[]byte("missing"), []byte("b")})
+	assert.Equal(newCompatResponse(okResponse, newIntegerResponse(2)), runRm(rm, server))
+	assert.Equal(newIntegerResponse(0), runExists(exists, server))
+}
+
+func TestMsetnxSetsNoneIfAnyExists(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap()}
+	server.hm.set("b", []byte("old"), 0)
+
+	failed := newArgsCommand(commandMsetnx, "a", [][]byte{[]byte("1"), []byte("b"), []byte("2")})
+	assert.Equal(newBooleanResponse(false), runMsetnx(failed, server))
+	assert.Nil(failed.getReplication())
+	assert.NotContains(server.hm.data, "a")
+	assert.Equal([]byte("old"), server.hm.data["b"].getValue())
+
+	msetnx := newArgsCommand(commandMsetnx, "a", [][]byte{[]byte("1"), []byte("c"), []byte("2")})
+	assert.Equal(newBooleanResponse(true), runMsetnx(msetnx, server))
+	assert.Equal(newArgsCommand(commandMset, "a", msetnx.args), msetnx.getReplication())
+	assert.Equal([]byte("2"), server.hm.data["c"].getValue())
+}
@@ -0,0 +1,82 @@
+package main
+
+import "fmt"
+
+// keyspaceEvents selects which keyspace notifications are published. It is
+// set from a string of flags, as the notify-keyspace-events of Redis.
+type keyspaceEvents uint8
+
+const (
+	notifyKeyspace keyspaceEvents = 1 << iota // K: published to __keyspace__:<key>
+	notifyKeyevent                            // E: published to __keyevent__:<event>
+	notifyGeneric                             // g: del
+	notifyString                              // $: set, incrby, incrbyfloat
+	notifySet                                 // s: sinterstore, sunionstore, sdiffstore
+	notifyExpired                             // x: expired
+	notifyEvicted                             // e: evicted
+
+	notifyAll = notifyGeneric | notifyString | notifySet | notifyExpired | notifyEvicted // A
+)
+
+const (
+	keyspaceChannelPrefix = "__keyspace__:"
+	keyeventChannelPrefix = "__keyevent__:"
+)
+
+var keyspaceEventFlags = map[rune]keyspaceEvents{
+	'K': notifyKeyspace,
+	'E': notifyKeyevent,
+	'g': notifyGeneric,
+	'$': notifyString,
+	's': notifySet,
+	'x': notifyExpired,
+	'e': notifyEvicted,
+	'A': notifyAll,
+}
+
+// parseKeyspaceEvents reads flags like "KEA" or "Ex". Unless at least one of
+// K or E and one class of events are given, nothing gets published at all.
+func parseKeyspaceEvents(flags string) (keyspaceEvents, error) {
+	var events keyspaceEvents
+	for _, flag := range flags {
+		event, found := keyspaceEventFlags[flag]
+		if !found {
+			return 0, fmt.Errorf("invalid keyspace events flag \"%c\" (K, E, g, $, s, x, e or A)", flag)
+		}
+		events |= event
+	}
+
+	channels := events & (notifyKeyspace | notifyKeyevent)
+	if channels == 0 || events&notifyAll == 0 {
+		return 0, nil
+	}
+	return events, nil
+}
+
+func (hm *hashmap) notifies(class keyspaceEvents) bool {
+	return hm.events&class != 0
+}
+
+// notifyEvent publishes the event if its class is selected. When the
+// notifications are disabled, this is all the cost they have.
+func (hm *hashmap) notifyEvent(class keyspaceEvents, event string, key string) {
+	if hm.notifies(class) {
+		hm.notify(event, key)
+	}
+}
+
+// enableKeyspaceEvents makes the hashmap publish the selected events to the
+// subscribers of this instance (replicas publish their own)
+func (s *AetherServer) enableKeyspaceEvents(events keyspaceEvents) {
+	s.hm.events = events
+	s.hm.notify = s.publishKeyspaceEvent
+}
+
+func (s *AetherServer) publishKeyspaceEvent(event string, key string) {
+	if s.hm.notifies(notifyKeyspace) {
+		s.pubsub.publish(keyspaceChannelPrefix+key, []byte(event))
+	}
+	if s.hm.notifies(notifyKeyevent) {
+		s.pubsub.publish(keyeventChannelPrefix+event, []byte(key))
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	events, err := parseKeyspaceEvents("KEA")
+	assert.Nil(err)
+	assert.Equal(notifyKeyspace|notifyKeyevent|notifyAll, events)
+
+	events, _ = parseKeyspaceEvents("Ex")
+	assert.Equal(notifyKeyevent|notifyExpired, events)
+
+	events, _ = parseKeyspaceEvents("K")
+	assert.Equal(keyspaceEvents(0), events, "no class of events")
+	events, _ = parseKeyspaceEvents("g$")
+	assert.Equal(keyspaceEvents(0), events, "no channel to publish to")
+	events, _ = parseKeyspaceEvents("")
+	assert.Equal(keyspaceEvents(0), events)
+
+	_, err = parseKeyspaceEvents("KEQ")
+	assert.NotNil(err)
+}
+
+func TestKeyspaceEventsFromHashmap(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	notified := make([]string, 0)
+	hm.events = notifyKeyevent | notifyGeneric | notifyExpired
+	hm.notify = func(event string, key string) {
+		notified = append(notified, event+" "+key)
+	}
+
+	hm.set("a", []byte("1"), 0)
+	hm.rm("a")
+	hm.rm("missing")
+	hm.set("t", []byte("1"), nowMillis()+60000)
+	hm.data["t"].deadline = nowMillis() - 1
+	hm.evict()
+	hm.set("b", []byte("1"), 0)
+	hm.rmall()
+
+	assert.Equal([]string{"del a", "expired t", "del b"}, notified, "set is not selected")
+}
+
+func TestKeyspaceEventsOfCountersAndStores(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	notified := make([]string, 0)
+	server.hm.events = notifyKeyevent | notifyAll
+	server.hm.notify = func(event string, key string) {
+		notified = append(notified, event+" "+key)
+	}
+
+	runStreamCommand(server, nil, commandIncr, "n")
+	runStreamCommand(server, nil, commandIncr, "n")
+	runStreamCommand(server, nil, commandIncrbyfloat, "f", "1.5")
+	runStreamCommand(server, nil, commandSadd, "a", "x")
+	runStreamCommand(server, nil, commandSunionstore, "dest", "a")
+	runStreamCommand(server, nil, commandSinterstore, "dest", "a", "missing")
+
+	assert.Equal([]string{
+		"incrby n",
+		"incrby n",
+		"incrbyfloat f",
+		"sunionstore dest",
+		"del dest",
+	}, notified)
+}
+
+func TestKeyspaceEventsPublished(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), pubsub: newPubsub()}
+	server.enableKeyspaceEvents(notifyKeyspace | notifyKeyevent | notifyAll)
+	c := newSubscriber()
+	runSubscribe(newArgsCommand(commandSubscribe, "__keyspace__:k", [][]byte{[]byte("__keyevent__:set")}), c, server, false)
+
+	server.hm.set("k", []byte("v"), 0)
+
+	replies := takeReplies(c)
+	assert.Equal([]any{"message", "__keyspace__:k", "set"}, replies[len(replies)-2])
+	assert.Equal([]any{"message", "__keyevent__:set", "k"}, replies[len(replies)-1])
+}
+
+func TestKeyspaceEventsDontWaitForSubscribers(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), pubsub: newPubsub(), events: make(chan event, 16)}
+	server.enableKeyspaceEvents(notifyKeyevent | notifyAll)
+	conn, peer := net.Pipe() // Nobody reads from the peer
+	defer peer.Close()
+	c := newClient(conn, server)
+	go c.write()
+	runSubscribe(newArgsCommand(commandPsubscribe, "__keyevent__:*", [][]byte{}), c, server, true)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < pubsubOutputLimit; n++ {
+			server.hm.set("k", []byte("v"), nowMillis()-1) // Set, then deleted
+			server.hm.set("t", []byte("v"), nowMillis()+60000)
+			server.hm.data["t"].deadline = nowMillis() - 1
+			server.hm.get("t") // Reads may expire the key too
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		assert.Fail("writes must not wait for a subscriber not reading its notifications")
+		return
+	}
+	assert.True(c.outbox.isClosed(), "the subscriber is disconnected")
+}
@@ -0,0 +1,79 @@
+package main
+
+import "sync"
+
+// Replies waiting to be written to a subscriber or a replica before it is
+// disconnected for not keeping up, like the client-output-buffer-limit of
+// Redis. Other clients only get the replies to their own commands, so they
+// aren't limited.
+const (
+	pubsubOutputLimit  = 32 * 1024
+	replicaOutputLimit = 1024 * 1024
+)
+
+// outbox holds the replies of a client until its writer gets to them, so
+// the event loop never waits on a slow (or gone) client
+type outbox struct {
+	mu      sync.Mutex
+	replies []response
+	closed  bool
+	ready   chan struct{} // Signaled when there are replies or it is closed
+}
+
+func newOutbox() *outbox {
+	return &outbox{ready: make(chan struct{}, 1)}
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default: // Already signaled
+	}
+}
+
+// push adds the reply returning how many are waiting, or false if the
+// outbox is closed and the reply was dropped
+func (o *outbox) push(r response) (int, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0, false
+	}
+	o.replies = append(o.replies, r)
+	o.signal()
+	return len(o.replies), true
+}
+
+// take waits for the replies, returning false once the outbox is closed
+func (o *outbox) take() ([]response, bool) {
+	for {
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			return nil, false
+		}
+		if len(o.replies) > 0 {
+			replies := o.replies
+			o.replies = nil
+			o.mu.Unlock()
+			return replies, true
+		}
+		o.mu.Unlock()
+		<-o.ready
+	}
+}
+
+// close drops the replies still waiting and stops the writer
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.replies = nil
+	o.signal()
+}
+
+func (o *outbox) isClosed() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.closed
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	assert := assert.New(t)
+
+	o := newOutbox()
+	pending, open := o.push(okResponse)
+	assert.Equal(1, pending)
+	assert.True(open)
+	pending, _ = o.push(pongResponse)
+	assert.Equal(2, pending)
+
+	replies, open := o.take()
+	assert.True(open)
+	assert.Equal([]response{okResponse, pongResponse}, replies)
+
+	taken := make(chan bool)
+	go func() {
+		_, open := o.take()
+		taken <- open
+	}()
+	o.close()
+	assert.False(<-taken, "closing stops the writer waiting for replies")
+
+	_, open = o.push(okResponse)
+	assert.False(open, "replies to a gone client are dropped, never waited on")
+}
@@ -126,13 +126,18 @@ func (parser *parser) getArgData(index int) []byte {
 func (parser *parser) readCommand() (commandCode, *parsingError) {
 
 	arg0 := parser.getArg(0)
+	name := strings.ToUpper(arg0)
 
 	for _, code := range commandCodes {
-		if strings.ToUpper(arg0) == string(code) {
+		if name == string(code) {
 			return code, nil
 		}
 	}
 
+	if code, found := commandAliases[name]; found {
+		return code, nil
+	}
+
 	return "", parser.invalidCommand(arg0)
 }
 
@@ -153,31 +158,78 @@ func (parser *parser) parseArgs() (*command, *ioData, *parsingError) {
 		if nparams < 2 {
 			return nil, parser.in, newParsingError("to few args, expected as least 2")
 		}
-		if nparams > 4 {
-			return nil, parser.in, newParsingError("unknow args, expected max %v given %v", 4, nparams)
-		}
 
 		key := parser.getArg(1)
 		value := parser.getArgData(2)
 		var expiration int
-
-		if nparams > 2 {
-			arg3 := parser.getArg(3)
-			if strings.ToUpper(arg3) == "EXP" {
-				arg4 := parser.getArg(4)
-				var err2 error
-				expiration, err2 = strconv.Atoi(arg4)
-				if err2 != nil {
-					return nil, parser.in, newParsingError("invalid expiration lastMeasurement \"%s\"", arg4)
+		var deadline int64
+		expires := false
+		options := make([][]byte, 0)
+
+		for i := 3; i <= nparams; i++ {
+			arg := parser.getArg(i)
+			option := strings.ToUpper(arg)
+			switch option {
+			case "EXP", "EX", "PX", "EXAT", "PXAT":
+				if expires || hasSetOption(options, setKeepTtl) {
+					return nil, parser.in, newParsingError("conflicting argument \"%s\"", arg)
+				}
+				if i == nparams {
+					return nil, parser.in, newParsingError("missing expiration time after \"%s\"", arg)
+				}
+				i++
+				amount, err2 := strconv.ParseInt(parser.getArg(i), 10, 64)
+				if err2 != nil || (option != "EXP" && amount <= 0) {
+					return nil, parser.in, newParsingError("invalid expiration lastMeasurement \"%s\"", parser.getArg(i))
 				}
-			} else {
-				return nil, parser.in, newParsingError("unknown argument \"%s\"", arg3)
+				fits := true
+				switch option {
+				case "EXP", "EX":
+					expiration = int(amount)
+					var millis int64
+					if millis, fits = secsToMillis(amount); fits {
+						_, fits = addMillis(nowMillis(), millis)
+					}
+				case "PX":
+					deadline, fits = addMillis(nowMillis(), amount)
+				case "EXAT":
+					deadline, fits = secsToMillis(amount)
+				case "PXAT":
+					deadline = amount
+				}
+				if !fits {
+					return nil, parser.in, newParsingError("invalid expire time in 'set' command")
+				}
+				expires = true
+			case setNx, setXx, setGet, setKeepTtl:
+				conflicts := hasSetOption(options, option) ||
+					(option == setNx && hasSetOption(options, setXx)) ||
+					(option == setXx && hasSetOption(options, setNx)) ||
+					(option == setKeepTtl && expires)
+				if conflicts {
+					return nil, parser.in, newParsingError("conflicting argument \"%s\"", arg)
+				}
+				options = append(options, []byte(option))
+			default:
+				return nil, parser.in, newParsingError("unknown argument \"%s\"", arg)
 			}
 		}
 
-		return newCommand(code, key, value, expiration), parser.in, nil
+		command := newCommand(code, key, value, expiration)
+		command.deadline = deadline
+		command.args = options
+		return command, parser.in, nil
 
-	case commandGet, commandRm:
+	case commandRm, commandMget, commandExists:
+		return parser.parseKeyArgs(code, 1, -1)
+
+	case commandMset, commandMsetnx:
+		if nparams > 1 && nparams%2 != 0 {
+			return nil, parser.in, newParsingError("wrong number of args, expected key and value pairs")
+		}
+		return parser.parseKeyArgs(code, 2, -1)
+
+	case commandGet:
 		if nparams < 1 {
 			return nil, parser.in, newParsingError("to few args, expected as least 1")
 		}
@@ -189,7 +241,180 @@ func (parser *parser) parseArgs() (*command, *ioData, *parsingError) {
 
 		return newCommand(code, key, []byte{}, 0), parser.in, nil
 
-	case commandRmall, commandStats, commandList, commandPing, commandExit, commandSync:
+	case commandHset:
+		if nparams > 2 && nparams%2 == 0 {
+			return nil, parser.in, newParsingError("wrong number of args, expected key and field value pairs")
+		}
+		return parser.parseKeyArgs(code, 3, -1)
+
+	case commandHget:
+		return parser.parseKeyArgs(code, 2, 2)
+
+	case commandHdel:
+		return parser.parseKeyArgs(code, 2, -1)
+
+	case commandHgetall:
+		return parser.parseKeyArgs(code, 1, 1)
+
+	case commandHincrby:
+		return parser.parseKeyArgs(code, 3, 3)
+
+	case commandLpush, commandRpush:
+		return parser.parseKeyArgs(code, 2, -1)
+
+	case commandLpop, commandRpop:
+		return parser.parseKeyArgs(code, 1, 2)
+
+	case commandLrange, commandLtrim:
+		return parser.parseKeyArgs(code, 3, 3)
+
+	case commandBlpop, commandBrpop:
+		return parser.parseKeyArgs(code, 2, -1)
+
+	case commandSadd, commandSrem, commandSinterstore, commandSunionstore, commandSdiffstore:
+		return parser.parseKeyArgs(code, 2, -1)
+
+	case commandSmembers, commandScard:
+		return parser.parseKeyArgs(code, 1, 1)
+
+	case commandSismember:
+		return parser.parseKeyArgs(code, 2, 2)
+
+	case commandSinter, commandSunion, commandSdiff:
+		return parser.parseKeyArgs(code, 1, -1)
+
+	case commandZadd:
+		if nparams > 2 && nparams%2 == 0 {
+			return nil, parser.in, newParsingError("wrong number of args, expected key and score member pairs")
+		}
+		return parser.parseKeyArgs(code, 3, -1)
+
+	case commandZrem:
+		return parser.parseKeyArgs(code, 2, -1)
+
+	case commandZscore, commandZrank:
+		return parser.parseKeyArgs(code, 2, 2)
+
+	case commandZrange:
+		return parser.parseKeyArgs(code, 3, 4)
+
+	case commandZrangebyscore:
+		return parser.parseKeyArgs(code, 3, 7)
+
+	case commandZincrby:
+		return parser.parseKeyArgs(code, 3, 3)
+
+	case commandZcard:
+		return parser.parseKeyArgs(code, 1, 1)
+
+	case commandIncr, commandDecr:
+		return parser.parseKeyArgs(code, 1, 1)
+
+	case commandIncrby, commandDecrby, commandIncrbyfloat:
+		return parser.parseKeyArgs(code, 2, 2)
+
+	case commandTtl, commandPttl, commandPersist:
+		return parser.parseKeyArgs(code, 1, 1)
+
+	case commandExpire, commandPexpire, commandExpireat, commandPexpireat:
+		return parser.parseKeyArgs(code, 2, 2)
+
+	case commandScan:
+		return parser.parseKeyArgs(code, 1, 7)
+
+	case commandHscan, commandSscan, commandZscan:
+		return parser.parseKeyArgs(code, 2, 6)
+
+	case commandLlen:
+		return parser.parseKeyArgs(code, 1, 1)
+
+	case commandLindex:
+		return parser.parseKeyArgs(code, 2, 2)
+
+	case commandHello:
+		if nparams > 1 {
+			return nil, parser.in, newParsingError("unknow args, expected max %v given %v", 1, nparams)
+		}
+
+		version := ""
+		if nparams == 1 {
+			version = parser.getArg(1)
+		}
+
+		return newCommand(code, version, []byte{}, 0), parser.in, nil
+
+	case commandList:
+		if nparams > 1 {
+			return nil, parser.in, newParsingError("unknow args, expected max 1 given %v", nparams)
+		}
+		if nparams == 1 {
+			return newCommand(code, parser.getArg(1), []byte{}, 0), parser.in, nil
+		}
+
+		return newCommand(code, "", []byte{}, 0), parser.in, nil
+
+	case commandRmmatch:
+		return parser.parseKeyArgs(code, 1, 1)
+
+	case commandWatch, commandSubscribe, commandPsubscribe:
+		return parser.parseKeyArgs(code, 1, -1)
+
+	case commandUnsubscribe, commandPunsubscribe:
+		if nparams == 0 {
+			return newCommand(code, "", []byte{}, 0), parser.in, nil
+		}
+		return parser.parseKeyArgs(code, 1, -1)
+
+	case commandPublish:
+		return parser.parseKeyArgs(code, 2, 2)
+
+	case commandXadd:
+		return parser.parseKeyArgs(code, 3, -1)
+
+	case commandXrange:
+		return parser.parseKeyArgs(code, 3, 5)
+
+	case commandXread:
+		return parser.parseKeyArgs(code, 3, -1)
+
+	case commandXlen:
+		return parser.parseKeyArgs(code, 1, 1)
+
+	case commandXtrim:
+		return parser.parseKeyArgs(code, 3, 4)
+
+	case commandXsetid:
+		return parser.parseKeyArgs(code, 2, 2)
+
+	case commandXgroup:
+		return parser.parseKeyArgs(code, 3, 5)
+
+	case commandXreadgroup:
+		return parser.parseKeyArgs(code, 6, -1)
+
+	case commandXack:
+		return parser.parseKeyArgs(code, 3, -1)
+
+	case commandXpending:
+		return parser.parseKeyArgs(code, 2, 8)
+
+	case commandXclaim:
+		return parser.parseKeyArgs(code, 5, -1)
+
+	case commandQpush:
+		return parser.parseKeyArgs(code, 2, 8)
+
+	case commandQreserve:
+		return parser.parseKeyArgs(code, 1, 7)
+
+	case commandQack:
+		return parser.parseKeyArgs(code, 2, 2)
+
+	case commandQnack:
+		return parser.parseKeyArgs(code, 2, 4)
+
+	case commandRmall, commandStats, commandPing, commandExit, commandSync, commandRewriteAof,
+		commandMulti, commandExec, commandDiscard, commandUnwatch:
 		if nparams > 0 {
 			return nil, parser.in, newParsingError("unknow args, expcted 0 but %v was given", nparams)
 		}
@@ -201,6 +426,27 @@ func (parser *parser) parseArgs() (*command, *ioData, *parsingError) {
 	}
 }
 
+// parseKeyArgs parses commands shaped as "CODE key args...", accepting from
+// min to max params after the command name (a negative max means no limit)
+func (parser *parser) parseKeyArgs(code commandCode, min int, max int) (*command, *ioData, *parsingError) {
+	nparams := len(parser.args) - 1
+
+	if nparams < min {
+		return nil, parser.in, newParsingError("to few args, expected as least %v", min)
+	}
+	if max >= 0 && nparams > max {
+		return nil, parser.in, newParsingError("unknow args, expected max %v given %v", max, nparams)
+	}
+
+	key := parser.getArg(1)
+	args := make([][]byte, 0, nparams-1)
+	for i := 2; i <= nparams; i++ {
+		args = append(args, parser.getArgData(i))
+	}
+
+	return newArgsCommand(code, key, args), parser.in, nil
+}
+
 func (parser *parser) binStringBeforeArray() *parsingError {
 	return newParsingError("binary string before and array")
 }
@@ -0,0 +1,180 @@
+package main
+
+import "fmt"
+
+// pubsub tracks who is subscribed to each channel and channel pattern
+type pubsub struct {
+	channels map[string]map[*aetherClient]struct{}
+	patterns map[string]map[*aetherClient]struct{}
+}
+
+// Commands a client can still send once subscribed (unless on RESP3, where
+// the messages are pushed out of band and any command can be sent)
+var subscriberCommands = []commandCode{
+	commandSubscribe,
+	commandUnsubscribe,
+	commandPsubscribe,
+	commandPunsubscribe,
+	commandPing,
+	commandExit,
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*aetherClient]struct{}),
+		patterns: make(map[string]map[*aetherClient]struct{}),
+	}
+}
+
+func subscribe(subscriptions map[string]map[*aetherClient]struct{}, name string, c *aetherClient) {
+	clients, found := subscriptions[name]
+	if !found {
+		clients = make(map[*aetherClient]struct{})
+		subscriptions[name] = clients
+	}
+	clients[c] = struct{}{}
+}
+
+func unsubscribe(subscriptions map[string]map[*aetherClient]struct{}, name string, c *aetherClient) {
+	clients := subscriptions[name]
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(subscriptions, name)
+	}
+}
+
+// publish pushes the message to the subscribers of the channel and of the
+// patterns matching it, returning how many messages were sent
+func (p *pubsub) publish(channel string, message []byte) int {
+	sent := 0
+	for c := range p.channels[channel] {
+		c.enqueueReply(newPushResponse([]element{
+			newStringResponse([]byte("message")),
+			newStringResponse([]byte(channel)),
+			newStringResponse(message),
+		}))
+		sent++
+	}
+	for pattern, clients := range p.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for c := range clients {
+			c.enqueueReply(newPushResponse([]element{
+				newStringResponse([]byte("pmessage")),
+				newStringResponse([]byte(pattern)),
+				newStringResponse([]byte(channel)),
+				newStringResponse(message),
+			}))
+			sent++
+		}
+	}
+	return sent
+}
+
+// rm drops every subscription of the client (e.g. when it disconnects)
+func (p *pubsub) rm(c *aetherClient) {
+	for channel := range c.channels {
+		unsubscribe(p.channels, channel, c)
+	}
+	for pattern := range c.patterns {
+		unsubscribe(p.patterns, pattern, c)
+	}
+}
+
+func (c *aetherClient) isSubscribed() bool {
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+func (c *aetherClient) countSubscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func (command *command) isSubscriberCommand() bool {
+	for _, code := range subscriberCommands {
+		if code == command.getCode() {
+			return true
+		}
+	}
+	return false
+}
+
+// mustRefuseWhileSubscribed tells if the client is in the subscribed mode,
+// where the connection only takes the commands to manage the subscriptions
+func (c *aetherClient) mustRefuseWhileSubscribed(command *command) bool {
+	return c.isSubscribed() && c.getProtocol() != protocolResp3 && !command.isSubscriberCommand()
+}
+
+func newSubscribedModeResponse(command *command) response {
+	msg := fmt.Sprintf("Can't execute '%v': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / EXIT are allowed in this context", command.getCode())
+	return newErrorResponse(msg, false)
+}
+
+func newSubscriptionResponse(kind string, name element, count int) element {
+	return newPushResponse([]element{
+		newStringResponse([]byte(kind)),
+		name,
+		newIntegerResponse(count),
+	})
+}
+
+func runSubscribe(command *command, c *aetherClient, server *AetherServer, pattern bool) response {
+	kind, subscriptions, own := "subscribe", server.pubsub.channels, &c.channels
+	if pattern {
+		kind, subscriptions, own = "psubscribe", server.pubsub.patterns, &c.patterns
+	}
+	if *own == nil {
+		*own = make(map[string]struct{})
+	}
+
+	replies := make([]element, 0)
+	for _, name := range command.getKeys() {
+		subscribe(subscriptions, name, c)
+		(*own)[name] = struct{}{}
+		replies = append(replies, newSubscriptionResponse(kind, newStringResponse([]byte(name)), c.countSubscriptions()))
+	}
+	return newSequenceResponse(replies)
+}
+
+// runUnsubscribe drops the given subscriptions, or all of them if none is given
+func runUnsubscribe(command *command, c *aetherClient, server *AetherServer, pattern bool) response {
+	kind, subscriptions, own := "unsubscribe", server.pubsub.channels, c.channels
+	if pattern {
+		kind, subscriptions, own = "punsubscribe", server.pubsub.patterns, c.patterns
+	}
+
+	names := command.getKeys()
+	if command.key == "" {
+		names = make([]string, 0, len(own))
+		for name := range own {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		null := newNullResponse("No subscriptions")
+		return newSubscriptionResponse(kind, null, c.countSubscriptions())
+	}
+
+	replies := make([]element, 0, len(names))
+	for _, name := range names {
+		unsubscribe(subscriptions, name, c)
+		delete(own, name)
+		replies = append(replies, newSubscriptionResponse(kind, newStringResponse([]byte(name)), c.countSubscriptions()))
+	}
+	return newSequenceResponse(replies)
+}
+
+// isMessage tells if the command is a published message, which is relayed
+// to the replicas like the writes but isn't kept in the append-only log
+func (command *command) isMessage() bool {
+	return command.getCode() == commandPublish
+}
+
+// runPublish delivers the message to the subscribers of this instance and
+// sends it to the replicas, so the subscribers of the replicas get it too.
+// Within a transaction it reaches the replicas along with its writes.
+func runPublish(command *command, server *AetherServer) response {
+	sent := server.pubsub.publish(command.key, command.getArg(0))
+	server.propagate(command)
+	return newIntegerResponse(sent)
+}
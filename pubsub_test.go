@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newSubscriber returns a real client whose replies are never written, left
+// in its outbox to be checked with takeReplies
+func newSubscriber() *aetherClient {
+	conn, _ := net.Pipe()
+	server := &AetherServer{events: make(chan event, 16), protocol: protocolResp2}
+	return newClient(conn, server)
+}
+
+func takeReplies(c *aetherClient) []any {
+	replies, _ := c.outbox.take()
+	natives := make([]any, 0, len(replies))
+	for _, r := range replies {
+		natives = append(natives, r.(element).toNative())
+	}
+	return natives
+}
+
+func TestPublishToChannelsAndPatterns(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), replicas: newClientSet(), pubsub: newPubsub()}
+	exact := newSubscriber()
+	pattern := newSubscriber()
+
+	runSubscribe(newArgsCommand(commandSubscribe, "news", [][]byte{[]byte("sports")}), exact, server, false)
+	runSubscribe(newArgsCommand(commandPsubscribe, "n*", [][]byte{}), pattern, server, true)
+	assert.Equal(2, exact.countSubscriptions())
+
+	publish := newArgsCommand(commandPublish, "news", [][]byte{[]byte("hello")})
+	assert.Equal(newIntegerResponse(2), runPublish(publish, server))
+
+	replies := takeReplies(exact)
+	assert.Equal([]any{"message", "news", "hello"}, replies[len(replies)-1])
+	replies = takeReplies(pattern)
+	assert.Equal([]any{"pmessage", "n*", "news", "hello"}, replies[len(replies)-1])
+
+	runUnsubscribe(newArgsCommand(commandUnsubscribe, "news", [][]byte{}), exact, server, false)
+	server.pubsub.rm(pattern)
+	assert.Equal(newIntegerResponse(0), runPublish(publish, server))
+	assert.Equal(1, exact.countSubscriptions())
+	assert.NotContains(server.pubsub.patterns, "n*")
+}
+
+func TestSubscribedMode(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{pubsub: newPubsub()}
+	c := newSubscriber()
+	get := newCommand(commandGet, "k", []byte{}, 0)
+	ping := newCommand(commandPing, "", []byte{}, 0)
+
+	assert.False(c.mustRefuseWhileSubscribed(get))
+
+	runSubscribe(newArgsCommand(commandSubscribe, "news", [][]byte{}), c, server, false)
+	assert.True(c.mustRefuseWhileSubscribed(get))
+	assert.False(c.mustRefuseWhileSubscribed(ping))
+
+	c.setProtocol(protocolResp3)
+	assert.False(c.mustRefuseWhileSubscribed(get), "RESP3 pushes the messages out of band")
+
+	c.setProtocol(protocolResp2)
+	runUnsubscribe(newCommand(commandUnsubscribe, "", []byte{}, 0), c, server, false)
+	assert.False(c.isSubscribed())
+	assert.False(c.mustRefuseWhileSubscribed(get))
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), replicas: newClientSet(), pubsub: newPubsub(), events: make(chan event, 16)}
+	conn, peer := net.Pipe() // Nobody reads from the peer
+	defer peer.Close()
+	c := newClient(conn, server)
+	go c.write()
+	runSubscribe(newArgsCommand(commandSubscribe, "news", [][]byte{}), c, server, false)
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		publish := newArgsCommand(commandPublish, "news", [][]byte{[]byte("hello")})
+		for n := 0; n < 2*pubsubOutputLimit; n++ {
+			runPublish(publish, server)
+		}
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		assert.Fail("publishing to a subscriber not reading must not block")
+		return
+	}
+
+	assert.True(c.outbox.isClosed())
+	disconnect := <-server.events
+	assert.Equal(newCloseClientEvent(c), disconnect, "the subscriber is disconnected")
+
+	server.disconnect(c)
+	publish := newArgsCommand(commandPublish, "news", [][]byte{[]byte("hello")})
+	assert.Equal(newIntegerResponse(0), runPublish(publish, server))
+}
+
+func TestPublishWithinTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), replicas: newClientSet(), pubsub: newPubsub(), statistics: newIoStatistics()}
+	server.aof = newAppendLog(filepath.Join(t.TempDir(), "test.aof"), fsyncNo)
+	server.aof.open()
+	replica := newSubscriber()
+	server.addReplica(replica)
+	client := &aetherClient{}
+
+	runMulti(client)
+	server.queueInTransaction(client, newArgsCommand(commandPublish, "news", [][]byte{[]byte("stale")}))
+	server.queueInTransaction(client, newSetCommand("k", []byte("v"), 0))
+	runExec(client, server)
+
+	replies, _ := replica.outbox.take()
+	codes := make([]commandCode, 0)
+	for _, r := range replies {
+		codes = append(codes, r.(*broadcastCommandResponse).command.getCode())
+	}
+	assert.Equal([]commandCode{commandMulti, commandPublish, commandSet, commandExec}, codes, "the message goes along with the writes")
+
+	server.aof.close()
+	logged := make([]commandCode, 0)
+	server.aof.replay(func(c *command) {
+		logged = append(logged, c.getCode())
+	})
+	assert.Equal([]commandCode{commandSet}, logged, "messages aren't logged")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Slots of the key index visited at a time by the purges
+	purgeChunkSize = 100
+	// Max time spent purging keys on each heartbeat
+	purgeBudget = 25 * time.Millisecond
+)
+
+// keyPurge is a pattern delete (RMMATCH) in progress. It scans the keys a
+// chunk at a time, so deleting millions of keys never stalls the event loop.
+type keyPurge struct {
+	pattern string
+	cursor  int
+	started bool
+	removed int
+}
+
+func newKeyPurge(pattern string) *keyPurge {
+	return &keyPurge{pattern: pattern}
+}
+
+func (p *keyPurge) isDone() bool {
+	return p.started && p.cursor == 0
+}
+
+// step removes the matching keys of the next chunk, returning them
+func (p *keyPurge) step(hm *hashmap) []string {
+	next, keys := hm.scan(p.cursor, scanOptions{pattern: p.pattern, count: purgeChunkSize})
+	for _, key := range keys {
+		hm.rm(key)
+	}
+	p.cursor = next
+	p.started = true
+	p.removed += len(keys)
+	return keys
+}
+
+func (hm *hashmap) getKeysMatching(pattern string) []string {
+	keys := make([]string, 0)
+	for _, key := range hm.getKeys() {
+		if globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// purgeKeys moves the pattern deletes forward as long as the time budget
+// allows. Each key is replicated as a RM of its own, so the replicas remove
+// exactly the same keys no matter what gets written while the purge goes on.
+func (s *AetherServer) purgeKeys() {
+	start := time.Now()
+	for len(s.purges) > 0 && time.Since(start) < purgeBudget {
+		purge := s.purges[0]
+		for _, key := range purge.step(s.hm) {
+			s.propagate(newCommand(commandRm, key, []byte{}, 0))
+		}
+		if purge.isDone() {
+			log.WithFields(log.Fields{
+				"pattern": purge.pattern,
+				"keys":    purge.removed,
+			}).Debug("Keys purged")
+			s.purges = s.purges[1:]
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeysMatching(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	hm.set("session:1", []byte("a"), 0)
+	hm.set("session:2", []byte("b"), 0)
+	hm.set("user:1", []byte("c"), 0)
+	hm.set("session:gone", []byte("d"), nowMillis()-1000)
+
+	assert.ElementsMatch([]string{"session:1", "session:2"}, hm.getKeysMatching("session:*"))
+	assert.ElementsMatch([]string{"session:1", "user:1"}, hm.getKeysMatching("*:1"))
+	assert.Empty(hm.getKeysMatching("none:*"))
+}
+
+func TestPurgeRemovesInChunks(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	total := purgeChunkSize*3 + 10
+	for i := 0; i < total; i++ {
+		hm.set(fmt.Sprintf("session:%v", i), []byte("v"), 0)
+		hm.set(fmt.Sprintf("user:%v", i), []byte("v"), 0)
+	}
+
+	purge := newKeyPurge("session:*")
+	assert.False(purge.isDone())
+
+	steps := 0
+	for !purge.isDone() {
+		removed := purge.step(hm)
+		assert.LessOrEqual(len(removed), purgeChunkSize)
+		steps++
+	}
+
+	assert.Greater(steps, 1, "purges in more than one step")
+	assert.Equal(total, purge.removed)
+	assert.Empty(hm.getKeysMatching("session:*"))
+	assert.Len(hm.getKeys(), total, "keeps the keys not matching")
+}
+
+func TestRmmatchPurgesMatchingKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), replicas: newClientSet()}
+	server.hm.set("tmp:1", []byte("a"), 0)
+	server.hm.set("tmp:2", []byte("b"), 0)
+	server.hm.set("keep", []byte("c"), 0)
+
+	rmmatch := newArgsCommand(commandRmmatch, "tmp:*", [][]byte{})
+	assert.Same(okResponse, commandRunners[commandRmmatch](rmmatch, nil, server))
+	assert.Nil(rmmatch.getReplication(), "the removed keys are replicated instead")
+	assert.Empty(server.purges)
+	assert.Equal([]string{"keep"}, server.getKeys())
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Times a job can be reserved before it goes to the dead-letter list
+	defaultQueueMaxAttempts = 5
+	// Time a reserved job stays hidden from the other workers if not acked
+	defaultVisibilityTimeout = 30 * time.Second
+	// The jobs failing too many times are pushed to the list at "<key>:dead"
+	deadLetterSuffix = ":dead"
+)
+
+// job is an entry of a queue. It is ready to be reserved once its time comes,
+// and while reserved it is hidden until acked or its reservation times out.
+type job struct {
+	id       streamId
+	payload  []byte
+	attempts int   // Times it was reserved
+	at       int64 // Unix time in millis it gets ready, or its reservation times out if reserved
+	reserved bool
+}
+
+// jobQueue holds the jobs ready to be reserved in the order they got ready,
+// the delayed ones in the order they will, and the reserved ones in the order
+// their reservations time out
+type jobQueue struct {
+	lastId   streamId
+	jobs     map[streamId]*job
+	ready    []*job
+	delayed  []*job
+	reserved []*job
+}
+
+func newQueueItem(key string) *item {
+	return &item{
+		key:  key,
+		kind: kindQueue,
+		queue: &jobQueue{
+			jobs:     make(map[streamId]*job),
+			ready:    make([]*job, 0),
+			delayed:  make([]*job, 0),
+			reserved: make([]*job, 0),
+		},
+		creation: time.Now(),
+	}
+}
+
+// before orders the jobs by the time they get ready (or time out), then by id,
+// so the order doesn't depend on when the delayed ones are moved to ready
+func (j *job) before(other *job) bool {
+	return j.at < other.at || (j.at == other.at && j.id.less(other.id))
+}
+
+func insertJob(jobs []*job, j *job) []*job {
+	n := sort.Search(len(jobs), func(n int) bool {
+		return j.before(jobs[n])
+	})
+	jobs = append(jobs, nil)
+	copy(jobs[n+1:], jobs[n:])
+	jobs[n] = j
+	return jobs
+}
+
+func removeJob(jobs []*job, j *job) []*job {
+	for n, other := range jobs {
+		if other == j {
+			return append(jobs[:n], jobs[n+1:]...)
+		}
+	}
+	return jobs
+}
+
+// place puts the job among the ready or delayed ones, as its time says
+func (q *jobQueue) place(j *job, now int64) {
+	if j.at > now {
+		q.delayed = insertJob(q.delayed, j)
+	} else {
+		q.ready = insertJob(q.ready, j)
+	}
+}
+
+// promote moves the delayed jobs whose time came to ready, returning how many
+func (q *jobQueue) promote(now int64) int {
+	due := 0
+	for due < len(q.delayed) && q.delayed[due].at <= now {
+		q.ready = insertJob(q.ready, q.delayed[due])
+		due++
+	}
+	q.delayed = q.delayed[due:]
+	return due
+}
+
+// timedOut returns the reserved jobs whose reservation is over, in the order
+// they timed out
+func (q *jobQueue) timedOut(now int64) []*job {
+	due := 0
+	for due < len(q.reserved) && q.reserved[due].at <= now {
+		due++
+	}
+	return append([]*job(nil), q.reserved[:due]...)
+}
+
+func (q *jobQueue) unlink(j *job) {
+	if j.reserved {
+		q.reserved = removeJob(q.reserved, j)
+		j.reserved = false
+	} else {
+		q.ready = removeJob(q.ready, j)
+		q.delayed = removeJob(q.delayed, j)
+	}
+}
+
+func (q *jobQueue) sortedJobs() []*job {
+	jobs := make([]*job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].id.less(jobs[b].id)
+	})
+	return jobs
+}
+
+func (i *item) qlen() int {
+	return len(i.queue.jobs)
+}
+
+func (i *item) cloneQueue() *jobQueue {
+	c := newQueueItem(i.key).queue
+	c.lastId = i.queue.lastId
+	now := nowMillis()
+	for _, j := range i.queue.jobs {
+		copied := *j
+		c.jobs[j.id] = &copied
+		if j.reserved {
+			c.reserved = insertJob(c.reserved, &copied)
+		} else {
+			c.place(&copied, now)
+		}
+	}
+	return c
+}
+
+func (i *item) queueMemory() int64 {
+	size := int64(0)
+	for _, j := range i.queue.jobs {
+		size += entryMemory(j.payload)
+	}
+	return size
+}
+
+// genQpushCommandPieces returns the commands recreating the jobs as they are,
+// the reserved ones pushed with one attempt less and then reserved again
+func (i *item) genQpushCommandPieces() [][][]byte {
+	commands := make([][][]byte, 0, i.qlen())
+	reservations := make([][][]byte, 0)
+	for _, j := range i.queue.sortedJobs() {
+		attempts := j.attempts
+		if j.reserved {
+			attempts--
+			reservations = append(reservations, newQreserveCommand(i.getKey(), j).toPieces())
+		}
+		commands = append(commands, newQpushCommand(i.getKey(), j, attempts).toPieces())
+	}
+	return append(commands, reservations...)
+}
+
+// newQpushCommand pushes the job as it is now (see newForcedClaimCommand)
+func newQpushCommand(key string, j *job, attempts int) *command {
+	args := [][]byte{
+		j.payload,
+		[]byte("ID"),
+		[]byte(j.id.String()),
+		[]byte("PXAT"),
+		[]byte(strconv.FormatInt(j.at, 10)),
+	}
+	if attempts > 0 {
+		args = append(args, []byte("ATTEMPTS"), []byte(strconv.Itoa(attempts)))
+	}
+	return newArgsCommand(commandQpush, key, args)
+}
+
+func newQreserveCommand(key string, j *job) *command {
+	return newArgsCommand(commandQreserve, key, [][]byte{
+		[]byte("ID"),
+		[]byte(j.id.String()),
+		[]byte("PXAT"),
+		[]byte(strconv.FormatInt(j.at, 10)),
+	})
+}
+
+func (hm *hashmap) getQueue(key string) (*item, bool, bool) {
+	return hm.lookup(key, kindQueue)
+}
+
+func (hm *hashmap) qpush(i *item, j *job) {
+	i.queue.jobs[j.id] = j
+	if i.queue.lastId.less(j.id) {
+		i.queue.lastId = j.id
+	}
+	i.queue.place(j, nowMillis())
+	hm.modified(i)
+	hm.resize(i, entryMemory(j.payload))
+}
+
+// qreserve hides the job from the other workers until the deadline
+func (hm *hashmap) qreserve(i *item, j *job, deadline int64) {
+	i.queue.unlink(j)
+	j.reserved = true
+	j.attempts++
+	j.at = deadline
+	i.queue.reserved = insertJob(i.queue.reserved, j)
+	hm.modified(i)
+}
+
+// qrelease makes the reserved job ready again at the given time
+func (hm *hashmap) qrelease(i *item, j *job, at int64) {
+	i.queue.unlink(j)
+	j.at = at
+	i.queue.place(j, nowMillis())
+	hm.modified(i)
+}
+
+// qack removes the job for good, along with the queue if left empty
+func (hm *hashmap) qack(i *item, j *job) {
+	i.queue.unlink(j)
+	delete(i.queue.jobs, j.id)
+	hm.modified(i)
+	hm.resize(i, -entryMemory(j.payload))
+	hm.rmIfEmpty(i)
+}
+
+// failJob handles a failed attempt of a reserved job (nacked or timed out),
+// making it ready again at the given time. If decide is given, jobs out of
+// attempts go to the dead-letter list instead, otherwise the master already
+// decided it. It returns the writes that replicate what was done.
+func (s *AetherServer) failJob(i *item, j *job, at int64, decide bool) []*command {
+	key := i.getKey()
+	if !decide || j.attempts < s.queueMaxAttempts {
+		return s.releaseJob(i, j, at)
+	}
+
+	deadKey := key + deadLetterSuffix
+	dead, isList := s.hm.getOrCreateList(deadKey)
+	if !isList {
+		// Kept in the queue rather than lost, until the key is freed
+		log.WithFields(log.Fields{"key": key, "job": j.id.String()}).Warn("Dead-letter key is not a list, job kept")
+		return s.releaseJob(i, j, at)
+	}
+
+	s.hm.qack(i, j)
+	s.hm.rpush(dead, j.payload)
+	s.signalKeyAsReady(deadKey)
+	return []*command{
+		newArgsCommand(commandQack, key, [][]byte{[]byte(j.id.String())}),
+		newArgsCommand(commandRpush, deadKey, [][]byte{j.payload}),
+	}
+}
+
+// releaseJob makes the reserved job ready again at the given time, returning
+// the write that replicates it
+func (s *AetherServer) releaseJob(i *item, j *job, at int64) []*command {
+	s.hm.qrelease(i, j, at)
+	return []*command{newArgsCommand(commandQnack, i.getKey(), [][]byte{
+		[]byte(j.id.String()),
+		[]byte("PXAT"),
+		[]byte(strconv.FormatInt(at, 10)),
+	})}
+}
+
+// serveQueues moves the delayed jobs whose time came to ready and, on the
+// master, makes the jobs whose reservation timed out ready again (replicas
+// get that from the master, as it may send them to the dead-letter list)
+func (s *AetherServer) serveQueues() {
+	now := nowMillis()
+	for _, key := range s.hm.queueKeys.getKeys() {
+		i := s.hm.data[key]
+		if i.isTransient() && i.hasExpired() {
+			continue // Just not evicted yet
+		}
+		i.queue.promote(now)
+		if s.isAReplica() {
+			continue
+		}
+		for _, j := range i.queue.timedOut(now) {
+			s.propagateAll(s.failJob(i, j, now, true))
+		}
+	}
+}
+
+// afterSecs returns the time the (possibly fractional) secs after now, false
+// if they are negative, not a number or too many to fit
+func afterSecs(now int64, secs float64) (int64, bool) {
+	if !(secs >= 0 && secs < math.MaxInt64/1000) {
+		return 0, false
+	}
+	return addMillis(now, int64(secs*1000))
+}
+
+// parseJobDelay reads "DELAY secs" or "PXAT unix-millis" as the time the job
+// gets ready at, returning false if the option is none of them
+func parseJobDelay(option string, value string, now int64) (int64, bool, error) {
+	switch option {
+	case "DELAY":
+		secs, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, true, fmt.Errorf("invalid delay")
+		}
+		at, ok := afterSecs(now, secs)
+		if !ok {
+			return 0, true, fmt.Errorf("invalid delay")
+		}
+		return at, true, nil
+	case "PXAT":
+		at, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, true, fmt.Errorf("invalid unix time")
+		}
+		return at, true, nil
+	}
+	return 0, false, nil
+}
+
+func newJobResponse(j *job) element {
+	return newArrayResponse([]element{
+		newStringResponse([]byte(j.id.String())),
+		newStringResponse(j.payload),
+		newIntegerResponse(j.attempts),
+	})
+}
+
+// runQpush adds a job, as "key payload [DELAY secs]"
+func runQpush(command *command, client *aetherClient, server *AetherServer) response {
+	fail := func(msg string) response {
+		command.dontReplicate()
+		return newErrorResponse(msg, false)
+	}
+
+	args := command.getArgs()
+	now := nowMillis()
+	j := &job{payload: args[0], at: now}
+	var id *streamId
+
+	for n := 1; n < len(args); n += 2 {
+		if n+1 >= len(args) {
+			return fail("syntax error")
+		}
+		option, value := strings.ToUpper(string(args[n])), string(args[n+1])
+		if client != nil && option != "DELAY" {
+			return fail("syntax error")
+		}
+		at, isDelay, err := parseJobDelay(option, value, now)
+		switch {
+		case err != nil:
+			return fail(err.Error())
+		case isDelay:
+			j.at = at
+		case option == "ID":
+			parsed, err := parseStreamId(value, 0)
+			if err != nil {
+				return fail(err.Error())
+			}
+			id = &parsed
+		case option == "ATTEMPTS":
+			j.attempts, err = strconv.Atoi(value)
+			if err != nil || j.attempts < 0 {
+				return fail("invalid attempts")
+			}
+		default:
+			return fail("syntax error")
+		}
+	}
+
+	i, found, isQueue := server.hm.getQueue(command.key)
+	if found && !isQueue {
+		command.dontReplicate()
+		return wrongTypeResponse
+	}
+	if !found {
+		i = newQueueItem(command.key)
+	}
+
+	switch {
+	case id == nil:
+		generated, err := genStreamIdAfter(i.queue.lastId, uint64(now))
+		if err != nil {
+			return fail(err.Error())
+		}
+		j.id = generated
+	case !i.queue.lastId.less(*id):
+		return fail("The ID specified in QPUSH is equal or smaller than the last job of the queue")
+	default:
+		j.id = *id
+	}
+
+	if !found {
+		server.hm.put(i)
+	}
+	server.hm.qpush(i, j)
+	command.replicateAs(newQpushCommand(command.key, j, j.attempts))
+
+	return newStringResponse([]byte(j.id.String()))
+}
+
+// runQreserve reserves the next ready job, as "key [TIMEOUT secs]"
+func runQreserve(command *command, client *aetherClient, server *AetherServer) response {
+	args := command.getArgs()
+	now := nowMillis()
+	deadline := now + defaultVisibilityTimeout.Milliseconds()
+	var id *streamId
+
+	fail := func(failure response) response {
+		command.dontReplicate()
+		return failure
+	}
+
+	for n := 0; n < len(args); n += 2 {
+		if n+1 >= len(args) {
+			return fail(newErrorResponse("syntax error", false))
+		}
+		option, value := strings.ToUpper(string(args[n])), string(args[n+1])
+		if client != nil && option != "TIMEOUT" {
+			return fail(newErrorResponse("syntax error", false))
+		}
+		switch option {
+		case "TIMEOUT":
+			secs, err := strconv.ParseFloat(value, 64)
+			if err != nil || secs <= 0 {
+				return fail(newErrorResponse("timeout is not a positive number", false))
+			}
+			var ok bool
+			if deadline, ok = afterSecs(now, secs); !ok {
+				return fail(newErrorResponse("timeout is out of range", false))
+			}
+		case "PXAT":
+			at, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fail(newErrorResponse("invalid unix time", false))
+			}
+			deadline = at
+		case "ID":
+			parsed, err := parseStreamId(value, 0)
+			if err != nil {
+				return fail(newErrorResponse(err.Error(), false))
+			}
+			id = &parsed
+		default:
+			return fail(newErrorResponse("syntax error", false))
+		}
+	}
+
+	i, found, isQueue := server.hm.getQueue(command.key)
+	switch {
+	case found && !isQueue:
+		return fail(wrongTypeResponse)
+	case !found:
+		return fail(newNullArrayResponse("No jobs ready"))
+	}
+
+	// Like the expired keys, the delayed jobs are also promoted on access
+	i.queue.promote(now)
+
+	var j *job
+	if id != nil {
+		j = i.queue.jobs[*id]
+	} else if len(i.queue.ready) > 0 {
+		j = i.queue.ready[0]
+	}
+	if j == nil || j.reserved {
+		return fail(newNullArrayResponse("No jobs ready"))
+	}
+
+	server.hm.qreserve(i, j, deadline)
+	command.replicateAs(newQreserveCommand(command.key, j))
+	return newJobResponse(j)
+}
+
+// lookupJob returns the queue at the key and the job with the given id
+func (s *AetherServer) lookupJob(key string, arg []byte) (*item, *job, response) {
+	id, err := parseStreamId(string(arg), 0)
+	if err != nil {
+		return nil, nil, newErrorResponse(err.Error(), false)
+	}
+	i, found, isQueue := s.hm.getQueue(key)
+	switch {
+	case found && !isQueue:
+		return nil, nil, wrongTypeResponse
+	case !found:
+		return nil, nil, nil
+	}
+	return i, i.queue.jobs[id], nil
+}
+
+// runQack removes the job for good, once its worker is done with it
+func runQack(command *command, server *AetherServer) response {
+	i, j, failure := server.lookupJob(command.key, command.getArg(0))
+	if failure != nil {
+		command.dontReplicate()
+		return failure
+	}
+	if j == nil {
+		return newIntegerResponse(0)
+	}
+	server.hm.qack(i, j)
+	return newIntegerResponse(1)
+}
+
+// runQnack gives a reserved job back as failed, as "key id [DELAY secs]"
+func runQnack(command *command, client *aetherClient, server *AetherServer) response {
+	command.dontReplicate()
+
+	args := command.getArgs()
+	i, j, failure := server.lookupJob(command.key, args[0])
+	if failure != nil {
+		return failure
+	}
+
+	now := nowMillis()
+	at := now
+	if len(args) == 3 {
+		option := strings.ToUpper(string(args[1]))
+		if client != nil && option != "DELAY" {
+			return newErrorResponse("syntax error", false)
+		}
+		delay, isDelay, err := parseJobDelay(option, string(args[2]), now)
+		if err != nil {
+			return newErrorResponse(err.Error(), false)
+		}
+		if !isDelay {
+			return newErrorResponse("syntax error", false)
+		}
+		at = delay
+	} else if len(args) != 1 {
+		return newErrorResponse("syntax error", false)
+	}
+
+	if j == nil || !j.reserved {
+		return newIntegerResponse(0)
+	}
+
+	// Otherwise the master already decided if it goes to the dead-letter list
+	fromClient := client != nil
+	writes := server.failJob(i, j, at, fromClient)
+	if fromClient {
+		server.propagateAll(writes)
+	}
+	return newIntegerResponse(1)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newQueueServer() *AetherServer {
+	server := newStreamServer()
+	server.queueMaxAttempts = 2
+	return server
+}
+
+func TestQpushAndQreserve(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newQueueServer()
+	first := runStreamCommand(server, nil, commandQpush, "q", "a").(element).toNative()
+	second := runStreamCommand(server, nil, commandQpush, "q", "b").(element).toNative()
+	runStreamCommand(server, nil, commandQpush, "q", "later", "DELAY", "60")
+
+	reply := runStreamCommand(server, nil, commandQreserve, "q").(element).toNative()
+	assert.Equal([]any{first, "a", int64(1)}, reply)
+	reserve := newArgsCommand(commandQreserve, "q", streamArgs("TIMEOUT", "5"))
+	reply = runQreserve(reserve, nil, server).(element).toNative()
+	assert.Equal([]any{second, "b", int64(1)}, reply)
+	secondId, _ := parseStreamId(second.(string), 0)
+	job := server.hm.data["q"].queue.jobs[secondId]
+	assert.Equal(newQreserveCommand("q", job), reserve.getReplication(), "replicated as the reservation of the job")
+	assert.IsType(&nullResponse{}, runStreamCommand(server, nil, commandQreserve, "q"), "the delayed job isn't ready")
+
+	assert.Equal(newIntegerResponse(1), runStreamCommand(server, nil, commandQack, "q", first.(string)))
+	assert.Equal(newIntegerResponse(0), runStreamCommand(server, nil, commandQack, "q", first.(string)))
+	assert.Equal(2, server.hm.data["q"].qlen())
+
+	runStreamCommand(server, nil, commandSet, "str", "v")
+	assert.Same(wrongTypeResponse, runStreamCommand(server, nil, commandQpush, "str", "a"))
+	assert.IsType(&nullResponse{}, runStreamCommand(server, nil, commandQreserve, "missing"))
+}
+
+func TestQueueReplicationOptionsRefusedToClients(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newQueueServer()
+	client := &aetherClient{}
+	id := runStreamCommand(server, client, commandQpush, "q", "later", "DELAY", "60").(element).toNative().(string)
+
+	syntaxError := newErrorResponse("syntax error", false)
+	assert.Equal(syntaxError, runStreamCommand(server, client, commandQpush, "q", "a", "ID", "9-0"))
+	assert.Equal(syntaxError, runStreamCommand(server, client, commandQpush, "q", "a", "ATTEMPTS", "3"))
+	assert.Equal(syntaxError, runStreamCommand(server, client, commandQpush, "q", "a", "PXAT", "0"))
+	assert.Equal(syntaxError, runStreamCommand(server, client, commandQreserve, "q", "ID", id), "the delayed job isn't ready")
+	assert.Equal(syntaxError, runStreamCommand(server, client, commandQreserve, "q", "PXAT", "0"))
+	assert.Equal(syntaxError, runStreamCommand(server, client, commandQnack, "q", id, "PXAT", "0"))
+	assert.Equal(1, server.hm.data["q"].qlen())
+	assert.Len(server.hm.data["q"].queue.reserved, 0)
+}
+
+func TestQueueDelaysOutOfRangeRefused(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newQueueServer()
+	for _, delay := range []string{"1e300", "NaN", "-1"} {
+		assert.Equal(newErrorResponse("invalid delay", false), runStreamCommand(server, nil, commandQpush, "q", "a", "DELAY", delay), delay)
+	}
+	assert.NotContains(server.hm.data, "q")
+
+	runStreamCommand(server, nil, commandQpush, "q", "a")
+	outOfRange := runStreamCommand(server, nil, commandQreserve, "q", "TIMEOUT", "1e300")
+	assert.Equal(newErrorResponse("timeout is out of range", false), outOfRange)
+	assert.Len(server.hm.data["q"].queue.ready, 1)
+}
+
+func TestQueueDelayedJobsPromoted(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newQueueServer()
+	runStreamCommand(server, nil, commandQpush, "q", "soon", "DELAY", "60")
+	q := server.hm.data["q"].queue
+	assert.Len(q.delayed, 1)
+
+	q.delayed[0].at = nowMillis() - 1
+	server.serveQueues()
+	assert.Len(q.delayed, 0)
+	assert.Len(q.ready, 1)
+}
+
+func TestQueueTimedOutJobsRequeuedThenDeadLettered(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newQueueServer()
+	runStreamCommand(server, nil, commandQpush, "q", "flaky")
+	q := server.hm.data["q"].queue
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		reply := runStreamCommand(server, nil, commandQreserve, "q").(element).toNative().([]any)
+		assert.Equal(int64(attempt), reply[2])
+
+		q.jobs[q.lastId].at = nowMillis() - 1
+		server.beginExec()
+		server.serveQueues()
+		writes := server.execWrites
+		server.endExec()
+
+		if attempt == 1 {
+			assert.Len(writes, 1)
+			assert.Equal(commandQnack, writes[0].getCode(), "timed out jobs get ready again")
+			assert.Len(q.ready, 1)
+		} else {
+			assert.Len(writes, 2)
+			assert.Equal(commandQack, writes[0].getCode())
+			assert.Equal(commandRpush, writes[1].getCode())
+			assert.Equal("q:dead", writes[1].getKey())
+		}
+	}
+
+	assert.NotContains(server.hm.data, "q", "the queue is removed once empty")
+	dead := runStreamCommand(server, nil, commandLrange, "q:dead", "0", "-1").(element).toNative()
+	assert.Equal([]any{"flaky"}, dead)
+}
+
+func TestQueueReservationsInDeadlineOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newQueueServer()
+	for _, payload := range []string{"a", "b", "c"} {
+		runStreamCommand(server, nil, commandQpush, "q", payload)
+	}
+	runStreamCommand(server, nil, commandQreserve, "q", "TIMEOUT", "60")
+	runStreamCommand(server, nil, commandQreserve, "q", "TIMEOUT", "1")
+	runStreamCommand(server, nil, commandQreserve, "q", "TIMEOUT", "30")
+
+	q := server.hm.data["q"].queue
+	payloads := make([]string, 0)
+	for _, j := range q.reserved {
+		payloads = append(payloads, string(j.payload))
+	}
+	assert.Equal([]string{"b", "c", "a"}, payloads)
+
+	now := nowMillis()
+	assert.Len(q.timedOut(now), 0)
+	assert.Equal(q.reserved[:2], q.timedOut(now+30_000), "up to the first still reserved")
+}
+
+func TestQueueJobKeptWhenDeadLetterKeyIsNotAList(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newQueueServer()
+	runSet(newCommand(commandSet, "q:dead", []byte("v"), 0), server)
+	id := runStreamCommand(server, nil, commandQpush, "q", "job").(element).toNative().(string)
+	runStreamCommand(server, nil, commandQreserve, "q")
+	runStreamCommand(server, nil, commandQnack, "q", id)
+	runStreamCommand(server, nil, commandQreserve, "q")
+
+	client := &aetherClient{}
+	assert.Equal(newIntegerResponse(1), runStreamCommand(server, client, commandQnack, "q", id))
+	q := server.hm.data["q"].queue
+	assert.Len(q.ready, 1, "out of attempts but nowhere to go")
+	assert.Equal("v", runStreamCommand(server, nil, commandGet, "q:dead").(element).toNative())
+}
+
+func TestQnack(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newQueueServer()
+	id := runStreamCommand(server, nil, commandQpush, "q", "job").(element).toNative().(string)
+	assert.Equal(newIntegerResponse(0), runStreamCommand(server, nil, commandQnack, "q", id), "only reserved jobs can be nacked")
+
+	runStreamCommand(server, nil, commandQreserve, "q")
+	assert.Equal(newIntegerResponse(1), runStreamCommand(server, nil, commandQnack, "q", id, "DELAY", "60"))
+	q := server.hm.data["q"].queue
+	assert.Len(q.delayed, 1, "nacked with a delay")
+
+	q.delayed[0].at = nowMillis() - 1
+	runStreamCommand(server, nil, commandQreserve, "q")
+	client := &aetherClient{}
+	assert.Equal(newIntegerResponse(1), runStreamCommand(server, client, commandQnack, "q", id))
+	assert.NotContains(server.hm.data, "q", "out of attempts")
+	assert.Equal([]any{"job"}, runStreamCommand(server, nil, commandLrange, "q:dead", "0", "-1").(element).toNative())
+}
+
+func TestQueueRestored(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newQueueServer()
+	runStreamCommand(server, nil, commandQpush, "q", "a")
+	runStreamCommand(server, nil, commandQpush, "q", "b")
+	runStreamCommand(server, nil, commandQpush, "q", "c", "DELAY", "60")
+	runStreamCommand(server, nil, commandQreserve, "q")
+
+	restored := newQueueServer()
+	for _, pieces := range server.hm.data["q"].genRestoreCommands() {
+		code := commandCode(pieces[0])
+		commandRunners[code](newArgsCommand(code, string(pieces[1]), pieces[2:]), nil, restored)
+	}
+
+	original := server.hm.data["q"]
+	restoredQueue := restored.hm.data["q"]
+	assert.Equal(original.queue, restoredQueue.queue)
+	assert.Equal(original.getMemory(), restoredQueue.getMemory())
+}
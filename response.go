@@ -1,32 +1,72 @@
 package main
 
 import (
+	"bytes"
 	json2 "encoding/json"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type protocol int
+
+const (
+	// The aetherg protocol only replies with simple strings, errors and
+	// protocol strings (aggregates are sent as a JSON encoded string)
+	protocolAetherg protocol = 1
+
+	// Strict RESP2 as spoken by Redis, so redis-cli and Redis libraries work
+	protocolResp2 protocol = 2
+
+	// RESP3 adds maps, sets, doubles, booleans and push messages (negotiated
+	// per client through HELLO)
+	protocolResp3 protocol = 3
 )
 
 var okResponse = newRawBytesResponse("+OK\r\n", false)
 var pongResponse = newRawBytesResponse("+PONG\r\n", false)
 var byeResponse = newRawBytesResponse("+BYE\r\n", true)
+var queuedResponse = newRawBytesResponse("+QUEUED\r\n", false)
+var readOnlyResponse = newCodedErrorResponse("READONLY", "this instance is a read replica (read-only)", false)
+var notAnIntegerResponse = newErrorResponse("value is not an integer or out of range", false)
+var wrongTypeResponse = newCodedErrorResponse("WRONGTYPE", "Operation against a key holding the wrong kind of value", false)
 
 type response interface {
-	write(sink *sink) (*ioData, error)
+	write(sink *sink, proto protocol) (*ioData, error)
 	isFinal() bool
 }
 
+// element is a response that can also be nested inside an aggregate response
+type element interface {
+	response
+	encode(sink *sink, proto protocol)
+	toNative() any
+}
+
 type stringResponse struct {
 	data []byte
 }
 
-func (s *stringResponse) write(sink *sink) (*ioData, error) {
-	return sink.flushAsProtocolString(s.data)
+func (s *stringResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	s.encode(sink, proto)
+	return sink.flush()
+}
+
+func (s *stringResponse) encode(sink *sink, _ protocol) {
+	sink.writeAsProtocolString(s.data)
+}
+
+func (s *stringResponse) toNative() any {
+	return string(s.data)
 }
 
 func (s *stringResponse) isFinal() bool {
 	return false
 }
 
-func newStringResponse(data []byte) response {
+func newStringResponse(data []byte) element {
 	return &stringResponse{data: data}
 }
 
@@ -35,44 +75,452 @@ type rawBytesResponse struct {
 	final bool
 }
 
-func (s *rawBytesResponse) write(sink *sink) (*ioData, error) {
-	return sink.flushWrite(s.data)
+func (s *rawBytesResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	s.encode(sink, proto)
+	return sink.flush()
+}
+
+func (s *rawBytesResponse) encode(sink *sink, _ protocol) {
+	sink.write(s.data)
+}
+
+func (s *rawBytesResponse) toNative() any {
+	return strings.TrimSpace(string(s.data[1:]))
 }
 
 func (s *rawBytesResponse) isFinal() bool {
 	return s.final
 }
 
-func newRawBytesResponse(data string, final bool) response {
+func newRawBytesResponse(data string, final bool) element {
 	return &rawBytesResponse{data: []byte(data), final: final}
 }
 
-func newErrorResponse(message string, final bool) response {
-	message = "-ERR " + message + "\r\n"
+func newErrorResponse(message string, final bool) element {
+	return newCodedErrorResponse("ERR", message, final)
+}
+
+// newCodedErrorResponse creates an error reply with a Redis-like error code
+// prefix (ERR, WRONGTYPE, READONLY, etc)
+func newCodedErrorResponse(code string, message string, final bool) element {
+	message = "-" + code + " " + message + "\r\n"
 	return newRawBytesResponse(message, final)
 }
 
-func newJsonResponse(object any) response {
+type integerResponse struct {
+	value int64
+}
+
+func (r *integerResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	r.encode(sink, proto)
+	return sink.flush()
+}
+
+func (r *integerResponse) encode(sink *sink, proto protocol) {
+	if proto == protocolAetherg {
+		sink.writeAsProtocolString(bprintf("%v", r.value))
+	} else {
+		sink.writeAsRawBytes(fmt.Sprintf(":%v\r\n", r.value))
+	}
+}
+
+func (r *integerResponse) toNative() any {
+	return r.value
+}
+
+func (r *integerResponse) isFinal() bool {
+	return false
+}
+
+func newIntegerResponse(value int) element {
+	return &integerResponse{value: int64(value)}
+}
+
+// nullResponse is the absence of a value. Since the aetherg protocol has no
+// null type, it replies with an error explaining what is missing instead
+// (unless it is a nil, which isn't a failure).
+type nullResponse struct {
+	message string
+	array   bool // RESP2 has a null array besides the null string
+	nil     bool // The aetherg protocol replies "(nil)" instead of an error
+}
+
+func (r *nullResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	r.encode(sink, proto)
+	return sink.flush()
+}
+
+func (r *nullResponse) encode(sink *sink, proto protocol) {
+	switch proto {
+	case protocolAetherg:
+		if r.nil {
+			sink.writeAsRawBytes("+(nil)\r\n")
+		} else {
+			sink.writeAsRawBytes("-ERR " + r.message + "\r\n")
+		}
+	case protocolResp2:
+		if r.array {
+			sink.writeAsRawBytes("*-1\r\n")
+		} else {
+			sink.writeAsRawBytes("$-1\r\n")
+		}
+	default:
+		sink.writeAsRawBytes("_\r\n")
+	}
+}
+
+func (r *nullResponse) toNative() any {
+	return nil
+}
+
+func (r *nullResponse) isFinal() bool {
+	return false
+}
+
+func newNullResponse(message string) element {
+	return &nullResponse{message: message}
+}
+
+// newNilResponse is a null reply that isn't a failure (e.g. a write that was
+// done, or skipped on purpose, with nothing to return)
+func newNilResponse() element {
+	return &nullResponse{nil: true}
+}
+
+func newNullArrayResponse(message string) element {
+	return &nullResponse{message: message, array: true}
+}
+
+type doubleResponse struct {
+	value float64
+}
+
+func (r *doubleResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	r.encode(sink, proto)
+	return sink.flush()
+}
+
+func (r *doubleResponse) encode(sink *sink, proto protocol) {
+	value := formatDouble(r.value)
+	if proto == protocolResp3 {
+		sink.writeAsRawBytes("," + value + "\r\n")
+	} else {
+		sink.writeAsProtocolString([]byte(value))
+	}
+}
+
+func (r *doubleResponse) toNative() any {
+	return formatDouble(r.value)
+}
+
+func (r *doubleResponse) isFinal() bool {
+	return false
+}
+
+func newDoubleResponse(value float64) element {
+	return &doubleResponse{value: value}
+}
+
+func formatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	default:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+}
+
+type booleanResponse struct {
+	value bool
+}
+
+func (r *booleanResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	r.encode(sink, proto)
+	return sink.flush()
+}
+
+func (r *booleanResponse) encode(sink *sink, proto protocol) {
+	switch {
+	case proto == protocolResp3 && r.value:
+		sink.writeAsRawBytes("#t\r\n")
+	case proto == protocolResp3:
+		sink.writeAsRawBytes("#f\r\n")
+	default:
+		newIntegerResponse(r.toInt()).encode(sink, proto)
+	}
+}
+
+func (r *booleanResponse) toInt() int {
+	if r.value {
+		return 1
+	}
+	return 0
+}
+
+func (r *booleanResponse) toNative() any {
+	return r.value
+}
+
+func (r *booleanResponse) isFinal() bool {
+	return false
+}
+
+func newBooleanResponse(value bool) element {
+	return &booleanResponse{value: value}
+}
+
+// aggregateType is the RESP3 type prefix of an aggregate. On RESP2 every one
+// of them degrades to an array (maps are flattened into key/value pairs).
+type aggregateType byte
+
+const (
+	aggregateArray aggregateType = '*'
+	aggregateSet   aggregateType = '~'
+	aggregatePush  aggregateType = '>'
+)
+
+type arrayResponse struct {
+	kind     aggregateType
+	elements []element
+}
+
+func (r *arrayResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	r.encode(sink, proto)
+	return sink.flush()
+}
+
+func (r *arrayResponse) encode(sink *sink, proto protocol) {
+	kind := r.kind
+	switch proto {
+	case protocolAetherg:
+		sink.writeAsProtocolString(toJson(r.toNative()))
+		return
+	case protocolResp2:
+		kind = aggregateArray
+	}
+	sink.writeAsRawBytes(fmt.Sprintf("%c%v\r\n", kind, len(r.elements)))
+	for _, e := range r.elements {
+		e.encode(sink, proto)
+	}
+}
+
+func (r *arrayResponse) toNative() any {
+	natives := make([]any, 0, len(r.elements))
+	for _, e := range r.elements {
+		natives = append(natives, e.toNative())
+	}
+	return natives
+}
+
+func (r *arrayResponse) isFinal() bool {
+	return false
+}
+
+func newArrayResponse(elements []element) element {
+	return &arrayResponse{kind: aggregateArray, elements: elements}
+}
+
+func newSetResponse(elements []element) element {
+	return &arrayResponse{kind: aggregateSet, elements: elements}
+}
+
+func newPushResponse(elements []element) element {
+	return &arrayResponse{kind: aggregatePush, elements: elements}
+}
+
+func newStringArrayResponse(values []string) element {
+	elements := make([]element, 0, len(values))
+	for _, str := range values {
+		elements = append(elements, newStringResponse([]byte(str)))
+	}
+	return newArrayResponse(elements)
+}
+
+type mapEntry struct {
+	key   element
+	value element
+}
+
+type mapResponse struct {
+	entries []mapEntry
+}
+
+func (r *mapResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	r.encode(sink, proto)
+	return sink.flush()
+}
+
+func (r *mapResponse) encode(sink *sink, proto protocol) {
+	switch proto {
+	case protocolAetherg:
+		sink.writeAsProtocolString(toJson(r.toNative()))
+		return
+	case protocolResp2:
+		sink.writeAsRawBytes(fmt.Sprintf("*%v\r\n", len(r.entries)*2))
+	default:
+		sink.writeAsRawBytes(fmt.Sprintf("%%%v\r\n", len(r.entries)))
+	}
+	for _, entry := range r.entries {
+		entry.key.encode(sink, proto)
+		entry.value.encode(sink, proto)
+	}
+}
+
+func (r *mapResponse) put(key string, value element) {
+	r.entries = append(r.entries, mapEntry{key: newStringResponse([]byte(key)), value: value})
+}
+
+func (r *mapResponse) toNative() any {
+	natives := make(map[string]any)
+	for _, entry := range r.entries {
+		key := fmt.Sprint(entry.key.toNative())
+		natives[key] = entry.value.toNative()
+	}
+	return natives
+}
+
+func (r *mapResponse) isFinal() bool {
+	return false
+}
+
+func newMapResponse() *mapResponse {
+	return &mapResponse{entries: make([]mapEntry, 0)}
+}
+
+// newNativeResponse converts any JSON encodable object into the equivalent
+// response tree (objects become maps, with the keys in alphabetical order)
+func newNativeResponse(object any) element {
+	decoder := json2.NewDecoder(bytes.NewReader(toJson(object)))
+	decoder.UseNumber()
+
+	var native any
+	err := decoder.Decode(&native)
+	if err != nil {
+		// TODO: better error handling
+		panic(err)
+	}
+
+	return nativeToResponse(native)
+}
+
+func nativeToResponse(native any) element {
+	switch value := native.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		r := newMapResponse()
+		for _, key := range keys {
+			r.put(key, nativeToResponse(value[key]))
+		}
+		return r
+	case []any:
+		elements := make([]element, 0, len(value))
+		for _, e := range value {
+			elements = append(elements, nativeToResponse(e))
+		}
+		return newArrayResponse(elements)
+	case json2.Number:
+		if integer, err := value.Int64(); err == nil {
+			return &integerResponse{value: integer}
+		}
+		double, _ := value.Float64()
+		return newDoubleResponse(double)
+	case string:
+		return newStringResponse([]byte(value))
+	case bool:
+		return newBooleanResponse(value)
+	default:
+		return newNullResponse("null")
+	}
+}
+
+// helloResponse replies to HELLO already in the negotiated protocol, and lets
+// the client writer know every following response must use it as well
+type helloResponse struct {
+	proto protocol
+	body  element
+}
+
+func (r *helloResponse) write(sink *sink, _ protocol) (*ioData, error) {
+	return r.body.write(sink, r.proto)
+}
+
+func (r *helloResponse) isFinal() bool {
+	return false
+}
+
+func newHelloResponse(proto protocol, body element) response {
+	return &helloResponse{proto: proto, body: body}
+}
+
+// compatResponse keeps the historical aetherg reply of a command while giving
+// the Redis reply to clients speaking RESP (e.g. +OK vs the number of deletions)
+type compatResponse struct {
+	aetherg element
+	resp    element
+}
+
+func (r *compatResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	r.encode(sink, proto)
+	return sink.flush()
+}
+
+func (r *compatResponse) encode(sink *sink, proto protocol) {
+	r.pick(proto).encode(sink, proto)
+}
+
+func (r *compatResponse) pick(proto protocol) element {
+	if proto == protocolAetherg {
+		return r.aetherg
+	}
+	return r.resp
+}
+
+func (r *compatResponse) toNative() any {
+	return r.resp.toNative()
+}
+
+func (r *compatResponse) isFinal() bool {
+	return false
+}
+
+func newCompatResponse(aetherg element, resp element) element {
+	return &compatResponse{aetherg: aetherg, resp: resp}
+}
+
+func toJson(object any) []byte {
 	json, err := json2.Marshal(object)
 	if err != nil {
 		// TODO: better error handling
 		panic(err)
 	}
+	return json
+}
 
-	return newStringResponse(json)
+func newJsonResponse(object any) element {
+	return newStringResponse(toJson(object))
 }
 
 type syncResponse struct {
 	items []*item
 }
 
-func (s *syncResponse) write(sink *sink) (*ioData, error) {
-	arrayHeader := fmt.Sprintf("*%v\r\n", len(s.items))
+func (s *syncResponse) write(sink *sink, _ protocol) (*ioData, error) {
+	commands := make([][][]byte, 0, len(s.items))
+	for _, item := range s.items {
+		commands = append(commands, item.genRestoreCommands()...)
+	}
+
+	arrayHeader := fmt.Sprintf("*%v\r\n", len(commands))
 	sink.writeAsRawBytes(arrayHeader)
 	total := newIoData()
 
-	for _, item := range s.items {
-		pieces := item.genSetCommandPieces()
+	for _, pieces := range commands {
 		sink.writeArrayOfProtocolStrings(pieces...)
 		if sink.full() {
 			data, err := sink.flush()
@@ -100,7 +548,7 @@ type broadcastCommandResponse struct {
 	command *command
 }
 
-func (r *broadcastCommandResponse) write(sink *sink) (*ioData, error) {
+func (r *broadcastCommandResponse) write(sink *sink, _ protocol) (*ioData, error) {
 	pieces := r.command.toPieces()
 	return sink.flushArrayOfProtocolStrings(pieces...)
 }
@@ -112,3 +560,24 @@ func (s *broadcastCommandResponse) isFinal() bool {
 func newBroadcastCommandResponse(c *command) response {
 	return &broadcastCommandResponse{command: c}
 }
+
+// sequenceResponse is a reply made of many elements sent one after another,
+// like the confirmations of a SUBSCRIBE to many channels
+type sequenceResponse struct {
+	elements []element
+}
+
+func (r *sequenceResponse) write(sink *sink, proto protocol) (*ioData, error) {
+	for _, e := range r.elements {
+		e.encode(sink, proto)
+	}
+	return sink.flush()
+}
+
+func (r *sequenceResponse) isFinal() bool {
+	return false
+}
+
+func newSequenceResponse(elements []element) response {
+	return &sequenceResponse{elements: elements}
+}
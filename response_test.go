@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponsesOnAethergProtocol(t *testing.T) {
+	assert := assert.New(t)
+
+	replies := []response{
+		okResponse,
+		newIntegerResponse(42),
+		newNullResponse("Key \"k\" not found"),
+		newNilResponse(),
+		newStringArrayResponse([]string{"a", "b"}),
+		newCompatResponse(okResponse, newIntegerResponse(1)),
+	}
+
+	expected := "+OK\r\n" +
+		"$2\r\n42\r\n" +
+		"-ERR Key \"k\" not found\r\n" +
+		"+(nil)\r\n" +
+		"$9\r\n[\"a\",\"b\"]\r\n" +
+		"+OK\r\n"
+
+	assert.Equal(expected, writeResponses(replies, protocolAetherg))
+}
+
+func TestResponsesOnResp2Protocol(t *testing.T) {
+	assert := assert.New(t)
+
+	nested := newArrayResponse([]element{
+		newIntegerResponse(-7),
+		newNullResponse("missing"),
+		newStringArrayResponse([]string{"x"}),
+	})
+
+	replies := []response{
+		okResponse,
+		newIntegerResponse(42),
+		newNullResponse("Key \"k\" not found"),
+		nested,
+		newCompatResponse(okResponse, newIntegerResponse(1)),
+		newCodedErrorResponse("WRONGTYPE", "wrong kind of value", false),
+	}
+
+	expected := "+OK\r\n" +
+		":42\r\n" +
+		"$-1\r\n" +
+		"*3\r\n:-7\r\n$-1\r\n*1\r\n$1\r\nx\r\n" +
+		":1\r\n" +
+		"-WRONGTYPE wrong kind of value\r\n"
+
+	assert.Equal(expected, writeResponses(replies, protocolResp2))
+}
+
+func writeResponses(replies []response, proto protocol) string {
+	output := newMockOutputStream()
+	sink := newSink(output, 1024)
+	for _, r := range replies {
+		_, err := r.write(sink, proto)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return output.stringContent()
+}
+
+func TestResponsesOnResp3Protocol(t *testing.T) {
+	assert := assert.New(t)
+
+	stats := newMapResponse()
+	stats.put("keys", newIntegerResponse(2))
+	stats.put("ratio", newDoubleResponse(0.5))
+
+	replies := []response{
+		newNullResponse("missing"),
+		stats,
+		newSetResponse([]element{newStringResponse([]byte("a"))}),
+		newBooleanResponse(true),
+		newPushResponse([]element{newStringResponse([]byte("message"))}),
+	}
+
+	expected := "_\r\n" +
+		"%2\r\n$4\r\nkeys\r\n:2\r\n$5\r\nratio\r\n,0.5\r\n" +
+		"~1\r\n$1\r\na\r\n" +
+		"#t\r\n" +
+		">1\r\n$7\r\nmessage\r\n"
+
+	assert.Equal(expected, writeResponses(replies, protocolResp3))
+
+	expected = "$-1\r\n" +
+		"*4\r\n$4\r\nkeys\r\n:2\r\n$5\r\nratio\r\n$3\r\n0.5\r\n" +
+		"*1\r\n$1\r\na\r\n" +
+		":1\r\n" +
+		"*1\r\n$7\r\nmessage\r\n"
+
+	assert.Equal(expected, writeResponses(replies, protocolResp2))
+}
+
+func TestNativeResponseOfAStruct(t *testing.T) {
+	assert := assert.New(t)
+
+	stats := ioStats{In: 10, Out: 20, Reads: 1, Writes: 2}
+
+	expected := "%4\r\n" +
+		"$2\r\nin\r\n:10\r\n" +
+		"$3\r\nout\r\n:20\r\n" +
+		"$5\r\nreads\r\n:1\r\n" +
+		"$6\r\nwrites\r\n:2\r\n"
+
+	assert.Equal(expected, writeResponses([]response{newNativeResponse(stats)}, protocolResp3))
+}
+
+func TestHelloSwitchesTheProtocol(t *testing.T) {
+	assert := assert.New(t)
+
+	hello := newMapResponse()
+	hello.put("proto", newIntegerResponse(3))
+
+	reply := newHelloResponse(protocolResp3, hello)
+
+	assert.Equal("%1\r\n$5\r\nproto\r\n:3\r\n", writeResponses([]response{reply}, protocolAetherg))
+}
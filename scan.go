@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const defaultScanCount = 10
+
+type scanOptions struct {
+	pattern string   // Empty matches everything
+	count   int      // Slots visited per call (just a hint)
+	kind    itemKind // Empty is any kind
+}
+
+func parseScanOptions(args [][]byte, allowType bool) (scanOptions, error) {
+	opts := scanOptions{count: defaultScanCount}
+	for n := 0; n < len(args); n += 2 {
+		option := strings.ToUpper(string(args[n]))
+		if n+1 >= len(args) {
+			return opts, fmt.Errorf("syntax error")
+		}
+		value := string(args[n+1])
+		switch {
+		case option == "MATCH":
+			opts.pattern = value
+		case option == "COUNT":
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("value is not an integer or out of range")
+			}
+			if count < 1 {
+				return opts, fmt.Errorf("syntax error")
+			}
+			opts.count = count
+		case option == "TYPE" && allowType:
+			opts.kind = itemKind(strings.ToLower(value))
+		default:
+			return opts, fmt.Errorf("syntax error")
+		}
+	}
+	return opts, nil
+}
+
+func (opts scanOptions) matches(value string) bool {
+	return opts.pattern == "" || globMatch(opts.pattern, value)
+}
+
+func parseCursor(arg []byte) (int, error) {
+	cursor, err := strconv.Atoi(string(arg))
+	if err != nil || cursor < 0 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// scan visits the keys from the end of the key index towards its start, with
+// the same guarantees of the key index scan (see keyIndex.scan)
+func (hm *hashmap) scan(cursor int, opts scanOptions) (int, []string) {
+	keys := make([]string, 0)
+
+	next := hm.keys.scan(cursor, opts.count, func(key string) {
+		i := hm.data[key]
+		if i.isTransient() && i.hasExpired() {
+			return // Not evicted yet
+		}
+		if opts.kind != "" && !i.is(opts.kind) {
+			return
+		}
+		if opts.matches(key) {
+			keys = append(keys, key)
+		}
+	})
+
+	return next, keys
+}
+
+// scanElements returns the matching elements of a collection, visiting up to
+// COUNT of them from the cursor like the keys are scanned
+func (i *item) scanElements(cursor int, opts scanOptions) (int, [][]byte) {
+	elements := make([][]byte, 0)
+	next := i.elements.scan(cursor, opts.count, func(element string) {
+		if !opts.matches(element) {
+			return
+		}
+		switch i.kind {
+		case kindHash:
+			elements = append(elements, []byte(element), i.hash[element])
+		case kindSet:
+			elements = append(elements, []byte(element))
+		case kindSortedSet:
+			score, _ := i.zscore(element)
+			elements = append(elements, []byte(element), []byte(formatDouble(score)))
+		}
+	})
+	return next, elements
+}
+
+func newScanResponse(cursor int, elements element) element {
+	return newArrayResponse([]element{
+		newStringResponse([]byte(strconv.Itoa(cursor))),
+		elements,
+	})
+}
+
+func runScan(command *command, server *AetherServer) response {
+	cursor, err := parseCursor([]byte(command.key))
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+	opts, err := parseScanOptions(command.getArgs(), true)
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+	next, keys := server.hm.scan(cursor, opts)
+	return newScanResponse(next, newStringArrayResponse(keys))
+}
+
+// runElementsScan runs HSCAN, SSCAN and ZSCAN over the collection kind
+func runElementsScan(command *command, server *AetherServer, kind itemKind) response {
+	cursor, err := parseCursor(command.getArg(0))
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+	opts, err := parseScanOptions(command.getArgs()[1:], false)
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+	i, found, ok := server.hm.lookup(command.key, kind)
+	switch {
+	case found && !ok:
+		return wrongTypeResponse
+	case !found:
+		return newScanResponse(0, newArrayResponse([]element{}))
+	}
+	next, elements := i.scanElements(cursor, opts)
+	return newScanResponse(next, newBytesArrayResponse(elements))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	matches := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*:*:end", "a:b:end", true},
+		{"*:*:end", "a:b:ends", false},
+	}
+
+	for _, m := range matches {
+		assert.Equal(m.match, globMatch(m.pattern, m.s), "%v ~ %v", m.pattern, m.s)
+	}
+}
+
+func TestScanReturnsEveryKeyPresentForTheWholeScan(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	for n := 0; n < 1000; n++ {
+		hm.set(fmt.Sprintf("stable-%v", n), []byte("value"), 0)
+		hm.set(fmt.Sprintf("churn-%v", n), []byte("value"), 0)
+	}
+
+	seen := make(map[string]bool)
+	opts := scanOptions{count: 50}
+	cursor, next := 0, 0
+	for {
+		var keys []string
+		next, keys = hm.scan(cursor, opts)
+		for _, key := range keys {
+			seen[key] = true
+		}
+
+		// Keys come and go between the calls
+		for n := 0; n < 20; n++ {
+			hm.rm(fmt.Sprintf("churn-%v", rand.Intn(1000)))
+			hm.set(fmt.Sprintf("new-%v", rand.Intn(1000)), []byte("value"), 0)
+		}
+
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	for n := 0; n < 1000; n++ {
+		assert.True(seen[fmt.Sprintf("stable-%v", n)], "stable-%v not returned", n)
+	}
+}
+
+func TestScanOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	hm.set("user:1", []byte("value"), 0)
+	hm.set("user:2", []byte("value"), 0)
+	hm.set("order:1", []byte("value"), 0)
+	h, _ := hm.getOrCreateHash("user:3")
+	hm.hset(h, "name", []byte("jairo"))
+	hm.hset(h, "age", []byte("35"))
+
+	opts, err := parseScanOptions([][]byte{[]byte("match"), []byte("user:*"), []byte("COUNT"), []byte("100")}, true)
+	assert.Nil(err)
+	next, keys := hm.scan(0, opts)
+	assert.Equal(0, next)
+	assert.ElementsMatch([]string{"user:1", "user:2", "user:3"}, keys)
+
+	opts.kind = kindHash
+	_, keys = hm.scan(0, opts)
+	assert.Equal([]string{"user:3"}, keys)
+
+	next, keys = hm.scan(0, scanOptions{count: 3})
+	assert.Equal(1, next)
+	assert.Len(keys, 3)
+
+	next, elements := h.scanElements(0, scanOptions{pattern: "n*", count: 10})
+	assert.Equal(0, next)
+	assert.Equal([][]byte{[]byte("name"), []byte("jairo")}, elements)
+
+	_, err = parseScanOptions([][]byte{[]byte("TYPE"), []byte("hash")}, false)
+	assert.NotNil(err)
+	_, err = parseScanOptions([][]byte{[]byte("COUNT")}, true)
+	assert.NotNil(err)
+	_, err = parseScanOptions([][]byte{[]byte("COUNT"), []byte("0")}, true)
+	assert.NotNil(err)
+	_, err = parseCursor([]byte("-1"))
+	assert.NotNil(err)
+}
+
+func TestElementsScanIsIncremental(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap()}
+	z, _ := server.hm.getOrCreateSortedSet("z")
+	for n := 0; n < 25; n++ {
+		server.hm.zadd(z, "member:"+strconv.Itoa(n), float64(n))
+	}
+
+	seen := make(map[string]string)
+	cursor, calls := "0", 0
+	for {
+		args := [][]byte{[]byte(cursor), []byte("COUNT"), []byte("10")}
+		reply := runElementsScan(newArgsCommand(commandZscan, "z", args), server, kindSortedSet).(element).toNative().([]any)
+		elements := reply[1].([]any)
+		assert.LessOrEqual(len(elements), 20, "at most COUNT members a call")
+		for n := 0; n < len(elements); n += 2 {
+			seen[elements[n].(string)] = elements[n+1].(string)
+		}
+		if calls == 0 {
+			// Changes in the middle of the scan don't make it miss members
+			server.hm.zrem(z, "member:3")
+			server.hm.zadd(z, "member:25", 25)
+		}
+		calls++
+		if cursor = reply[0].(string); cursor == "0" {
+			break
+		}
+	}
+
+	assert.Equal(3, calls)
+	for n := 0; n < 25; n++ {
+		if n != 3 {
+			assert.Equal(strconv.Itoa(n), seen["member:"+strconv.Itoa(n)])
+		}
+	}
+
+	s, _ := server.hm.getOrCreateSet("s")
+	server.hm.sadd(s, "a")
+	server.hm.sadd(s, "b")
+	server.hm.srem(s, "a")
+	reply := runElementsScan(newArgsCommand(commandSscan, "s", [][]byte{[]byte("0")}), server, kindSet)
+	assert.Equal([]any{"0", []any{"b"}}, reply.(element).toNative())
+}
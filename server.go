@@ -1,51 +1,77 @@
 package main
 
 import (
+	"bufio"
 	"container/list"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 type AetherSettings struct {
-	Host          string
-	Port          int
-	Replicate     bool
-	SourceAddress string
-	Snapshot      string
+	Host           string
+	Port           int
+	Replicate      bool
+	SourceAddress  string
+	Snapshot       string
+	AppendLog      string
+	AppendFsync    fsyncPolicy
+	Protocol       protocol
+	MaxMemory      int64 // Bytes, 0 means no limit
+	EvictionPolicy evictionPolicy
+	KeyspaceEvents keyspaceEvents // 0 means no keyspace notifications
+	// Times a job can be reserved before going to the dead-letter list
+	QueueMaxAttempts int
 }
 
 type AetherServer struct {
-	host          string
-	port          int
-	hm            *hashmap
-	listener      net.Listener
-	clients       clientList
-	replicas      *clientSet
-	events        chan event
-	snapFile      string
-	snapshotting  bool
-	snapSync      sync.RWMutex
-	replicate     bool
-	sourceAddress string
-	master        *master
-	nextId        int64
-	creation      time.Time
-	statistics    *ioStatistics
-	eventCount    int
-	network       ioStats
-	disk          ioStats
+	host             string
+	port             int
+	hm               *hashmap
+	listener         net.Listener
+	clients          clientList
+	replicas         *clientSet
+	waiting          *waitingList
+	pubsub           *pubsub
+	purges           []*keyPurge
+	executing        bool       // Whether a transaction is being executed (EXEC)
+	execWrites       []*command // Writes of the transaction, propagated together
+	events           chan event
+	snapFile         string
+	snapshotting     bool
+	snapSync         sync.RWMutex
+	aof              *appendLog
+	protocol         protocol
+	maxMemory        int64
+	evictionPolicy   evictionPolicy
+	queueMaxAttempts int
+	replicate        bool
+	sourceAddress    string
+	master           *master
+	nextId           int64
+	creation         time.Time
+	statistics       *ioStatistics
+	eventCount       int
+	network          ioStats
+	disk             ioStats
 }
 
 const version = "v0.1.0-beta"
 
+// snapshotFormat is the layout version written in the snapshot header. The
+// format 1 files (headers without a format) left the transient keys out, the
+// format 2 ones have them along with their absolute deadlines.
+const snapshotFormat = 2
+
 const maxClientsAllowed = 512
 
 func (s *AetherServer) newEvent(e event) {
@@ -122,22 +148,43 @@ type serverStats struct {
 	Network     ioStats          `json:"network"`
 	Keys        int              `json:"keys"`
 	Replicas    int              `json:"replicas"`
+	Blocked     int              `json:"blocked"`
+	Expired     int              `json:"expired"`
+	Memory      int64            `json:"memory"`
+	MaxMemory   int64            `json:"maxmemory"`
+	Evicted     int              `json:"evicted"`
 	Connections []connectionInfo `json:"connections"`
 }
 
 func NewAetherServer(settings AetherSettings) *AetherServer {
-	return &AetherServer{
-		host:          settings.Host,
-		port:          settings.Port,
-		hm:            newHashmap(),
-		events:        make(chan event),
-		replicas:      newClientSet(),
-		snapFile:      absPath(settings.Snapshot),
-		replicate:     settings.Replicate,
-		sourceAddress: settings.SourceAddress,
-		nextId:        genIdSeed(),
-		statistics:    newIoStatistics(),
+	server := &AetherServer{
+		host:             settings.Host,
+		port:             settings.Port,
+		hm:               newHashmap(),
+		events:           make(chan event),
+		replicas:         newClientSet(),
+		waiting:          newWaitingList(),
+		pubsub:           newPubsub(),
+		snapFile:         absPath(settings.Snapshot),
+		replicate:        settings.Replicate,
+		sourceAddress:    settings.SourceAddress,
+		nextId:           genIdSeed(),
+		statistics:       newIoStatistics(),
+		protocol:         settings.Protocol,
+		maxMemory:        settings.MaxMemory,
+		evictionPolicy:   settings.EvictionPolicy,
+		queueMaxAttempts: settings.QueueMaxAttempts,
+	}
+
+	if settings.KeyspaceEvents != 0 {
+		server.enableKeyspaceEvents(settings.KeyspaceEvents)
+	}
+
+	if settings.AppendLog != "" && !settings.Replicate {
+		server.aof = newAppendLog(settings.AppendLog, settings.AppendFsync)
 	}
+
+	return server
 }
 
 func genIdSeed() int64 {
@@ -177,6 +224,7 @@ func (s *AetherServer) Run() {
 	} else {
 		// TODO: Before load, should clean up old temp snapshot that was left undone by ungraceful teardown
 		s.loadSnapshot()
+		s.loadAppendLog()
 	}
 	s.openServerSocket()
 	go s.listenToSignals()
@@ -206,11 +254,16 @@ func (s *AetherServer) tearDown() {
 	}
 
 	s.waitForSnapshot() // Wait if there is any
+	s.abortAppendLogRewrite()
 	if s.mustSave() {
 		log.Warn("Snapshotting before exit")
-		items := s.getItems()
+		items := s.cutSnapshot()
 		s.persist(items)
 	}
+
+	if s.hasAppendLog() {
+		s.aof.close()
+	}
 }
 
 func (s *AetherServer) add(c *aetherClient) {
@@ -245,9 +298,34 @@ func (s *AetherServer) getStats() serverStats {
 	stats.Connections = s.clients.summarizeClients()
 	stats.Keys = s.hm.count()
 	stats.Replicas = s.replicas.count()
+	stats.Blocked = s.waiting.count()
+	stats.Expired = s.hm.getExpiredCount()
+	stats.Memory = s.hm.getUsedMemory()
+	stats.MaxMemory = s.maxMemory
+	stats.Evicted = s.hm.getEvictedCount()
 	return stats
 }
 
+// getHello is the server and connection info replied to HELLO
+func (s *AetherServer) getHello(c *aetherClient) element {
+	role := "master"
+	if s.isAReplica() {
+		role = "replica"
+	}
+
+	id, _ := strconv.Atoi(c.getId())
+
+	hello := newMapResponse()
+	hello.put("server", newStringResponse([]byte("aetherg")))
+	hello.put("version", newStringResponse([]byte(version)))
+	hello.put("proto", newIntegerResponse(int(c.getProtocol())))
+	hello.put("id", newIntegerResponse(id))
+	hello.put("mode", newStringResponse([]byte("standalone")))
+	hello.put("role", newStringResponse([]byte(role)))
+	hello.put("modules", newArrayResponse([]element{}))
+	return hello
+}
+
 func (s *AetherServer) logErrorClosingSocket(err error) {
 	logError("Error closing server listening socket", err)
 }
@@ -309,15 +387,93 @@ func (s *AetherServer) broadcast(c *command) {
 	s.replicas.broadcast(c)
 }
 
+// execute runs a command sent by a client. Commands from a blocked client
+// wait until it gets unblocked, so they still run in the order they were sent.
+func (s *AetherServer) execute(client *aetherClient, command *command) {
+	if client.isBlocked() {
+		client.queue(command)
+		return
+	}
+
+	if client.mustRefuseWhileSubscribed(command) {
+		client.enqueueReply(newSubscribedModeResponse(command))
+		return
+	}
+
+	if client.inTransaction() && !command.isTransactionCommand() {
+		client.enqueueReply(s.queueInTransaction(client, command))
+		return
+	}
+
+	if s.isAReplica() && !command.canRunOnAReplica() {
+		client.enqueueReply(readOnlyResponse)
+		return
+	}
+
+	response := s.run(client, command)
+	// A nil response means the client got blocked and will be replied later
+	if response != nil {
+		client.enqueueReply(response)
+	}
+
+	s.serveBlockedClients()
+}
+
+// run runs the command and propagates what it wrote
+func (s *AetherServer) run(client *aetherClient, command *command) response {
+	if command.isWriteCommand() && command.mayTakeMemory() && !s.freeMemory() {
+		return oomResponse
+	}
+
+	runner := commandRunners[command.getCode()]
+	response := runner(command, client, s)
+	if replication := command.getReplication(); command.isWriteCommand() && replication != nil {
+		s.propagate(replication)
+	}
+	return response
+}
+
+// propagate hands an accepted write command to everyone that must know about
+// it besides the in-memory hashmap: the append-only log and the replicas.
+func (s *AetherServer) propagate(c *command) {
+	if s.isExecuting() {
+		s.execWrites = append(s.execWrites, c)
+		return
+	}
+	if !c.isMessage() {
+		s.appendToLog(c)
+	}
+	s.broadcast(c)
+}
+
+func (s *AetherServer) appendToLog(c *command) {
+	if s.hasAppendLog() {
+		data := s.aof.append(c)
+		s.accountFor(&ioEvent{device: disk, kind: output, data: *data})
+	}
+}
+
+// apply runs a command that doesn't come from a client (e.g. read from disk)
+func (s *AetherServer) apply(c *command) {
+	runner := commandRunners[c.getCode()]
+	_ = runner(c, nil, s)
+}
+
 func (s *AetherServer) disconnect(client *aetherClient) {
 	defer client.close()
+	if client.isBlocked() {
+		s.unblock(client)
+	}
+	s.pubsub.rm(client)
 	s.clients.rm(client)
 	s.replicas.rm(client)
 	client.logExit()
 }
 
 func (s *AetherServer) evictExpiredKeys() {
-	s.hm.evict()
+	if evicted := s.hm.evict(); evicted > 0 {
+		log.WithField("keys", evicted).Debug("Expired keys evicted")
+	}
 }
 
 func (s *AetherServer) loadSnapshot() {
@@ -327,13 +483,18 @@ func (s *AetherServer) loadSnapshot() {
 		return
 	}
 
-	info("Loading snapshot file", log.Fields{"snapshot": s.snapFile})
-
 	snap, err := os.Open(s.snapFile)
 	if err != nil {
 		fatalError("Error opening snapshot file", err)
 	}
 
+	format := readSnapshotFormat(snap)
+	if format > snapshotFormat {
+		fatal("Unsupported snapshot format", log.Fields{"snapshot": s.snapFile, "format": format})
+	}
+
+	info("Loading snapshot file", log.Fields{"snapshot": s.snapFile, "format": format})
+
 	src := newBufferedSource(snap, 4096)
 	parser := newParser(src)
 
@@ -341,9 +502,9 @@ func (s *AetherServer) loadSnapshot() {
 		command, _, err := parser.next()
 		switch {
 		case err == nil:
-			switch command.getCode() {
-			case commandSet:
-				s.hm.set(command.getKey(), command.getValue(), command.getExpiration())
+			switch {
+			case command.isWriteCommand():
+				s.apply(command)
 			default:
 				fatal("Invalid command in snapshot file", log.Fields{"code": command.getCode()})
 			}
@@ -357,6 +518,177 @@ func (s *AetherServer) loadSnapshot() {
 	}
 }
 
+// readSnapshotFormat reads the format from the snapshot header, rewinding the
+// file back to its start
+func readSnapshotFormat(snap *os.File) int {
+	defer func() {
+		if _, err := snap.Seek(0, io.SeekStart); err != nil {
+			fatalError("Error rewinding snapshot file", err)
+		}
+	}()
+
+	header, _ := bufio.NewReader(snap).ReadString('\n')
+	fields := strings.Fields(header)
+	for i, field := range fields {
+		if field == "format" && i+1 < len(fields) {
+			format, err := strconv.Atoi(fields[i+1])
+			if err == nil {
+				return format
+			}
+		}
+	}
+
+	return 1 // Headers had no format before the format 2
+}
+
+func (s *AetherServer) hasAppendLog() bool {
+	return s.aof != nil
+}
+
+func (s *AetherServer) loadAppendLog() {
+	if !s.hasAppendLog() {
+		return
+	}
+
+	count := s.aof.replay(s.apply)
+
+	if count > 0 {
+		// Consolidate the replayed commands into a new snapshot, so the log
+		// can start over empty (and a truncated tail is never appended to).
+		// The snapshot must hold every key, the ones with an expiration too,
+		// or they would be lost along with the log.
+		info("Consolidating append-only log into snapshot", log.Fields{"commands": count})
+		items := s.getItems()
+		s.replaceAppendLog(items)
+		s.persist(items)
+		truncateFile(s.aof.path)
+	}
+
+	s.hm.washClean()
+	s.aof.open()
+}
+
+func (s *AetherServer) tickAppendLog() {
+	if s.hasAppendLog() {
+		s.aof.tick()
+	}
+}
+
+func (s *AetherServer) isRewritingAppendLog() bool {
+	return s.hasAppendLog() && s.aof.isRewriting()
+}
+
+func (s *AetherServer) mustRewriteAppendLog() bool {
+	return s.hasAppendLog() && s.aof.mustRewrite() && !s.isSnapshotting()
+}
+
+// startAppendLogRewrite compacts the append-only log in background. The new
+// log resets the hashmap and then sets every item, so it is equivalent to all
+// the writes done since the last snapshot.
+func (s *AetherServer) startAppendLogRewrite() {
+	items := s.getItems()
+
+	tmp, err := s.aof.genTempFile()
+	if err != nil {
+		fatalError("Error opening temp append-only log file", err)
+	}
+	s.aof.startRewrite(tmp.Name())
+
+	info("Rewriting append-only log", log.Fields{"tmp": tmp.Name(), "size": s.aof.size})
+
+	go s.rewriteAppendLog(items, tmp)
+}
+
+func (s *AetherServer) rewriteAppendLog(items []*item, tmp *os.File) {
+	start := time.Now()
+	writeRewrittenLog(items, tmp, func(data *ioData) {
+		go s.newEvent(newDiskWriteEvent(data))
+	})
+	info("Append-only log written", log.Fields{"tmp": tmp.Name(), "duration": time.Since(start)})
+
+	s.aof.markRewritten()
+	s.newEvent(newAppendLogRewrittenEvent(tmp.Name()))
+}
+
+// writeRewrittenLog writes a log that resets the hashmap and then sets every
+// item, handing each chunk written to the given function
+func writeRewrittenLog(items []*item, tmp *os.File, written func(*ioData)) {
+	sink := newSink(tmp, 4096)
+
+	reset := newCommand(commandRmall, "", []byte{}, 0)
+	sink.writeArrayOfProtocolStrings(reset.toPieces()...)
+
+	for _, item := range items {
+		for _, pieces := range item.genRestoreCommands() {
+			sink.writeArrayOfProtocolStrings(pieces...)
+		}
+		if sink.full() {
+			data, err := sink.flush()
+			written(data)
+			if err != nil {
+				fatalError("Error writing to temp append-only log", err)
+			}
+		}
+	}
+
+	data, err := sink.flush()
+	written(data)
+	if err != nil {
+		fatalError("Error writing to temp append-only log", err)
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		fatalError("Error syncing temp append-only log", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		fatalError("Error closing temp append-only log", err)
+	}
+}
+
+// replaceAppendLog puts a rewritten log in place of the replayed ones before
+// they are consolidated into a snapshot. Since it resets the hashmap first,
+// replaying it on top of the snapshot is harmless if the process dies before
+// the log is cleared, where the writes it replaced would be applied twice.
+func (s *AetherServer) replaceAppendLog(items []*item) {
+	tmp, err := s.aof.genTempFile()
+	if err != nil {
+		fatalError("Error opening temp append-only log file", err)
+	}
+	writeRewrittenLog(items, tmp, func(*ioData) {})
+	s.aof.replaceWith(tmp.Name())
+}
+
+// abortAppendLogRewrite drops the rewrite running in background, if any, once
+// it is done writing. On exit the last snapshot makes the new log pointless.
+func (s *AetherServer) abortAppendLogRewrite() {
+	if !s.isRewritingAppendLog() {
+		return
+	}
+	log.Warn("Aborting append-only log rewrite")
+	s.aof.abortRewrite()
+}
+
+func (s *AetherServer) finishAppendLogRewrite(tmp string) {
+	data := s.aof.finishRewrite(tmp)
+	s.accountFor(&ioEvent{device: disk, kind: output, data: *data})
+	info("Append-only log rewrite is done", log.Fields{"size": s.aof.size})
+}
+
+// cutSnapshot captures the items to be persisted and, since from now on the
+// snapshot will account for every write done so far, rotates the append-only log
+func (s *AetherServer) cutSnapshot() []*item {
+	items := s.getItems()
+	s.washClean()
+	s.setSnapshotting(true)
+	if s.hasAppendLog() {
+		s.aof.rotate()
+	}
+	return items
+}
+
 func (s *AetherServer) dirty() bool {
 	return s.hm.isDirty()
 }
@@ -381,15 +713,16 @@ func (s *AetherServer) persist(items []*item) {
 
 	sink := newSink(snap, 4096)
 
-	header := fmt.Sprintf("# aetherg %v snapshot %v\n", version, time.Now())
+	header := fmt.Sprintf("# aetherg %v snapshot format %v %v\n", version, snapshotFormat, time.Now())
 	sink.writeAsRawBytes(header)
 
 	for _, item := range items {
-		if item.isTransient() {
-			continue // Transient items must not be persisted
+		if item.isTransient() && item.hasExpired() {
+			continue // No point in persisting what is already gone
+		}
+		for _, pieces := range item.genRestoreCommands() {
+			sink.writeArrayOfProtocolStrings(pieces...)
 		}
-		pieces := item.genSetCommandPieces()
-		sink.writeArrayOfProtocolStrings(pieces...)
 		if sink.full() {
 			data, err := sink.flush()
 			write := newDiskWriteEvent(data)
@@ -412,6 +745,10 @@ func (s *AetherServer) persist(items []*item) {
 		fatalError("Error replacing snapshot with the new one", err)
 	}
 
+	if s.hasAppendLog() {
+		s.aof.dropPrevious()
+	}
+
 	logger.WithField("duration", time.Since(start)).Info("Snapshot is done")
 }
 
@@ -441,7 +778,7 @@ func (s *AetherServer) genTempSnapshot() (*os.File, error) {
 }
 
 func (s *AetherServer) mustSave() bool {
-	return !s.isAReplica() && s.dirty() && !s.isSnapshotting()
+	return !s.isAReplica() && s.dirty() && !s.isSnapshotting() && !s.isRewritingAppendLog()
 }
 
 func (s *AetherServer) waitForSnapshot() {
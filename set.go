@@ -0,0 +1,216 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+func newSetItem(key string) *item {
+	return &item{
+		key:      key,
+		kind:     kindSet,
+		members:  make(map[string]struct{}),
+		elements: newKeyIndex(),
+		creation: time.Now(),
+	}
+}
+
+// sadd adds the member returning true if it wasn't there yet
+func (i *item) sadd(member string) bool {
+	_, found := i.members[member]
+	i.members[member] = struct{}{}
+	i.elements.add(member)
+	return !found
+}
+
+func (i *item) srem(member string) bool {
+	_, found := i.members[member]
+	delete(i.members, member)
+	i.elements.rm(member)
+	return found
+}
+
+func (i *item) sismember(member string) bool {
+	_, found := i.members[member]
+	return found
+}
+
+func (i *item) scard() int {
+	return len(i.members)
+}
+
+// smembers returns the members in alphabetical order
+func (i *item) smembers() []string {
+	members := make([]string, 0, len(i.members))
+	for member := range i.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (i *item) cloneMembers() map[string]struct{} {
+	members := make(map[string]struct{}, len(i.members))
+	for member := range i.members {
+		members[member] = struct{}{}
+	}
+	return members
+}
+
+func (i *item) genSaddCommandPieces() [][]byte {
+	pieces := [][]byte{
+		[]byte(commandSadd),
+		[]byte(i.getKey()),
+	}
+
+	for _, member := range i.smembers() {
+		pieces = append(pieces, []byte(member))
+	}
+
+	return pieces
+}
+
+func (hm *hashmap) getSet(key string) (*item, bool, bool) {
+	return hm.lookup(key, kindSet)
+}
+
+func (hm *hashmap) getOrCreateSet(key string) (*item, bool) {
+	return hm.lookupOrCreate(key, kindSet, newSetItem)
+}
+
+func (hm *hashmap) sadd(i *item, member string) bool {
+	hm.modified(i)
+	added := i.sadd(member)
+	if added {
+		hm.resize(i, entryMemory([]byte(member)))
+	}
+	return added
+}
+
+func (hm *hashmap) srem(i *item, member string) bool {
+	removed := i.srem(member)
+	if removed {
+		hm.modified(i)
+		hm.resize(i, -entryMemory([]byte(member)))
+	}
+	hm.rmIfEmpty(i)
+	return removed
+}
+
+type setOperation string
+
+const (
+	setInter setOperation = "INTER"
+	setUnion setOperation = "UNION"
+	setDiff  setOperation = "DIFF"
+)
+
+// combine runs the set operation over the sets stored at the keys (missing
+// keys are empty sets). It fails if any of the keys holds something else.
+func (hm *hashmap) combine(op setOperation, keys []string) (map[string]struct{}, bool) {
+	sets := make([]map[string]struct{}, 0, len(keys))
+	for _, key := range keys {
+		i, found, isSet := hm.getSet(key)
+		switch {
+		case found && !isSet:
+			return nil, false
+		case found:
+			sets = append(sets, i.members)
+		default:
+			sets = append(sets, map[string]struct{}{})
+		}
+	}
+
+	result := make(map[string]struct{})
+
+	switch op {
+	case setUnion:
+		for _, set := range sets {
+			for member := range set {
+				result[member] = struct{}{}
+			}
+		}
+	case setInter:
+		for member := range sets[0] {
+			if inAll(member, sets[1:]) {
+				result[member] = struct{}{}
+			}
+		}
+	case setDiff:
+		for member := range sets[0] {
+			if !inAny(member, sets[1:]) {
+				result[member] = struct{}{}
+			}
+		}
+	}
+
+	return result, true
+}
+
+func inAll(member string, sets []map[string]struct{}) bool {
+	for _, set := range sets {
+		if _, found := set[member]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+func inAny(member string, sets []map[string]struct{}) bool {
+	for _, set := range sets {
+		if _, found := set[member]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// store replaces whatever is at the key with the set of members (an empty set
+// just deletes the key), notifying the event of the command storing them
+func (hm *hashmap) store(key string, members map[string]struct{}, event string) {
+	if len(members) == 0 {
+		hm.rm(key)
+		return
+	}
+	hm.remove(key)
+	i := newSetItem(key)
+	for member := range members {
+		i.sadd(member)
+	}
+	hm.put(i)
+	hm.notifyEvent(notifySet, event, key)
+}
+
+func newMembersResponse(members map[string]struct{}) element {
+	sorted := make([]string, 0, len(members))
+	for member := range members {
+		sorted = append(sorted, member)
+	}
+	sort.Strings(sorted)
+
+	elements := make([]element, 0, len(sorted))
+	for _, member := range sorted {
+		elements = append(elements, newStringResponse([]byte(member)))
+	}
+	return newSetResponse(elements)
+}
+
+func runSetOperation(command *command, server *AetherServer, op setOperation) response {
+	keys := append([]string{command.key}, bytesToStrings(command.getArgs())...)
+	members, ok := server.hm.combine(op, keys)
+	if !ok {
+		return wrongTypeResponse
+	}
+	return newMembersResponse(members)
+}
+
+func runSetOperationStore(command *command, server *AetherServer, op setOperation) response {
+	keys := bytesToStrings(command.getArgs())
+	members, ok := server.hm.combine(op, keys)
+	if !ok {
+		return wrongTypeResponse
+	}
+	server.hm.store(command.key, members, strings.ToLower(string(command.getCode())))
+	return newIntegerResponse(len(members))
+}
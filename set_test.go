@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetAlgebra(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	sadd := func(key string, members ...string) {
+		s, _ := hm.getOrCreateSet(key)
+		for _, member := range members {
+			hm.sadd(s, member)
+		}
+	}
+
+	sadd("a", "1", "2", "3", "4")
+	sadd("b", "3", "4", "5")
+	sadd("c", "4", "6")
+
+	members, ok := hm.combine(setInter, []string{"a", "b", "c"})
+	assert.True(ok)
+	assert.Equal(map[string]struct{}{"4": {}}, members)
+
+	members, _ = hm.combine(setUnion, []string{"a", "c", "missing"})
+	assert.Len(members, 5)
+
+	members, _ = hm.combine(setDiff, []string{"a", "b"})
+	assert.Equal(map[string]struct{}{"1": {}, "2": {}}, members)
+
+	members, _ = hm.combine(setInter, []string{"a", "missing"})
+	assert.Empty(members)
+
+	hm.set("str", []byte("value"), 0)
+	_, ok = hm.combine(setUnion, []string{"a", "str"})
+	assert.False(ok, "only sets can be combined")
+
+	hm.store("dest", map[string]struct{}{"x": {}, "y": {}}, "sunionstore")
+	dest, found, isSet := hm.getSet("dest")
+	assert.True(found)
+	assert.True(isSet)
+	assert.Equal([]string{"x", "y"}, dest.smembers())
+
+	hm.store("str", map[string]struct{}{"z": {}}, "sunionstore")
+	_, _, isSet = hm.getSet("str")
+	assert.True(isSet, "storing must replace any kind of value")
+
+	hm.store("dest", map[string]struct{}{}, "sunionstore")
+	_, found = hm.get("dest")
+	assert.False(found, "storing an empty set removes the key")
+}
+
+func TestSetMembers(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	s, isSet := hm.getOrCreateSet("tags")
+	assert.True(isSet)
+
+	assert.True(hm.sadd(s, "go"))
+	assert.True(hm.sadd(s, "redis"))
+	assert.False(hm.sadd(s, "go"))
+	assert.Equal(2, s.scard())
+	assert.True(s.sismember("redis"))
+
+	assert.Equal([][][]byte{{
+		[]byte("SADD"), []byte("tags"), []byte("go"), []byte("redis"),
+	}}, s.genRestoreCommands())
+
+	c := s.clone()
+	hm.sadd(s, "extra")
+	assert.Equal(2, c.scard(), "clones must not share the members")
+
+	assert.True(hm.srem(s, "go"))
+	assert.False(hm.srem(s, "go"))
+	hm.srem(s, "redis")
+	hm.srem(s, "extra")
+	_, found := hm.get("tags")
+	assert.False(found, "empty sets must be removed")
+}
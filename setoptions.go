@@ -0,0 +1,63 @@
+package main
+
+import "bytes"
+
+// Options of SET, kept in the args of the command
+const (
+	setNx      = "NX"      // Only set the key if it doesn't exist
+	setXx      = "XX"      // Only set the key if it already exists
+	setGet     = "GET"     // Reply the previous value instead of OK
+	setKeepTtl = "KEEPTTL" // Keep the expiration of the previous value
+)
+
+func hasSetOption(options [][]byte, option string) bool {
+	for _, o := range options {
+		if bytes.Equal(o, []byte(option)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (command *command) hasSetOption(option string) bool {
+	return hasSetOption(command.args, option)
+}
+
+// runSet sets the string value of the key, as long as the NX/XX conditions
+// hold. A conditional SET is replicated as a plain one with the resulting
+// expiration, so only the writes that actually happened reach the replicas.
+func runSet(command *command, server *AetherServer) response {
+	i, found := server.hm.get(command.key)
+	if command.hasSetOption(setGet) && found && !i.is(kindString) {
+		command.dontReplicate()
+		return wrongTypeResponse
+	}
+
+	var previous response = okResponse
+	if command.hasSetOption(setGet) {
+		if found {
+			previous = newStringResponse(i.getValue())
+		} else {
+			previous = newNilResponse() // Not an error, the key is set anyway
+		}
+	}
+
+	if (command.hasSetOption(setNx) && found) || (command.hasSetOption(setXx) && !found) {
+		command.dontReplicate()
+		if command.hasSetOption(setGet) {
+			return previous
+		}
+		return newNilResponse()
+	}
+
+	deadline := command.resolveDeadline()
+	if command.hasSetOption(setKeepTtl) && found {
+		deadline = i.getDeadline()
+	}
+
+	server.hm.set(command.key, command.value, deadline)
+	if len(command.args) > 0 {
+		command.replicateAs(newSetCommand(command.key, command.value, deadline))
+	}
+	return previous
+}
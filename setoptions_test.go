@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseSet(line string) (*command, *parsingError) {
+	parser := newParser(newBufferedSource(strings.NewReader(line+"\n"), 64))
+	command, _, err := parser.next()
+	return command, err
+}
+
+func TestParseSetOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	command, err := parseSet("SET k v nx EX 10 GET")
+	assert.Nil(err)
+	assert.Equal(10, command.getExpiration())
+	assert.True(command.hasSetOption(setNx))
+	assert.True(command.hasSetOption(setGet))
+	assert.False(command.hasSetOption(setXx))
+
+	for _, invalid := range []string{
+		"SET k v NX XX",
+		"SET k v KEEPTTL PX 100",
+		"SET k v EX 10 PX 100",
+		"SET k v GET GET",
+		"SET k v EX",
+		"SET k v FOO",
+		"SET k v EX 9223372036854775",
+		"SET k v PX 9223372036854775807",
+		"SET k v EXAT 9223372036854775807",
+	} {
+		_, err := parseSet(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func TestConditionalSet(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap()}
+
+	xx, _ := parseSet("SET k v1 XX")
+	assert.Equal(newNilResponse(), runSet(xx, server), "a nil, not an error")
+	assert.Nil(xx.getReplication(), "nothing written, nothing replicated")
+	assert.NotContains(server.hm.data, "k")
+
+	nx, _ := parseSet("SET k v1 NX GET")
+	assert.Equal(newNilResponse(), runSet(nx, server), "set, with no previous value")
+	assert.Equal(newSetCommand("k", []byte("v1"), 0), nx.getReplication())
+	assert.Equal([]byte("v1"), server.hm.data["k"].getValue())
+
+	nx, _ = parseSet("SET k v2 NX GET")
+	assert.Equal(newStringResponse([]byte("v1")), runSet(nx, server))
+	assert.Nil(nx.getReplication())
+	assert.Equal([]byte("v1"), server.hm.data["k"].getValue())
+
+	deadline := nowMillis() + 60000
+	server.hm.set("k", []byte("v1"), deadline)
+	keep, _ := parseSet("SET k v3 XX KEEPTTL")
+	assert.Same(okResponse, runSet(keep, server))
+	assert.Equal(newSetCommand("k", []byte("v3"), deadline), keep.getReplication())
+	assert.Equal(deadline, server.hm.data["k"].getDeadline())
+
+	plain, _ := parseSet("SET k v4")
+	assert.Same(okResponse, runSet(plain, server))
+	assert.Same(plain, plain.getReplication())
+	assert.Equal(int64(0), server.hm.data["k"].getDeadline(), "a plain SET drops the expiration")
+
+	server.hm.lookupOrCreate("list", kindList, newListItem)
+	get, _ := parseSet("SET list v GET")
+	assert.Same(wrongTypeResponse, runSet(get, server))
+	assert.True(server.hm.data["list"].is(kindList))
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamId identifies a stream entry as the unix time in millis it was added
+// plus a sequence number for the entries added in the same milli
+type streamId struct {
+	ms  uint64
+	seq uint64
+}
+
+var maxStreamId = streamId{ms: math.MaxUint64, seq: math.MaxUint64}
+
+// parseStreamId reads ids like "1700000000000-1", or just "1700000000000"
+// in which case the sequence is the given one (0 or the max, for ranges)
+func parseStreamId(id string, seq uint64) (streamId, error) {
+	msPart, seqPart, hasSeq := strings.Cut(id, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamId{}, fmt.Errorf("Invalid stream ID specified as stream command argument")
+	}
+	if hasSeq {
+		seq, err = strconv.ParseUint(seqPart, 10, 64)
+		if err != nil {
+			return streamId{}, fmt.Errorf("Invalid stream ID specified as stream command argument")
+		}
+	}
+	return streamId{ms: ms, seq: seq}, nil
+}
+
+func (id streamId) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamId) less(other streamId) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+func (id streamId) isZero() bool {
+	return id.ms == 0 && id.seq == 0
+}
+
+// next returns the smallest id after this one, false if there is none
+func (id streamId) next() (streamId, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamId{ms: id.ms, seq: id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamId{ms: id.ms + 1}, true
+	default:
+		return id, false
+	}
+}
+
+// prev returns the greatest id before this one, false if there is none
+func (id streamId) prev() (streamId, bool) {
+	switch {
+	case id.seq > 0:
+		return streamId{ms: id.ms, seq: id.seq - 1}, true
+	case id.ms > 0:
+		return streamId{ms: id.ms - 1, seq: math.MaxUint64}, true
+	default:
+		return id, false
+	}
+}
+
+type streamEntry struct {
+	id     streamId
+	fields [][]byte // Field value pairs
+}
+
+// stream is an append-only log of entries ordered by id. The last id is kept
+// apart, so the ids keep growing even after the entries are trimmed.
+type stream struct {
+	entries []streamEntry
+	lastId  streamId
+	groups  map[string]*consumerGroup
+}
+
+func newStreamItem(key string) *item {
+	return &item{
+		key:      key,
+		kind:     kindStream,
+		stream:   &stream{entries: make([]streamEntry, 0), groups: make(map[string]*consumerGroup)},
+		creation: time.Now(),
+	}
+}
+
+// nextId generates the id of an entry added now
+func (s *stream) nextId(now uint64) (streamId, error) {
+	return genStreamIdAfter(s.lastId, now)
+}
+
+// genStreamIdAfter generates an id for now greater than the last one. If the
+// clock went back, the id is given the time of the last one, so the ids never
+// go back. It fails once the last one is the greatest possible id.
+func genStreamIdAfter(last streamId, now uint64) (streamId, error) {
+	if now > last.ms {
+		return streamId{ms: now}, nil
+	}
+	id, ok := last.next()
+	if !ok {
+		return id, fmt.Errorf("The stream has exhausted the last possible ID, unable to add more items")
+	}
+	return id, nil
+}
+
+// search returns the position of the first entry with an id not less than the given one
+func (s *stream) search(id streamId) int {
+	return sort.Search(len(s.entries), func(n int) bool {
+		return !s.entries[n].id.less(id)
+	})
+}
+
+func (i *item) xadd(id streamId, fields [][]byte) {
+	i.stream.entries = append(i.stream.entries, streamEntry{id: id, fields: fields})
+	i.stream.lastId = id
+}
+
+func (i *item) xlen() int {
+	return len(i.stream.entries)
+}
+
+func (i *item) getLastStreamId() streamId {
+	return i.stream.lastId
+}
+
+// xrange returns the entries with ids between start and end, inclusive, up
+// to count of them (negative is no limit)
+func (i *item) xrange(start streamId, end streamId, count int) []streamEntry {
+	entries := make([]streamEntry, 0)
+	for n := i.stream.search(start); n < i.xlen() && count != 0; n++ {
+		entry := i.stream.entries[n]
+		if end.less(entry.id) {
+			break
+		}
+		entries = append(entries, entry)
+		count--
+	}
+	return entries
+}
+
+// xreadAfter returns up to count entries with ids greater than the given one
+func (i *item) xreadAfter(id streamId, count int) []streamEntry {
+	start, ok := id.next()
+	if !ok {
+		return []streamEntry{}
+	}
+	return i.xrange(start, maxStreamId, count)
+}
+
+// xtrim drops the first count entries, returning them
+func (i *item) xtrim(count int) []streamEntry {
+	trimmed := i.stream.entries[:count]
+	i.stream.entries = append([]streamEntry{}, i.stream.entries[count:]...)
+	return trimmed
+}
+
+func (i *item) cloneStream() *stream {
+	return &stream{
+		entries: append([]streamEntry{}, i.stream.entries...),
+		lastId:  i.stream.lastId,
+		groups:  i.cloneGroups(),
+	}
+}
+
+func (i *item) genXaddCommandPieces() [][][]byte {
+	if i.xlen() == 0 {
+		// An entry trimmed right away creates the stream empty, then it gets
+		// its last id back (0-0 if it never had entries, refused by XADD)
+		return [][][]byte{{
+			[]byte(commandXadd),
+			[]byte(i.getKey()),
+			[]byte("MAXLEN"),
+			[]byte("0"),
+			[]byte(streamId{seq: 1}.String()),
+			{},
+			{},
+		}, {
+			[]byte(commandXsetid),
+			[]byte(i.getKey()),
+			[]byte(i.stream.lastId.String()),
+		}}
+	}
+
+	commands := make([][][]byte, 0, i.xlen())
+	for _, entry := range i.stream.entries {
+		pieces := [][]byte{
+			[]byte(commandXadd),
+			[]byte(i.getKey()),
+			[]byte(entry.id.String()),
+		}
+		commands = append(commands, append(pieces, entry.fields...))
+	}
+	return commands
+}
+
+func entriesMemory(entries []streamEntry) int64 {
+	size := int64(0)
+	for _, entry := range entries {
+		size += entryMemory(entry.fields...)
+	}
+	return size
+}
+
+func (hm *hashmap) getStream(key string) (*item, bool, bool) {
+	return hm.lookup(key, kindStream)
+}
+
+func (hm *hashmap) xadd(i *item, id streamId, fields [][]byte) {
+	hm.modified(i)
+	hm.resize(i, entryMemory(fields...))
+	i.xadd(id, fields)
+}
+
+// xtrim trims the stream as the trimming strategy says, returning how many
+// entries were removed
+func (hm *hashmap) xtrim(i *item, trim streamTrim) int {
+	count := trim.count(i)
+	if count == 0 {
+		return 0
+	}
+	trimmed := i.xtrim(count)
+	hm.modified(i)
+	hm.resize(i, -entriesMemory(trimmed))
+	return count
+}
+
+// xsetid sets the last id of the stream, the one the new ids must be after
+func (hm *hashmap) xsetid(i *item, id streamId) {
+	i.stream.lastId = id
+	hm.modified(i)
+}
+
+// streamTrim is the MAXLEN or MINID option of XADD and XTRIM
+type streamTrim struct {
+	strategy string
+	maxLen   int
+	minId    streamId
+}
+
+// parseStreamTrim reads "MAXLEN|MINID [=|~] threshold" from the args, returning
+// how many args were read. The approximate trimming (~) is done exactly.
+func parseStreamTrim(args [][]byte) (streamTrim, int, error) {
+	trim := streamTrim{strategy: strings.ToUpper(string(args[0]))}
+	read := 1
+	if len(args) > read && (string(args[read]) == "=" || string(args[read]) == "~") {
+		read++
+	}
+	if len(args) <= read {
+		return trim, 0, fmt.Errorf("syntax error")
+	}
+
+	threshold := string(args[read])
+	read++
+	var err error
+	switch trim.strategy {
+	case "MAXLEN":
+		trim.maxLen, err = strconv.Atoi(threshold)
+		if err != nil || trim.maxLen < 0 {
+			return trim, 0, fmt.Errorf("The MAXLEN argument must be >= 0")
+		}
+	case "MINID":
+		trim.minId, err = parseStreamId(threshold, 0)
+		if err != nil {
+			return trim, 0, err
+		}
+	default:
+		return trim, 0, fmt.Errorf("syntax error")
+	}
+	return trim, read, nil
+}
+
+func isStreamTrim(arg []byte) bool {
+	option := strings.ToUpper(string(arg))
+	return option == "MAXLEN" || option == "MINID"
+}
+
+// count returns how many of the first entries must be trimmed
+func (t streamTrim) count(i *item) int {
+	if t.strategy == "MAXLEN" {
+		return max(i.xlen()-t.maxLen, 0)
+	}
+	return i.stream.search(t.minId)
+}
+
+// toArgs writes the trimming back as command args, for the replication
+func (t streamTrim) toArgs() [][]byte {
+	if t.strategy == "MAXLEN" {
+		return [][]byte{[]byte("MAXLEN"), []byte(strconv.Itoa(t.maxLen))}
+	}
+	return [][]byte{[]byte("MINID"), []byte(t.minId.String())}
+}
+
+func newStreamEntryResponse(entry streamEntry) element {
+	if entry.fields == nil {
+		// Still pending in a consumer group, but trimmed from the stream
+		return newArrayResponse([]element{
+			newStringResponse([]byte(entry.id.String())),
+			newNullArrayResponse("Entry deleted"),
+		})
+	}
+	return newArrayResponse([]element{
+		newStringResponse([]byte(entry.id.String())),
+		newBytesArrayResponse(entry.fields),
+	})
+}
+
+func newStreamEntriesResponse(entries []streamEntry) element {
+	elements := make([]element, 0, len(entries))
+	for _, entry := range entries {
+		elements = append(elements, newStreamEntryResponse(entry))
+	}
+	return newArrayResponse(elements)
+}
+
+// runXadd appends an entry, generating its id if given as "*" (or "ms-*").
+// It is replicated with the actual id, so the replicas get the same entry.
+func runXadd(command *command, server *AetherServer) response {
+	fail := func(msg string) response {
+		command.dontReplicate()
+		return newErrorResponse(msg, false)
+	}
+
+	args := command.getArgs()
+	var trim *streamTrim
+	if isStreamTrim(args[0]) {
+		t, read, err := parseStreamTrim(args)
+		if err != nil {
+			return fail(err.Error())
+		}
+		trim = &t
+		args = args[read:]
+	}
+	if len(args) < 3 || len(args)%2 == 0 {
+		return fail("wrong number of arguments for 'XADD' command")
+	}
+
+	// The id is checked before the stream gets created, so a bad one leaves no empty stream behind
+	i, found, isStream := server.hm.getStream(command.key)
+	if found && !isStream {
+		command.dontReplicate()
+		return wrongTypeResponse
+	}
+	if !found {
+		i = newStreamItem(command.key)
+	}
+
+	id, err := genStreamId(i, string(args[0]))
+	if err != nil {
+		return fail(err.Error())
+	}
+	if !found {
+		server.hm.put(i)
+	}
+
+	fields := args[1:]
+	server.hm.xadd(i, id, fields)
+	replication := [][]byte{}
+	if trim != nil {
+		server.hm.xtrim(i, *trim)
+		replication = append(replication, trim.toArgs()...)
+	}
+	replication = append(replication, []byte(id.String()))
+	command.replicateAs(newArgsCommand(commandXadd, command.key, append(replication, fields...)))
+
+	server.signalKeyAsReady(command.key)
+	return newStringResponse([]byte(id.String()))
+}
+
+// genStreamId resolves the id given to XADD, which must be greater than the
+// id of the last entry of the stream
+func genStreamId(i *item, arg string) (streamId, error) {
+	last := i.getLastStreamId()
+	if arg == "*" {
+		return i.stream.nextId(uint64(nowMillis()))
+	}
+
+	var id streamId
+	var err error
+	if ms, found := strings.CutSuffix(arg, "-*"); found {
+		id, err = parseStreamId(ms, 0)
+		switch {
+		case err != nil:
+		case id.ms == last.ms && !last.isZero() && last.seq < math.MaxUint64:
+			id.seq = last.seq + 1
+		case id.ms == last.ms && !last.isZero():
+			id = last // No sequence left for this time, refused below
+		case id.isZero():
+			id.seq = 1
+		}
+	} else {
+		id, err = parseStreamId(arg, 0)
+	}
+
+	switch {
+	case err != nil:
+		return id, err
+	case id.isZero():
+		return id, fmt.Errorf("The ID specified in XADD must be greater than 0-0")
+	case !last.less(id):
+		return id, fmt.Errorf("The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	return id, nil
+}
+
+// parseRangeId reads an end of a XRANGE, where "-" and "+" are the smallest
+// and greatest ids and a "(" prefix makes the end exclusive
+func parseRangeId(arg string, isEnd bool) (streamId, bool, error) {
+	switch arg {
+	case "-":
+		return streamId{}, true, nil
+	case "+":
+		return maxStreamId, true, nil
+	}
+
+	exclusive := strings.HasPrefix(arg, "(")
+	seq := uint64(0)
+	if isEnd {
+		seq = math.MaxUint64
+	}
+	id, err := parseStreamId(strings.TrimPrefix(arg, "("), seq)
+	if err != nil || !exclusive {
+		return id, true, err
+	}
+	if isEnd {
+		id, ok := id.prev()
+		return id, ok, nil
+	}
+	id, ok := id.next()
+	return id, ok, nil
+}
+
+func runXrange(command *command, server *AetherServer) response {
+	args := command.getArgs()
+	start, startOk, err := parseRangeId(string(args[0]), false)
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+	end, endOk, err := parseRangeId(string(args[1]), true)
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+
+	count := -1
+	if len(args) > 2 {
+		if len(args) != 4 || strings.ToUpper(string(args[2])) != "COUNT" {
+			return newErrorResponse("syntax error", false)
+		}
+		count, err = strconv.Atoi(string(args[3]))
+		if err != nil || count < 0 {
+			return notAnIntegerResponse
+		}
+	}
+
+	i, found, isStream := server.hm.getStream(command.key)
+	switch {
+	case found && !isStream:
+		return wrongTypeResponse
+	case !found || !startOk || !endOk:
+		return newStreamEntriesResponse([]streamEntry{})
+	}
+	return newStreamEntriesResponse(i.xrange(start, end, count))
+}
+
+func runXlen(command *command, server *AetherServer) response {
+	i, found, isStream := server.hm.getStream(command.key)
+	switch {
+	case found && !isStream:
+		return wrongTypeResponse
+	case !found:
+		return newIntegerResponse(0)
+	}
+	return newIntegerResponse(i.xlen())
+}
+
+func runXtrim(command *command, server *AetherServer) response {
+	args := command.getArgs()
+	if !isStreamTrim(args[0]) {
+		return newErrorResponse("syntax error", false)
+	}
+	trim, read, err := parseStreamTrim(args)
+	if err != nil || read != len(args) {
+		return newErrorResponse("syntax error", false)
+	}
+
+	i, found, isStream := server.hm.getStream(command.key)
+	switch {
+	case found && !isStream:
+		return wrongTypeResponse
+	case !found:
+		return newIntegerResponse(0)
+	}
+	return newIntegerResponse(server.hm.xtrim(i, trim))
+}
+
+// runXsetid sets the last id of the stream, as long as it isn't before the
+// last entry
+func runXsetid(command *command, server *AetherServer) response {
+	id, err := parseStreamId(string(command.getArg(0)), 0)
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+
+	i, found, isStream := server.hm.getStream(command.key)
+	switch {
+	case found && !isStream:
+		return wrongTypeResponse
+	case !found:
+		return newErrorResponse("no such key", false)
+	}
+
+	if n := i.xlen(); n > 0 && id.less(i.stream.entries[n-1].id) {
+		return newErrorResponse("The ID specified in XSETID is smaller than the target stream top item", false)
+	}
+	server.hm.xsetid(i, id)
+	return okResponse
+}
+
+// streamRead is a XREAD of some streams from the given ids on
+type streamRead struct {
+	keys  []string
+	ids   []streamId
+	count int
+}
+
+// read returns the entries after the ids of the streams that have any, or
+// false if none has
+func (r *streamRead) read(server *AetherServer) (element, bool) {
+	streams := make([]element, 0)
+	for n, key := range r.keys {
+		i, found, isStream := server.hm.getStream(key)
+		if !found || !isStream {
+			continue
+		}
+		entries := i.xreadAfter(r.ids[n], r.count)
+		if len(entries) > 0 {
+			streams = append(streams, newArrayResponse([]element{
+				newStringResponse([]byte(key)),
+				newStreamEntriesResponse(entries),
+			}))
+		}
+	}
+	return newArrayResponse(streams), len(streams) > 0
+}
+
+// readOptions are the options of XREAD and XREADGROUP, besides the streams
+type readOptions struct {
+	count    int
+	block    bool
+	deadline time.Time // Zero means wait forever
+	noack    bool
+	keys     []string
+	ids      []string
+}
+
+// parseReadOptions reads "[COUNT n] [BLOCK millis] [NOACK] STREAMS key... id...",
+// where NOACK is only taken by XREADGROUP
+func parseReadOptions(args []string, group bool) (readOptions, response) {
+	opts := readOptions{count: -1}
+
+	n := 0
+	for ; n < len(args); n++ {
+		option := strings.ToUpper(args[n])
+		if option == "STREAMS" {
+			break
+		}
+		if option == "NOACK" && group {
+			opts.noack = true
+			continue
+		}
+		if n+1 >= len(args) {
+			break
+		}
+		switch option {
+		case "COUNT":
+			count, err := strconv.Atoi(args[n+1])
+			if err != nil || count < 0 {
+				return opts, notAnIntegerResponse
+			}
+			opts.count = count
+		case "BLOCK":
+			millis, err := strconv.ParseInt(args[n+1], 10, 64)
+			if err != nil || millis < 0 || millis > math.MaxInt64/int64(time.Millisecond) {
+				return opts, newErrorResponse("timeout is not an integer or out of range", false)
+			}
+			opts.block = true
+			if millis > 0 {
+				opts.deadline = time.Now().Add(time.Duration(millis) * time.Millisecond)
+			}
+		default:
+			return opts, newErrorResponse("syntax error", false)
+		}
+		n++
+	}
+
+	streams := args[min(n+1, len(args)):]
+	if n >= len(args) || strings.ToUpper(args[n]) != "STREAMS" || len(streams) == 0 || len(streams)%2 != 0 {
+		return opts, newErrorResponse("Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified", false)
+	}
+	half := len(streams) / 2
+	opts.keys = streams[:half]
+	opts.ids = streams[half:]
+	return opts, nil
+}
+
+// runXread reads the streams after the given ids, or parks the client until
+// any of them gets new entries if BLOCK is given
+func runXread(command *command, c *aetherClient, server *AetherServer) response {
+	opts, failure := parseReadOptions(command.getKeys(), false)
+	if failure != nil {
+		return failure
+	}
+
+	r := &streamRead{keys: opts.keys, count: opts.count}
+	for n, arg := range opts.ids {
+		i, found, isStream := server.hm.getStream(r.keys[n])
+		if found && !isStream {
+			return wrongTypeResponse
+		}
+		if arg == "$" {
+			// Only the entries added from now on
+			var last streamId
+			if found {
+				last = i.getLastStreamId()
+			}
+			r.ids = append(r.ids, last)
+			continue
+		}
+		id, err := parseStreamId(arg, 0)
+		if err != nil {
+			return newErrorResponse(err.Error(), false)
+		}
+		r.ids = append(r.ids, id)
+	}
+
+	if reply, ok := r.read(server); ok {
+		return reply
+	}
+	if !opts.block || c == nil || server.isExecuting() {
+		return newNullArrayResponse("No entries found")
+	}
+
+	server.block(c, &blockingState{
+		command:  command,
+		keys:     r.keys,
+		deadline: opts.deadline,
+		serve: func(s *AetherServer, _ string) (element, bool) {
+			return r.read(s)
+		},
+	})
+
+	return nil // The reply will be sent when unblocked
+}
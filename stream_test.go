@@ -0,0 +1,217 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func streamArgs(values ...string) [][]byte {
+	args := make([][]byte, 0, len(values))
+	for _, value := range values {
+		args = append(args, []byte(value))
+	}
+	return args
+}
+
+func TestStreamIds(t *testing.T) {
+	assert := assert.New(t)
+
+	id, err := parseStreamId("1700-3", 0)
+	assert.Nil(err)
+	assert.Equal(streamId{ms: 1700, seq: 3}, id)
+	assert.Equal("1700-3", id.String())
+
+	id, _ = parseStreamId("1700", 9)
+	assert.Equal(streamId{ms: 1700, seq: 9}, id, "the sequence defaults to the given one")
+
+	_, err = parseStreamId("17a0-1", 0)
+	assert.NotNil(err)
+
+	s := &stream{lastId: streamId{ms: 1700, seq: 3}}
+	id, _ = s.nextId(1700)
+	assert.Equal(streamId{ms: 1700, seq: 4}, id)
+	id, _ = s.nextId(1600)
+	assert.Equal(streamId{ms: 1700, seq: 4}, id, "the ids never go back")
+	id, _ = s.nextId(1800)
+	assert.Equal(streamId{ms: 1800}, id)
+
+	s.lastId = maxStreamId
+	_, err = s.nextId(1800)
+	assert.NotNil(err, "no id left")
+}
+
+func TestXaddAfterTheGreatestId(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	runStreamCommand(server, nil, commandXadd, "s", "18446744073709551615-18446744073709551615", "f", "v")
+	exhausted := newErrorResponse("The stream has exhausted the last possible ID, unable to add more items", false)
+	assert.Equal(exhausted, runStreamCommand(server, nil, commandXadd, "s", "*", "f", "v"))
+	assert.IsType(&rawBytesResponse{}, runStreamCommand(server, nil, commandXadd, "s", "18446744073709551615-*", "f", "v"))
+	assert.Equal(1, server.hm.data["s"].xlen())
+
+	runStreamCommand(server, nil, commandQpush, "q", "a", "ID", "18446744073709551615-18446744073709551615")
+	assert.Equal(exhausted, runStreamCommand(server, nil, commandQpush, "q", "b"))
+	assert.Equal(1, server.hm.data["q"].qlen())
+}
+
+func TestXaddAndXrange(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), waiting: newWaitingList()}
+	xadd := func(args ...string) response {
+		return runXadd(newArgsCommand(commandXadd, "s", streamArgs(args...)), server)
+	}
+
+	assert.Equal(newStringResponse([]byte("5-1")), xadd("5-1", "a", "1"))
+	assert.Equal(newStringResponse([]byte("5-2")), xadd("5-*", "b", "2"))
+	assert.Equal(newStringResponse([]byte("7-0")), xadd("7", "c", "3"))
+	smaller := newErrorResponse("The ID specified in XADD is equal or smaller than the target stream top item", false)
+	assert.Equal(smaller, xadd("6-0", "d", "4"))
+	assert.IsType(&rawBytesResponse{}, xadd("8-0", "a"), "field without a value")
+
+	auto := runXadd(newArgsCommand(commandXadd, "s", streamArgs("*", "e", "5")), server)
+	assert.IsType(&stringResponse{}, auto)
+
+	i, _, _ := server.hm.getStream("s")
+	assert.Equal(4, i.xlen())
+
+	all := i.xrange(streamId{}, maxStreamId, -1)
+	assert.Len(all, 4)
+	assert.Equal([][]byte{[]byte("b"), []byte("2")}, all[1].fields)
+
+	xrange := func(args ...string) []any {
+		r := runXrange(newArgsCommand(commandXrange, "s", streamArgs(args...)), server)
+		return r.(element).toNative().([]any)
+	}
+	assert.Len(xrange("-", "+"), 4)
+	assert.Len(xrange("5", "5"), 2, "a bare end takes every sequence of the milli")
+	assert.Len(xrange("(5-1", "7"), 2)
+	assert.Len(xrange("-", "+", "COUNT", "1"), 1)
+	assert.Equal([]any{"7-0", []any{"c", "3"}}, xrange("6", "7")[0])
+
+	invalid := runXadd(newArgsCommand(commandXadd, "new", streamArgs("0-0", "a", "1")), server)
+	assert.Equal(newErrorResponse("The ID specified in XADD must be greater than 0-0", false), invalid)
+	assert.NotContains(server.hm.data, "new", "a bad id creates no stream")
+}
+
+func TestXaddReplicatesTheId(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), waiting: newWaitingList()}
+	xadd := newArgsCommand(commandXadd, "s", streamArgs("MAXLEN", "~", "1", "*", "a", "1"))
+	id := runXadd(xadd, server).(element).toNative()
+
+	replication := xadd.getReplication()
+	assert.Equal(commandXadd, replication.getCode())
+	assert.Equal(streamArgs("MAXLEN", "1", id.(string), "a", "1"), replication.getArgs())
+
+	failed := newArgsCommand(commandXadd, "s", streamArgs("1-1", "a", "1"))
+	runXadd(failed, server)
+	assert.Nil(failed.getReplication())
+}
+
+func TestXtrim(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), waiting: newWaitingList()}
+	for _, id := range []string{"1-0", "2-0", "3-0", "4-0"} {
+		runXadd(newArgsCommand(commandXadd, "s", streamArgs(id, "f", "v")), server)
+	}
+	i, _, _ := server.hm.getStream("s")
+	memory := i.getMemory()
+
+	xtrim := func(args ...string) response {
+		return runXtrim(newArgsCommand(commandXtrim, "s", streamArgs(args...)), server)
+	}
+	assert.Equal(newIntegerResponse(1), xtrim("MAXLEN", "3"))
+	assert.Equal(newIntegerResponse(1), xtrim("MINID", "=", "3"))
+	assert.Equal(newIntegerResponse(0), xtrim("MAXLEN", "5"))
+	assert.Equal(2, i.xlen())
+	assert.Less(i.getMemory(), memory)
+
+	assert.Equal(newIntegerResponse(2), xtrim("MAXLEN", "0"))
+	assert.Contains(server.hm.data, "s", "emptied streams are kept")
+	assert.Equal(streamId{ms: 4}, i.getLastStreamId())
+}
+
+func TestStreamRestoreCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	i := newStreamItem("s")
+	hm.put(i)
+	hm.xadd(i, streamId{ms: 1, seq: 1}, streamArgs("a", "1"))
+	hm.xadd(i, streamId{ms: 2}, streamArgs("b", "2", "c", "3"))
+
+	assert.Equal([][][]byte{
+		streamArgs("XADD", "s", "1-1", "a", "1"),
+		streamArgs("XADD", "s", "2-0", "b", "2", "c", "3"),
+	}, i.genRestoreCommands())
+
+	hm.xtrim(i, streamTrim{strategy: "MAXLEN"})
+	assert.Equal([][][]byte{
+		streamArgs("XADD", "s", "MAXLEN", "0", "0-1", "", ""),
+		streamArgs("XSETID", "s", "2-0"),
+	}, i.genRestoreCommands(), "an empty stream keeps its last id")
+}
+
+func TestEmptyStreamRestored(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	runStreamCommand(server, nil, commandXgroup, "CREATE", "s", "g", "$", "MKSTREAM")
+	runStreamCommand(server, nil, commandXgroup, "DESTROY", "s", "g")
+
+	restored := newStreamServer()
+	for _, pieces := range server.hm.data["s"].genRestoreCommands() {
+		code := commandCode(pieces[0])
+		commandRunners[code](newArgsCommand(code, string(pieces[1]), pieces[2:]), nil, restored)
+	}
+	assert.Contains(restored.hm.data, "s", "never had entries nor groups left")
+	assert.Equal(0, restored.hm.data["s"].xlen())
+	assert.True(restored.hm.data["s"].getLastStreamId().isZero())
+}
+
+func TestXsetid(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newStreamServer()
+	assert.Equal(newErrorResponse("no such key", false), runStreamCommand(server, nil, commandXsetid, "s", "1-0"))
+	runStreamCommand(server, nil, commandXadd, "s", "2-0", "a", "1")
+	assert.IsType(&rawBytesResponse{}, runStreamCommand(server, nil, commandXsetid, "s", "1-0"), "before the last entry")
+	assert.Equal(okResponse, runStreamCommand(server, nil, commandXsetid, "s", "5-0"))
+	assert.IsType(&rawBytesResponse{}, runStreamCommand(server, nil, commandXadd, "s", "3-0", "a", "1"), "ids must come after the one set")
+
+	runStreamCommand(server, nil, commandSet, "str", "v")
+	assert.Same(wrongTypeResponse, runStreamCommand(server, nil, commandXsetid, "str", "1-0"))
+}
+
+func TestBlockingXread(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), waiting: newWaitingList()}
+	runXadd(newArgsCommand(commandXadd, "s", streamArgs("1-0", "a", "1")), server)
+
+	xread := func(c *aetherClient, args ...string) response {
+		return runXread(newArgsCommand(commandXread, args[0], streamArgs(args[1:]...)), c, server)
+	}
+
+	outOfRange := newErrorResponse("timeout is not an integer or out of range", false)
+	assert.Equal(outOfRange, xread(nil, "BLOCK", "9223372036854775807", "STREAMS", "s", "$"), "longer than a duration")
+
+	reply := xread(nil, "STREAMS", "s", "0")
+	assert.Equal([]any{[]any{"s", []any{[]any{"1-0", []any{"a", "1"}}}}}, reply.(element).toNative())
+	assert.IsType(&nullResponse{}, xread(nil, "STREAMS", "s", "other", "1-0", "0"))
+
+	c := newSubscriber()
+	assert.Nil(xread(c, "COUNT", "1", "BLOCK", "0", "STREAMS", "other", "s", "$", "$"))
+	assert.True(c.isBlocked())
+
+	runXadd(newArgsCommand(commandXadd, "s", streamArgs("2-0", "b", "2")), server)
+	server.serveBlockedClients()
+
+	assert.False(c.isBlocked())
+	assert.Equal([]any{[]any{[]any{"s", []any{[]any{"2-0", []any{"b", "2"}}}}}}, takeReplies(c))
+}
@@ -0,0 +1,245 @@
+package main
+
+import "fmt"
+
+// transaction holds the commands a client queued after MULTI
+type transaction struct {
+	commands []*command
+	// Whether a command failed to be queued, so EXEC must discard them all
+	aborted bool
+}
+
+// Commands that run right away even inside a transaction
+var transactionCommands = []commandCode{
+	commandMulti,
+	commandExec,
+	commandDiscard,
+	commandWatch,
+	commandUnwatch,
+	commandExit,
+}
+
+// Commands that change the connection itself, so they can't be queued
+var unqueueableCommands = []commandCode{
+	commandHello,
+	commandSync,
+	commandSubscribe,
+	commandUnsubscribe,
+	commandPsubscribe,
+	commandPunsubscribe,
+}
+
+func (command *command) isTransactionCommand() bool {
+	for _, code := range transactionCommands {
+		if code == command.getCode() {
+			return true
+		}
+	}
+	return false
+}
+
+func (command *command) isQueueable() bool {
+	for _, code := range unqueueableCommands {
+		if code == command.getCode() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *aetherClient) inTransaction() bool {
+	return c.transaction != nil
+}
+
+func (c *aetherClient) abortTransaction() {
+	if c.inTransaction() {
+		c.transaction.aborted = true
+	}
+}
+
+func (c *aetherClient) takeTransaction() *transaction {
+	t := c.transaction
+	c.transaction = nil
+	return t
+}
+
+// watch remembers the version of the key, EXEC fails if it gets changed
+func (c *aetherClient) watch(key string, version uint64) {
+	if c.watched == nil {
+		c.watched = make(map[string]uint64)
+	}
+	if _, found := c.watched[key]; !found {
+		c.watched[key] = version
+	}
+}
+
+func (c *aetherClient) unwatch() {
+	c.watched = nil
+}
+
+// queueInTransaction holds the command until EXEC. Commands that would be
+// refused anyway are refused now, making EXEC discard the whole transaction.
+func (s *AetherServer) queueInTransaction(client *aetherClient, command *command) response {
+	if !command.isQueueable() {
+		client.abortTransaction()
+		return newErrorResponse(fmt.Sprintf("%v is not allowed inside a transaction", command.getCode()), false)
+	}
+	if s.isAReplica() && !command.canRunOnAReplica() {
+		client.abortTransaction()
+		return readOnlyResponse
+	}
+	client.transaction.commands = append(client.transaction.commands, command)
+	return queuedResponse
+}
+
+func init() {
+	// Set apart since EXEC runs the other runners, which would make the
+	// initialization of the runners depend on itself
+	commandRunners[commandExec] = func(_ *command, c *aetherClient, s *AetherServer) response {
+		return runExec(c, s)
+	}
+}
+
+func runMulti(client *aetherClient) response {
+	if client.inTransaction() {
+		return newErrorResponse("MULTI calls can not be nested", false)
+	}
+	client.transaction = &transaction{commands: make([]*command, 0)}
+	return okResponse
+}
+
+func runDiscard(client *aetherClient) response {
+	if !client.inTransaction() {
+		return newErrorResponse("DISCARD without MULTI", false)
+	}
+	client.takeTransaction()
+	client.unwatch()
+	return okResponse
+}
+
+func runWatch(command *command, client *aetherClient, server *AetherServer) response {
+	if client.inTransaction() {
+		return newErrorResponse("WATCH inside MULTI is not allowed", false)
+	}
+	for _, key := range command.getKeys() {
+		client.watch(key, server.hm.getVersion(key))
+	}
+	return okResponse
+}
+
+// runExec runs the queued commands back to back, so no other client sees
+// the keys halfway through the transaction
+func runExec(client *aetherClient, server *AetherServer) response {
+	if !client.inTransaction() {
+		return newErrorResponse("EXEC without MULTI", false)
+	}
+
+	t := client.takeTransaction()
+	defer client.unwatch()
+
+	if t.aborted {
+		return newCodedErrorResponse("EXECABORT", "Transaction discarded because of previous errors", false)
+	}
+	for key, version := range client.watched {
+		if server.hm.getVersion(key) != version {
+			return newNullArrayResponse("Transaction aborted, a watched key was changed")
+		}
+	}
+
+	server.beginExec()
+	responses := make([]element, 0, len(t.commands))
+	for _, command := range t.commands {
+		responses = append(responses, server.run(client, command).(element))
+	}
+	server.endExec()
+
+	return newArrayResponse(responses)
+}
+
+func (s *AetherServer) isExecuting() bool {
+	return s.executing
+}
+
+// beginExec starts holding the propagated writes, so the transaction reaches
+// the append-only log and the replicas as a single unit
+func (s *AetherServer) beginExec() {
+	s.executing = true
+	s.execWrites = make([]*command, 0)
+}
+
+// endExec propagates the writes of the transaction wrapped in MULTI/EXEC,
+// unless there is only one (or none) of them. The published messages go to
+// the replicas in order with the writes, but never to the append-only log.
+func (s *AetherServer) endExec() {
+	writes := s.execWrites
+	s.executing = false
+	s.execWrites = nil
+
+	logged := make([]*command, 0, len(writes))
+	for _, c := range writes {
+		if !c.isMessage() {
+			logged = append(logged, c)
+		}
+	}
+	for _, c := range wrapInTransaction(logged) {
+		s.appendToLog(c)
+	}
+	for _, c := range wrapInTransaction(writes) {
+		s.broadcast(c)
+	}
+}
+
+func wrapInTransaction(writes []*command) []*command {
+	if len(writes) <= 1 {
+		return writes
+	}
+	wrapped := make([]*command, 0, len(writes)+2)
+	wrapped = append(wrapped, newCommand(commandMulti, "", []byte{}, 0))
+	wrapped = append(wrapped, writes...)
+	return append(wrapped, newCommand(commandExec, "", []byte{}, 0))
+}
+
+// propagateAll propagates the writes of a single command as a unit, wrapped
+// in MULTI/EXEC if more than one (within a transaction they already are)
+func (s *AetherServer) propagateAll(writes []*command) {
+	if s.isExecuting() {
+		for _, c := range writes {
+			s.propagate(c)
+		}
+		return
+	}
+	s.beginExec()
+	for _, c := range writes {
+		s.propagate(c)
+	}
+	s.endExec()
+}
+
+// transactionBuffer groups the commands sent between MULTI and EXEC by the
+// master (or found in the append-only log), so they are applied all at once
+type transactionBuffer struct {
+	commands []*command
+}
+
+// add takes the next command, returning the commands that can be applied
+func (b *transactionBuffer) add(c *command) []*command {
+	switch {
+	case c.getCode() == commandMulti:
+		b.commands = make([]*command, 0)
+		return nil
+	case c.getCode() == commandExec:
+		commands := b.commands
+		b.commands = nil
+		return commands
+	case b.commands != nil:
+		b.commands = append(b.commands, c)
+		return nil
+	default:
+		return []*command{c}
+	}
+}
+
+// pending returns whether a transaction was started but not finished yet
+func (b *transactionBuffer) pending() bool {
+	return b.commands != nil
+}
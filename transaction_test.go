@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	assert.Equal(uint64(0), hm.getVersion("k"))
+
+	hm.set("k", []byte("v"), 0)
+	set := hm.getVersion("k")
+	assert.NotEqual(uint64(0), set)
+
+	i, _ := hm.get("k")
+	hm.update(i, []byte("w"))
+	updated := hm.getVersion("k")
+	assert.Greater(updated, set)
+
+	hm.rm("k")
+	assert.Equal(uint64(0), hm.getVersion("k"))
+	hm.set("k", []byte("v"), 0)
+	assert.Greater(hm.getVersion("k"), updated, "never gets an old version back")
+
+	hm.set("gone", []byte("v"), nowMillis()+60000)
+	hm.data["gone"].deadline = nowMillis() - 1
+	assert.Equal(uint64(0), hm.getVersion("gone"))
+}
+
+func TestExecRunsTheQueuedCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), replicas: newClientSet(), waiting: newWaitingList()}
+	client := &aetherClient{}
+
+	assert.Same(okResponse, runMulti(client))
+	assert.Same(queuedResponse, server.queueInTransaction(client, newSetCommand("a", []byte("1"), 0)))
+	assert.Same(queuedResponse, server.queueInTransaction(client, newArgsCommand(commandIncr, "a", [][]byte{})))
+	assert.Same(queuedResponse, server.queueInTransaction(client, newArgsCommand(commandBlpop, "l", [][]byte{[]byte("0")})))
+
+	reply := runExec(client, server)
+	assert.Equal([]any{"OK", int64(2), nil}, reply.(element).toNative())
+	assert.False(client.inTransaction())
+	assert.False(client.isBlocked(), "blocking commands don't block inside transactions")
+	assert.False(server.isExecuting())
+}
+
+func TestWatchedKeyAbortsExec(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &AetherServer{hm: newHashmap(), replicas: newClientSet()}
+	client := &aetherClient{}
+
+	runWatch(newArgsCommand(commandWatch, "a", [][]byte{}), client, server)
+	server.hm.set("a", []byte("changed"), 0)
+	runMulti(client)
+	server.queueInTransaction(client, newSetCommand("a", []byte("1"), 0))
+
+	assert.IsType(&nullResponse{}, runExec(client, server))
+	assert.Equal([]byte("changed"), server.hm.data["a"].getValue())
+	assert.Nil(client.watched, "EXEC unwatches the keys")
+
+	runMulti(client)
+	client.abortTransaction()
+	reply := runExec(client, server)
+	assert.Contains(reply.(element).toNative(), "EXECABORT")
+}
+
+func TestTransactionBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	set := newSetCommand("a", []byte("1"), 0)
+	rm := newCommand(commandRm, "b", []byte{}, 0)
+	buffer := &transactionBuffer{}
+
+	assert.Equal([]*command{set}, buffer.add(set))
+	assert.Empty(buffer.add(newCommand(commandMulti, "", []byte{}, 0)))
+	assert.Empty(buffer.add(set))
+	assert.Empty(buffer.add(rm))
+	assert.True(buffer.pending())
+	assert.Equal([]*command{set, rm}, buffer.add(newCommand(commandExec, "", []byte{}, 0)))
+	assert.False(buffer.pending())
+}
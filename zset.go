@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sortedSet indexes the members scores by member, for the O(1) lookups, and
+// keeps them ordered in a skip list, for the rank and range queries
+type sortedSet struct {
+	scores map[string]float64
+	zsl    *skiplist
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{
+		scores: make(map[string]float64),
+		zsl:    newSkiplist(),
+	}
+}
+
+// add sets the member score returning true if the member is a new one
+func (z *sortedSet) add(member string, score float64) bool {
+	current, found := z.scores[member]
+	if found {
+		if current == score {
+			return false
+		}
+		z.zsl.delete(current, member)
+	}
+	z.zsl.insert(score, member)
+	z.scores[member] = score
+	return !found
+}
+
+func (z *sortedSet) rem(member string) bool {
+	score, found := z.scores[member]
+	if !found {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.scores, member)
+	return true
+}
+
+func (z *sortedSet) clone() *sortedSet {
+	c := newSortedSet()
+	for n := z.zsl.byRank(0); n != nil; n = n.next() {
+		c.add(n.member, n.score)
+	}
+	return c
+}
+
+// scoreRange is a score interval as given to ZRANGEBYSCORE, where each end
+// can be exclusive (e.g. "(1.5") or infinite ("-inf" and "+inf")
+type scoreRange struct {
+	min          float64
+	max          float64
+	minExclusive bool
+	maxExclusive bool
+}
+
+func (r scoreRange) aboveMin(score float64) bool {
+	if r.minExclusive {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r scoreRange) belowMax(score float64) bool {
+	if r.maxExclusive {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+func parseScoreRange(min []byte, max []byte) (scoreRange, error) {
+	r := scoreRange{}
+	var err1, err2 error
+	r.min, r.minExclusive, err1 = parseScoreBound(min)
+	r.max, r.maxExclusive, err2 = parseScoreBound(max)
+	if err1 != nil || err2 != nil {
+		return r, fmt.Errorf("min or max is not a float")
+	}
+	return r, nil
+}
+
+func parseScoreBound(arg []byte) (float64, bool, error) {
+	bound := string(arg)
+	exclusive := strings.HasPrefix(bound, "(")
+	if exclusive {
+		bound = bound[1:]
+	}
+	score, err := parseScore([]byte(bound))
+	return score, exclusive, err
+}
+
+func parseScore(arg []byte) (float64, error) {
+	score, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, fmt.Errorf("value is not a valid float")
+	}
+	return score, nil
+}
+
+func newSortedSetItem(key string) *item {
+	return &item{
+		key:      key,
+		kind:     kindSortedSet,
+		zset:     newSortedSet(),
+		elements: newKeyIndex(),
+		creation: time.Now(),
+	}
+}
+
+func (i *item) zadd(member string, score float64) bool {
+	i.elements.add(member)
+	return i.zset.add(member, score)
+}
+
+func (i *item) zrem(member string) bool {
+	i.elements.rm(member)
+	return i.zset.rem(member)
+}
+
+func (i *item) zscore(member string) (float64, bool) {
+	score, found := i.zset.scores[member]
+	return score, found
+}
+
+func (i *item) zrank(member string) (int, bool) {
+	score, found := i.zscore(member)
+	if !found {
+		return 0, false
+	}
+	return i.zset.zsl.rank(score, member)
+}
+
+func (i *item) zcard() int {
+	return len(i.zset.scores)
+}
+
+// zrange returns the members between the ranks (negative ones count from the end)
+func (i *item) zrange(start int, stop int) []*skiplistNode {
+	nodes := make([]*skiplistNode, 0)
+	start, stop, ok := normalizeRange(start, stop, i.zcard())
+	if !ok {
+		return nodes
+	}
+	n := i.zset.zsl.byRank(start)
+	for rank := start; rank <= stop; rank++ {
+		nodes = append(nodes, n)
+		n = n.next()
+	}
+	return nodes
+}
+
+// zrangeByScore returns the members with scores inside the range, skipping
+// the first offset ones and returning at most count (negative is no limit)
+func (i *item) zrangeByScore(r scoreRange, offset int, count int) []*skiplistNode {
+	nodes := make([]*skiplistNode, 0)
+	n := i.zset.zsl.firstInRange(r)
+	for ; n != nil && offset > 0; offset-- {
+		n = n.next()
+	}
+	for ; n != nil && count != 0 && r.belowMax(n.score); count-- {
+		nodes = append(nodes, n)
+		n = n.next()
+	}
+	return nodes
+}
+
+func (i *item) cloneSortedSet() *sortedSet {
+	return i.zset.clone()
+}
+
+func (i *item) genZaddCommandPieces() [][]byte {
+	pieces := [][]byte{
+		[]byte(commandZadd),
+		[]byte(i.getKey()),
+	}
+
+	for _, n := range i.zrange(0, -1) {
+		pieces = append(pieces, []byte(formatDouble(n.score)), []byte(n.member))
+	}
+
+	return pieces
+}
+
+func (hm *hashmap) getSortedSet(key string) (*item, bool, bool) {
+	return hm.lookup(key, kindSortedSet)
+}
+
+func (hm *hashmap) getOrCreateSortedSet(key string) (*item, bool) {
+	return hm.lookupOrCreate(key, kindSortedSet, newSortedSetItem)
+}
+
+func (hm *hashmap) zadd(i *item, member string, score float64) bool {
+	hm.modified(i)
+	added := i.zadd(member, score)
+	if added {
+		hm.resize(i, entryMemory([]byte(member)))
+	}
+	return added
+}
+
+func (hm *hashmap) zrem(i *item, member string) bool {
+	removed := i.zrem(member)
+	if removed {
+		hm.modified(i)
+		hm.resize(i, -entryMemory([]byte(member)))
+	}
+	hm.rmIfEmpty(i)
+	return removed
+}
+
+func newSortedSetRangeResponse(nodes []*skiplistNode, withScores bool) element {
+	elements := make([]element, 0, len(nodes))
+	for _, n := range nodes {
+		elements = append(elements, newStringResponse([]byte(n.member)))
+		if withScores {
+			elements = append(elements, newDoubleResponse(n.score))
+		}
+	}
+	return newArrayResponse(elements)
+}
+
+func runZrange(command *command, server *AetherServer) response {
+	start, err1 := command.getIntArg(0)
+	stop, err2 := command.getIntArg(1)
+	if err1 != nil || err2 != nil {
+		return notAnIntegerResponse
+	}
+
+	withScores := false
+	for _, option := range command.getArgs()[2:] {
+		if !strings.EqualFold(string(option), "WITHSCORES") {
+			return newErrorResponse("syntax error", false)
+		}
+		withScores = true
+	}
+
+	i, found, isSortedSet := server.hm.getSortedSet(command.key)
+	switch {
+	case found && !isSortedSet:
+		return wrongTypeResponse
+	case !found:
+		return newArrayResponse([]element{})
+	}
+	return newSortedSetRangeResponse(i.zrange(start, stop), withScores)
+}
+
+func runZrangeByScore(command *command, server *AetherServer) response {
+	args := command.getArgs()
+	r, err := parseScoreRange(args[0], args[1])
+	if err != nil {
+		return newErrorResponse(err.Error(), false)
+	}
+
+	withScores := false
+	offset, count := 0, -1
+	options := args[2:]
+	for n := 0; n < len(options); n++ {
+		switch strings.ToUpper(string(options[n])) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if n+2 >= len(options) {
+				return newErrorResponse("syntax error", false)
+			}
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(string(options[n+1]))
+			count, err2 = strconv.Atoi(string(options[n+2]))
+			if err1 != nil || err2 != nil {
+				return notAnIntegerResponse
+			}
+			if offset < 0 {
+				return newArrayResponse([]element{})
+			}
+			n += 2
+		default:
+			return newErrorResponse("syntax error", false)
+		}
+	}
+
+	i, found, isSortedSet := server.hm.getSortedSet(command.key)
+	switch {
+	case found && !isSortedSet:
+		return wrongTypeResponse
+	case !found:
+		return newArrayResponse([]element{})
+	}
+	return newSortedSetRangeResponse(i.zrangeByScore(r, offset, count), withScores)
+}
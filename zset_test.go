@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkiplistKeepsOrderAndRanks(t *testing.T) {
+	assert := assert.New(t)
+
+	z := newSortedSet()
+	scores := make(map[string]float64)
+	for n := 0; n < 1000; n++ {
+		member := fmt.Sprintf("member-%v", rand.Intn(300))
+		if rand.Intn(4) == 0 {
+			z.rem(member)
+			delete(scores, member)
+			continue
+		}
+		score := float64(rand.Intn(50))
+		z.add(member, score)
+		scores[member] = score
+	}
+
+	expected := make([]string, 0, len(scores))
+	for member := range scores {
+		expected = append(expected, member)
+	}
+	sort.Slice(expected, func(a, b int) bool {
+		if scores[expected[a]] != scores[expected[b]] {
+			return scores[expected[a]] < scores[expected[b]]
+		}
+		return expected[a] < expected[b]
+	})
+
+	assert.Equal(len(expected), z.zsl.length)
+
+	for rank, member := range expected {
+		n := z.zsl.byRank(rank)
+		assert.Equal(member, n.member)
+
+		found, ok := z.zsl.rank(scores[member], member)
+		assert.True(ok)
+		assert.Equal(rank, found)
+	}
+
+	assert.Nil(z.zsl.byRank(len(expected)))
+}
+
+func TestSortedSetRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	hm := newHashmap()
+	z, isSortedSet := hm.getOrCreateSortedSet("board")
+	assert.True(isSortedSet)
+
+	hm.zadd(z, "carol", 30)
+	hm.zadd(z, "alice", 10)
+	hm.zadd(z, "bob", 20)
+	hm.zadd(z, "dave", 20)
+	assert.False(hm.zadd(z, "alice", 40), "updating a score is not adding")
+
+	members := func(nodes []*skiplistNode) []string {
+		names := make([]string, 0)
+		for _, n := range nodes {
+			names = append(names, n.member)
+		}
+		return names
+	}
+
+	assert.Equal([]string{"bob", "dave", "carol", "alice"}, members(z.zrange(0, -1)))
+	assert.Equal([]string{"carol", "alice"}, members(z.zrange(-2, 10)))
+
+	rank, found := z.zrank("alice")
+	assert.True(found)
+	assert.Equal(3, rank)
+
+	r, err := parseScoreRange([]byte("(20"), []byte("+inf"))
+	assert.Nil(err)
+	assert.Equal([]string{"carol", "alice"}, members(z.zrangeByScore(r, 0, -1)))
+
+	r, _ = parseScoreRange([]byte("-inf"), []byte("30"))
+	assert.Equal([]string{"dave", "carol"}, members(z.zrangeByScore(r, 1, 2)))
+
+	r, _ = parseScoreRange([]byte("31"), []byte("39"))
+	assert.Empty(z.zrangeByScore(r, 0, -1))
+
+	_, err = parseScoreRange([]byte("abc"), []byte("1"))
+	assert.NotNil(err)
+
+	_, err = parseScore([]byte("nan"))
+	assert.NotNil(err)
+
+	hm.zadd(z, "eve", math.Inf(-1))
+	assert.Equal([][][]byte{{
+		[]byte("ZADD"), []byte("board"),
+		[]byte("-inf"), []byte("eve"),
+		[]byte("20"), []byte("bob"),
+		[]byte("20"), []byte("dave"),
+		[]byte("30"), []byte("carol"),
+		[]byte("40"), []byte("alice"),
+	}}, z.genRestoreCommands())
+
+	c := z.clone()
+	for _, member := range []string{"alice", "bob", "carol", "dave", "eve"} {
+		hm.zrem(z, member)
+	}
+	assert.Equal(5, c.zcard(), "clones must not share the members")
+
+	_, found = hm.get("board")
+	assert.False(found, "empty sorted sets must be removed")
+}